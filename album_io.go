@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The formats albums can be imported from and exported to. JSON is the
+// format of the API, CSV has a header line with the names of the columns
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+var csvHeader = []string{"id", "title", "artist", "price", "year", "genre"}
+
+// formatOfFile guesses the format of a file from its extension
+func formatOfFile(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return formatCSV
+	}
+	return formatJSON
+}
+
+func writeAlbums(w io.Writer, format string, albums []*Album) error {
+	switch format {
+	case formatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(albums)
+	case formatCSV:
+		out := csv.NewWriter(w)
+		out.Write(csvHeader)
+		for _, album := range albums {
+			out.Write([]string{strconv.FormatInt(album.ID, 10), album.Title, album.Artist, album.Price, album.Year, album.Genre})
+		}
+		out.Flush()
+		return out.Error()
+	}
+	return fmt.Errorf("unknown format %q, expected %s or %s", format, formatJSON, formatCSV)
+}
+
+// readAlbums reads albums written by `writeAlbums`. The IDs are dropped, the
+// store picks new ones. CSV columns may come in any order, and only the
+// title and the artist are required
+func readAlbums(r io.Reader, format string) ([]*Album, error) {
+	switch format {
+	case formatJSON:
+		albums := []*Album{}
+		decoder := json.NewDecoder(r)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&albums); err != nil {
+			return nil, err
+		}
+		for _, album := range albums {
+			album.ID = 0
+		}
+		return albums, nil
+	case formatCSV:
+		return readAlbumsCSV(r)
+	}
+	return nil, fmt.Errorf("unknown format %q, expected %s or %s", format, formatJSON, formatCSV)
+}
+
+func readAlbumsCSV(r io.Reader) ([]*Album, error) {
+	in := csv.NewReader(r)
+	header, err := in.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading the header: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"title", "artist"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("the header has no %s column", required)
+		}
+	}
+
+	albums := []*Album{}
+	for {
+		record, err := in.Read()
+		if err == io.EOF {
+			return albums, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return record[i]
+			}
+			return ""
+		}
+		albums = append(albums, &Album{
+			Title:  field("title"),
+			Artist: field("artist"),
+			Price:  field("price"),
+			Year:   field("year"),
+			Genre:  field("genre"),
+		})
+	}
+}
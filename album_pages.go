@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// The pages of a single album. The forms are submitted with POST, and
+// answered with a redirect to a page that shows how it went, so that
+// reloading that page doesn't submit them again
+
+type albumPage struct {
+	pageContext
+	Album *Album
+	// Errors are the messages of the invalid fields of the edit form
+	Errors map[string]string
+}
+
+type notFoundPage struct {
+	pageContext
+	Message string
+}
+
+// A formField is an input of a form, with the message of its error if the
+// submitted value was invalid
+type formField struct {
+	Name, Label, Value, Error string
+}
+
+func field(name, label, value string, errors map[string]string) formField {
+	return formField{Name: name, Label: label, Value: value, Error: errors[name]}
+}
+
+func albumURL(id int64) string {
+	return "/albums/" + strconv.FormatInt(id, 10)
+}
+
+// seeOther redirects a form submission to a page, with a message for it
+func seeOther(w http.ResponseWriter, r *http.Request, target string, f flash) {
+	setFlash(w, f)
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// sameOrigin refuses forms submitted by the pages of other sites. Browsers
+// send `Origin` with every POST, so a request without it doesn't come from
+// another site's page
+func sameOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	writeProblem(w, r, http.StatusForbidden, "Forms can only be submitted from the pages of this site.")
+	return false
+}
+
+// pageAlbum reads the album of the route, and renders the not found page if
+// there is none
+func pageAlbum(w http.ResponseWriter, r *http.Request) (*Album, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		albumNotFoundPage(w, r)
+		return nil, false
+	}
+	album, err := storeFor(r.Context()).GetAlbum(id)
+	if errors.Is(err, ErrAlbumNotFound) {
+		albumNotFoundPage(w, r)
+		return nil, false
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return nil, false
+	}
+	return album, true
+}
+
+func albumNotFoundPage(w http.ResponseWriter, r *http.Request) {
+	p := notFoundPage{pageContext: newPageContext(w, r)}
+	p.Message = p.L.T("notFound.album")
+	renderPage(w, r, http.StatusNotFound, "not-found", p)
+}
+
+func albumPageHandler(w http.ResponseWriter, r *http.Request) {
+	album, ok := pageAlbum(w, r)
+	if !ok {
+		return
+	}
+	renderPage(w, r, http.StatusOK, "album", albumPage{pageContext: newPageContext(w, r), Album: album})
+}
+
+// editAlbumPageHandler shows the edit form, with the values submitted last
+// if they were invalid
+func editAlbumPageHandler(w http.ResponseWriter, r *http.Request) {
+	album, ok := pageAlbum(w, r)
+	if !ok {
+		return
+	}
+	p := albumPage{pageContext: newPageContext(w, r), Album: album}
+	if p.Flash != nil && p.Flash.Album != nil && p.Flash.Album.ID == album.ID {
+		p.Album, p.Errors = p.Flash.Album, p.Flash.Errors
+	}
+	renderPage(w, r, http.StatusOK, "album-edit", p)
+}
+
+func editAlbumFormHandler(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(w, r) {
+		return
+	}
+	current, ok := pageAlbum(w, r)
+	if !ok {
+		return
+	}
+
+	album := Album{}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAlbumBodySize)
+	if err := decodeAlbumForm(r, &album); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "The form could not be parsed: "+err.Error())
+		return
+	}
+	album.ID = current.ID
+
+	// The messages of the flash are in the language of the page that
+	// submitted the form
+	l := localeFor(r)
+	if errs := album.Validate(); errs != nil {
+		messages := map[string]string{}
+		for _, e := range localizeAlbumErrors(l, errs) {
+			messages[e.Field] = e.Message
+		}
+		seeOther(w, r, albumURL(album.ID)+"/edit", flash{
+			Kind:    "error",
+			Message: l.T("flash.invalid"),
+			Album:   &album,
+			Errors:  messages,
+		})
+		return
+	}
+
+	err := updateAlbum(r.Context(), &album)
+	if errors.Is(err, ErrAlbumNotFound) {
+		albumNotFoundPage(w, r)
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	seeOther(w, r, albumURL(album.ID), flash{Kind: "success", Message: l.T("flash.saved")})
+}
+
+// deleteAlbumPageHandler asks for a confirmation before deleting an album
+func deleteAlbumPageHandler(w http.ResponseWriter, r *http.Request) {
+	album, ok := pageAlbum(w, r)
+	if !ok {
+		return
+	}
+	renderPage(w, r, http.StatusOK, "album-delete", albumPage{pageContext: newPageContext(w, r), Album: album})
+}
+
+func deleteAlbumFormHandler(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(w, r) {
+		return
+	}
+	album, ok := pageAlbum(w, r)
+	if !ok {
+		return
+	}
+
+	err := deleteAlbum(r.Context(), album.ID)
+	if errors.Is(err, ErrAlbumNotFound) {
+		albumNotFoundPage(w, r)
+		return
+	}
+	if errors.Is(err, ErrAlbumInCollections) {
+		seeOther(w, r, albumURL(album.ID), flash{Kind: "error", Message: localeFor(r).T("flash.collected", album.Title, album.Artist)})
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	seeOther(w, r, "/albums", flash{Kind: "success", Message: localeFor(r).T("flash.deleted", album.Title, album.Artist)})
+}
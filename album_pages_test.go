@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// submitForm posts a form the way a browser of the site does
+func submitForm(target string, form url.Values, header map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, request)
+	return recorder
+}
+
+// followRedirect gets the page a form submission redirected to, with the
+// cookies it set
+func followRedirect(t *testing.T, response *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	if response.Code != http.StatusSeeOther {
+		t.Fatalf("expected a 303 redirect, got %d: %s", response.Code, response.Body)
+	}
+	request := httptest.NewRequest("GET", response.Header().Get("Location"), nil)
+	for _, cookie := range response.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAlbumPage(t *testing.T) {
+	album := &Album{Title: "Abbey Road", Year: "1969", Genre: "Rock", Price: "19.99"}
+	catalogAlbums(t, album)
+
+	body := getPage(albumURL(album.ID)).Body.String()
+	for _, value := range []string{"Abbey Road", "1969", "Rock", "19.99", albumURL(album.ID) + "/edit"} {
+		if !strings.Contains(body, value) {
+			t.Errorf("the page should show %s:\n%s", value, body)
+		}
+	}
+
+	if response := getPage("/albums/999999999"); response.Code != http.StatusNotFound || !strings.Contains(response.Body.String(), "no album") {
+		t.Errorf("expected a not found page, got %d", response.Code)
+	}
+}
+
+func TestEditAlbumPage(t *testing.T) {
+	album := &Album{Title: "Abbey Road", Year: "1969"}
+	artist := catalogAlbums(t, album)
+	edit := albumURL(album.ID) + "/edit"
+
+	// Invalid values are sent back to the form, and nothing is saved
+	response := submitForm(edit, url.Values{"title": {"Abbey Road (Remastered)"}, "artist": {artist}, "year": {"1492"}}, nil)
+	if response.Header().Get("Location") != edit {
+		t.Fatalf("expected a redirect to the form, got %s", response.Header().Get("Location"))
+	}
+	body := followRedirect(t, response).Body.String()
+	if !strings.Contains(body, `value="Abbey Road (Remastered)"`) || !strings.Contains(body, "Year must be a year between") {
+		t.Errorf("the form should show the submitted values and their errors:\n%s", body)
+	}
+	if stored, _ := store.GetAlbum(album.ID); stored.Title != "Abbey Road" {
+		t.Errorf("an invalid album should not be saved, got %s", stored.Title)
+	}
+
+	response = submitForm(edit, url.Values{"title": {"Abbey Road (Remastered)"}, "artist": {artist}, "year": {"2019"}}, nil)
+	page := followRedirect(t, response)
+	if !strings.Contains(page.Body.String(), "The album was saved.") || !strings.Contains(page.Body.String(), "2019") {
+		t.Errorf("the album page should confirm the update:\n%s", page.Body)
+	}
+	// The message is only shown once
+	for _, cookie := range page.Result().Cookies() {
+		if cookie.Name == flashCookie && cookie.MaxAge >= 0 {
+			t.Errorf("the flash cookie should be removed once shown")
+		}
+	}
+}
+
+func TestDeleteAlbumPage(t *testing.T) {
+	album := &Album{Title: "Let It Be"}
+	catalogAlbums(t, album)
+
+	if body := getPage(albumURL(album.ID) + "/delete").Body.String(); !strings.Contains(body, "Delete Let It Be?") {
+		t.Errorf("the deletion should be confirmed first:\n%s", body)
+	}
+
+	// Other sites can't submit the form
+	response := submitForm(albumURL(album.ID)+"/delete", nil, map[string]string{"Origin": "https://evil.example.com"})
+	if response.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for another origin, got %d", response.Code)
+	}
+
+	response = submitForm(albumURL(album.ID)+"/delete", nil, map[string]string{"Origin": "http://example.com"})
+	if body := followRedirect(t, response).Body.String(); !strings.Contains(body, "Let It Be by ") {
+		t.Errorf("the catalog should confirm the deletion:\n%s", body)
+	}
+	if _, err := store.GetAlbum(album.ID); err != ErrAlbumNotFound {
+		t.Errorf("the album should be deleted, got %v", err)
+	}
+}
+
+func TestMalformedFlashIsIgnored(t *testing.T) {
+	request := httptest.NewRequest("GET", "/albums", nil)
+	request.AddCookie(&http.Cookie{Name: flashCookie, Value: "not base64!"})
+	recorder := httptest.NewRecorder()
+	if f := takeFlash(recorder, request); f != nil {
+		t.Errorf("expected no flash, got %+v", f)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Every version of the JSON API lives under its own prefix. A `/api/v2` gets
+// its own prefix and register function next to this one, reusing the v1
+// handlers for the routes whose payloads did not change, so that both
+// versions can be served side by side
+const apiV1Prefix = "/api/v1"
+
+// registerAPIv1 adds the routes of version 1 of the API to `r`, which is
+// expected to be a subrouter for `apiV1Prefix`
+func registerAPIv1(r *mux.Router) {
+	r.HandleFunc("/albums", getAlbumHandler).Methods("GET")
+	r.HandleFunc("/albums", createAlbumHandler).Methods("POST")
+	r.HandleFunc("/albums/{id:[0-9]+}", getAlbumByIDHandler).Methods("GET")
+	r.HandleFunc("/albums/{id:[0-9]+}", updateAlbumHandler).Methods("PUT")
+	r.HandleFunc("/albums/{id:[0-9]+}", deleteAlbumHandler).Methods("DELETE")
+	r.HandleFunc("/albums/events", albumEventsHandler).Methods("GET")
+
+	registerWebhookRoutes(r)
+	registerListRoutes(r)
+	registerCollectionRoutes(r)
+	registerShopRoutes(r)
+	registerPriceRoutes(r)
+}
+
+// albumURLv1 is where version 1 of the API serves the album with this ID
+func albumURLv1(id int64) string {
+	return apiV1Prefix + "/albums/" + strconv.FormatInt(id, 10)
+}
+
+// The unversioned `/album` routes predate the versioned API. They keep
+// working until `legacySunset`, but every response tells clients where to go
+var (
+	legacyDeprecated = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	legacySunset     = time.Date(2027, time.June, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// registerLegacyRoutes adds the unversioned aliases of the v1 routes to `r`
+func registerLegacyRoutes(r *mux.Router) {
+	r.Handle("/album", deprecated(getAlbumHandler, apiV1Prefix+"/albums")).Methods("GET")
+	r.Handle("/album", deprecated(createAlbumHandler, apiV1Prefix+"/albums")).Methods("POST")
+	r.Handle("/album/{id:[0-9]+}", deprecated(getAlbumByIDHandler, apiV1Prefix+"/albums/{id}")).Methods("GET")
+	r.Handle("/album/events", deprecated(albumEventsHandler, apiV1Prefix+"/albums/events")).Methods("GET")
+	r.Handle("/album/{id:[0-9]+}/prices", deprecated(getPriceHistoryHandler, apiV1Prefix+"/albums/{id}/prices")).Methods("GET")
+}
+
+// deprecated wraps a legacy handler so that its responses carry the
+// `Deprecation` (RFC 9745) and `Sunset` (RFC 8594) headers, and a link to
+// the route that replaces it
+func deprecated(next http.HandlerFunc, successor string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(legacyDeprecated.Unix(), 10))
+		w.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+		link := successor
+		for name, value := range mux.Vars(r) {
+			link = strings.Replace(link, "{"+name+"}", value, 1)
+		}
+		w.Header().Add("Link", "<"+link+`>; rel="successor-version"`)
+		next(w, r)
+	})
+}
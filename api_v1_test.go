@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIv1Routes(t *testing.T) {
+	r := newRouter()
+	mockServer := httptest.NewServer(r)
+
+	resp, err := http.Get(mockServer.URL + "/api/v1/albums")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Status should be ok, got %d", resp.StatusCode)
+	}
+	// The versioned routes are not deprecated
+	if deprecation := resp.Header.Get("Deprecation"); deprecation != "" {
+		t.Errorf("Deprecation header should not be set, got %q", deprecation)
+	}
+}
+
+func TestLegacyRoutesAreDeprecated(t *testing.T) {
+	r := newRouter()
+	mockServer := httptest.NewServer(r)
+
+	tests := []struct {
+		path string
+		link string
+	}{
+		{"/album", `</api/v1/albums>; rel="successor-version"`},
+		{"/album/12345", `</api/v1/albums/12345>; rel="successor-version"`},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(mockServer.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.Header.Get("Deprecation") == "" || resp.Header.Get("Sunset") == "" {
+			t.Errorf("%s should have Deprecation and Sunset headers, got %v", test.path, resp.Header)
+		}
+		if link := resp.Header.Get("Link"); link != test.link {
+			t.Errorf("%s: Link should be %s, got %s", test.path, test.link, link)
+		}
+	}
+}
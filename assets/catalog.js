@@ -0,0 +1,19 @@
+// The catalog pages work without JavaScript. With it, the visitor is told
+// when albums are added, rather than having to reload to find out
+(function () {
+  var notice = document.getElementById("new-albums")
+  if (!notice || !window.EventSource) {
+    return
+  }
+
+  var added = 0
+  var events = new EventSource("/api/v1/albums/events")
+  events.addEventListener("album.created", function () {
+    added++
+    // The page has the messages in its language. `textContent` never
+    // interprets markup
+    var message = added === 1 ? notice.dataset.one : notice.dataset.other
+    notice.textContent = message.replace("%d", added)
+    notice.hidden = false
+  })
+})()
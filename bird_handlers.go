@@ -1,62 +1,138 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
 )
 
+// Album request bodies are small, anything bigger than this is refused
+const maxAlbumBodySize = 1 << 20
+
 type Album struct {
+	ID     int64  `json:"id"`
 	Title  string `json:"title"`
 	Artist string `json:"artist"`
 	Price  string `json:"price"`
+	Year   string `json:"year"`
+	Genre  string `json:"genre"`
 }
 
 var albums []Album
 
 func getAlbumHandler(w http.ResponseWriter, r *http.Request) {
 	//Convert the "birds" variable to json
-	albums, err := store.GetAlbums()
+	albums, err := storeFor(r.Context()).GetAlbums()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
 
 	albumListBytes, err := json.Marshal(albums)
 
 	// If there is an error, print it to the console, and return a server
 	// error response to the user
 	if err != nil {
-		fmt.Println(fmt.Errorf("Error: %v", err))
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 	// If all goes well, write the JSON list of birds to the response
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(albumListBytes)
 }
 
+// albumID reads the ID of the album from the route. The route only matches
+// digits, so this can only fail on overflow, in which case there is no such
+// album either
+func albumID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, "There is no album with this ID.")
+		return 0, false
+	}
+	return id, true
+}
+
+func getAlbumByIDHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := albumID(w, r)
+	if !ok {
+		return
+	}
+
+	album, err := storeFor(r.Context()).GetAlbum(id)
+	if errors.Is(err, ErrAlbumNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "There is no album with this ID.")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	lists, err := listStore.PublicListsWithAlbum(id)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, albumResource{album, lists})
+}
+
+// albumResource is an album as the API serves it on its own, with the
+// public lists it is in
+type albumResource struct {
+	*Album
+	Lists []AlbumListSummary `json:"lists"`
+}
+
 func createAlbumHandler(w http.ResponseWriter, r *http.Request) {
 	// Create a new instance of Bird
 	album := Album{}
 
-	// We send all our data as HTML form data
-	// the `ParseForm` method of the request, parses the
-	// form values
-	err := r.ParseForm()
+	r.Body = http.MaxBytesReader(w, r.Body, maxAlbumBodySize)
+
+	// API clients send JSON, browsers send HTML form data
+	var err error
+	if hasJSONBody(r) {
+		err = decodeAlbumJSON(r.Body, &album)
+	} else {
+		err = decodeAlbumForm(r, &album)
+	}
 
-	// In case of any error, we respond with an error to the user
+	// A body that can't be parsed is the client's fault
 	if err != nil {
-		fmt.Println(fmt.Errorf("Error: %v", err))
-		w.WriteHeader(http.StatusInternalServerError)
+		writeProblem(w, r, http.StatusBadRequest, "The request body could not be parsed: "+err.Error())
 		return
 	}
 
-	// Get the information about the bird from the form info
-	album.Title = r.Form.Get("title")
-	album.Artist = r.Form.Get("artist")
-	album.Price = r.Form.Get("price")
+	// The form was well formed, but its values may still not make sense.
+	// The messages are in the language of the client
+	if errs := album.Validate(); errs != nil {
+		l := localeFor(r)
+		w.Header().Set("Content-Language", l.Tag)
+		w.Header().Add("Vary", "Accept-Language")
+		writeProblem(w, r, http.StatusUnprocessableEntity, l.T("validation.invalid"), localizeAlbumErrors(l, errs)...)
+		return
+	}
 
 	// Append our existing list of birds with a new entry
-	err = store.CreateAlbum(&album)
+	err = createAlbum(r.Context(), &album)
 	if err != nil {
-		fmt.Println(err)
+		writeServerError(w, r, err)
+		return
+	}
+
+	// API clients are told where the new album lives, and get it back
+	// with its new ID
+	if wantsJSON(r) {
+		w.Header().Set("Location", albumURLv1(album.ID))
+		writeJSON(w, r, http.StatusCreated, album)
+		return
 	}
 
 	//Finally, we redirect the user to the original HTMl page
@@ -64,3 +140,143 @@ func createAlbumHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/assets/", http.StatusFound)
 
 }
+
+// updateAlbumHandler replaces every field of an album
+func updateAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := albumID(w, r)
+	if !ok {
+		return
+	}
+
+	album := Album{}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAlbumBodySize)
+	var err error
+	if hasJSONBody(r) {
+		err = decodeAlbumJSON(r.Body, &album)
+	} else {
+		err = decodeAlbumForm(r, &album)
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "The request body could not be parsed: "+err.Error())
+		return
+	}
+	album.ID = id
+
+	if errs := album.Validate(); errs != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The album has invalid fields.", errs...)
+		return
+	}
+
+	err = updateAlbum(r.Context(), &album)
+	if errors.Is(err, ErrAlbumNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "There is no album with this ID.")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, album)
+}
+
+func deleteAlbumHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := albumID(w, r)
+	if !ok {
+		return
+	}
+
+	err := deleteAlbum(r.Context(), id)
+	if errors.Is(err, ErrAlbumNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "There is no album with this ID.")
+		return
+	}
+	if errors.Is(err, ErrAlbumInCollections) {
+		writeProblem(w, r, http.StatusConflict, "Users have copies of this album in their collections, it can't be deleted.")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createAlbum stores a new album and tells everybody listening for events.
+// Every way of adding an album goes through here, and the same goes for
+// `updateAlbum` and `deleteAlbum`. The context is the one of the request
+// asking for the change
+func createAlbum(ctx context.Context, album *Album) error {
+	if err := storeFor(ctx).CreateAlbum(album); err != nil {
+		return err
+	}
+	albumEvents.Publish(eventAlbumCreated, album)
+	return nil
+}
+
+// updateAlbum saves an album. The users waiting for its price to drop are
+// notified if it did
+func updateAlbum(ctx context.Context, album *Album) error {
+	previous, err := storeFor(ctx).UpdateAlbum(album)
+	if err != nil {
+		return err
+	}
+	albumEvents.Publish(eventAlbumUpdated, album)
+	notifyPriceDrop(album, previous)
+	return nil
+}
+
+// deleteAlbum removes an album. The event carries the album as it was just
+// before it was deleted
+func deleteAlbum(ctx context.Context, id int64) error {
+	s := storeFor(ctx)
+	album, err := s.GetAlbum(id)
+	if err != nil {
+		return err
+	}
+	if err := s.DeleteAlbum(id); err != nil {
+		return err
+	}
+	albumEvents.Publish(eventAlbumDeleted, album)
+	return nil
+}
+
+func decodeAlbumForm(r *http.Request, album *Album) error {
+	// the `ParseForm` method of the request, parses the
+	// form values
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	// Get the information about the album from the form info
+	album.Title = r.Form.Get("title")
+	album.Artist = r.Form.Get("artist")
+	album.Price = r.Form.Get("price")
+	album.Year = r.Form.Get("year")
+	album.Genre = r.Form.Get("genre")
+	return nil
+}
+
+func decodeAlbumJSON(body io.Reader, album *Album) error {
+	decoder := json.NewDecoder(body)
+	// Unknown fields are most likely typos, which would otherwise silently
+	// leave a field empty
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(album); err != nil {
+		return err
+	}
+	// The ID is chosen by the database, never by the client
+	album.ID = 0
+	return nil
+}
+
+// writeJSON sends `v` as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
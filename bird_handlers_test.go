@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -56,13 +59,110 @@ func TestCreateAlbumsHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	expected := Album{"Halo", "Beyonce", "33.99"}
+	// The ID is picked by the database, so we only check that there is one
+	if album_list[0].ID == 0 {
+		t.Errorf("album should have an ID, got %v", album_list[0])
+	}
+	expected := Album{ID: album_list[0].ID, Title: "Halo", Artist: "Beyonce", Price: "33.99"}
 
 	if album_list[0] != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", album_list[0], expected)
 	}
 }
 
+func TestCreateAlbumHandlerWithJSON(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	hf := http.HandlerFunc(createAlbumHandler)
+
+	body := `{"title": "Lemonade", "artist": "Beyonce", "price": "19.99", "year": "2016"}`
+	req, err := http.NewRequest("POST", "/album", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	hf.ServeHTTP(recorder, req)
+
+	// API clients get the created album instead of a redirect
+	if status := recorder.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+
+	created := Album{}
+	if err := json.NewDecoder(recorder.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	expected := Album{ID: created.ID, Title: "Lemonade", Artist: "Beyonce", Price: "19.99", Year: "2016"}
+	if created.ID == 0 || created != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", created, expected)
+	}
+
+	location := recorder.Header().Get("Location")
+	if location != "/api/v1/albums/"+strconv.FormatInt(created.ID, 10) {
+		t.Errorf("unexpected Location header %q", location)
+	}
+
+	// The Location header points to the album we just created
+	r := newRouter()
+	mockServer := httptest.NewServer(r)
+	resp, err := http.Get(mockServer.URL + location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	fetched := Album{}
+	if err := json.NewDecoder(resp.Body).Decode(&fetched); err != nil {
+		t.Fatal(err)
+	}
+	if fetched != created {
+		t.Errorf("GET %s returned %v, want %v", location, fetched, created)
+	}
+}
+
+func TestCreateAlbumHandlerNegotiatesResponse(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected int
+	}{
+		// What browsers send when submitting a form
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", http.StatusFound},
+		{"*/*", http.StatusFound},
+		{"application/json", http.StatusCreated},
+		{"text/html;q=0.5, application/json", http.StatusCreated},
+	}
+	for _, test := range tests {
+		form := newCreateAlbumForm()
+		req, err := http.NewRequest("POST", "/album", bytes.NewBufferString(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Accept", test.accept)
+
+		recorder := httptest.NewRecorder()
+		http.HandlerFunc(createAlbumHandler).ServeHTTP(recorder, req)
+		if recorder.Code != test.expected {
+			t.Errorf("Accept %q: got status %d want %d", test.accept, recorder.Code, test.expected)
+		}
+	}
+}
+
+func TestCreateAlbumHandlerRejectsMalformedJSON(t *testing.T) {
+	for _, body := range []string{`{"title": "Halo"`, `{"title": "Halo", "artst": "Beyonce"}`} {
+		req, err := http.NewRequest("POST", "/album", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Content-Type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		http.HandlerFunc(createAlbumHandler).ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("body %s: got status %d want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
 func newCreateAlbumForm() *url.Values {
 	form := url.Values{}
 	form.Set("title", "Halo")
@@ -70,3 +170,115 @@ func newCreateAlbumForm() *url.Values {
 	form.Set("price", "33.99")
 	return &form
 }
+
+func TestCreateAlbumHandlerRejectsInvalidAlbum(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	hf := http.HandlerFunc(createAlbumHandler)
+
+	// No title, a year from the far future and a price with a currency sign
+	form := url.Values{}
+	form.Set("artist", "Beyonce")
+	form.Set("year", "3000")
+	form.Set("price", "$33.99")
+	req, err := http.NewRequest("POST", "/album", bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	hf.ServeHTTP(recorder, req)
+
+	if status := recorder.Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusUnprocessableEntity)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/problem+json" {
+		t.Errorf("Wrong content type, expected application/problem+json, got %s", contentType)
+	}
+
+	p := problem{}
+	if err := json.NewDecoder(recorder.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != http.StatusUnprocessableEntity || p.Instance != "/album" {
+		t.Errorf("unexpected problem: %+v", p)
+	}
+
+	// Every invalid field is reported, in the order of the checks
+	fields := []string{}
+	for _, e := range p.Errors {
+		fields = append(fields, e.Field)
+	}
+	expected := "[title year price]"
+	if actual := fmt.Sprint(fields); actual != expected {
+		t.Errorf("invalid fields should be %s, got %s", expected, actual)
+	}
+}
+
+func TestAlbumValidate(t *testing.T) {
+	valid := Album{Title: " Halo ", Artist: "Beyonce", Price: "33.99", Year: "2008"}
+	if errs := valid.Validate(); errs != nil {
+		t.Errorf("album should be valid, got %v", errs)
+	}
+	if valid.Title != "Halo" {
+		t.Errorf("title should be trimmed, got %q", valid.Title)
+	}
+
+	tests := []struct {
+		album Album
+		field string
+		code  string
+	}{
+		{Album{Title: "   ", Artist: "Beyonce"}, "title", "required"},
+		{Album{Title: strings.Repeat("a", maxTitleLength+1), Artist: "Beyonce"}, "title", "too_long"},
+		{Album{Title: "Halo", Artist: "Beyonce", Year: "1850"}, "year", "out_of_range"},
+		{Album{Title: "Halo", Artist: "Beyonce", Year: "two thousand"}, "year", "out_of_range"},
+		{Album{Title: "Halo", Artist: "Beyonce", Price: "33.999"}, "price", "invalid_format"},
+	}
+	for _, test := range tests {
+		errs := test.album.Validate()
+		if len(errs) != 1 || errs[0].Field != test.field || errs[0].Code != test.code {
+			t.Errorf("%+v: expected %s/%s, got %v", test.album, test.field, test.code, errs)
+		}
+	}
+}
+
+func TestUpdateAndDeleteAlbumHandlers(t *testing.T) {
+	album := &Album{Title: "Homogenic", Artist: "Bjork"}
+	if err := createAlbum(context.Background(), album); err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/v1/albums/" + strconv.FormatInt(album.ID, 10)
+	r := newRouter()
+
+	// Updating replaces every field
+	body := `{"title": "Homogenic", "artist": "Björk", "year": "1997"}`
+	req := httptest.NewRequest("PUT", path, bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("update returned wrong status code: got %v want %v", recorder.Code, http.StatusOK)
+	}
+	updated, err := store.GetAlbum(album.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Album{ID: album.ID, Title: "Homogenic", Artist: "Björk", Year: "1997"}
+	if *updated != expected {
+		t.Errorf("album should be %v, got %v", expected, *updated)
+	}
+
+	// After deleting it, the album is gone
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("DELETE", path, nil))
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("delete returned wrong status code: got %v want %v", recorder.Code, http.StatusNoContent)
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		recorder = httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("%s after delete: got %v want %v", method, recorder.Code, http.StatusNotFound)
+		}
+	}
+}
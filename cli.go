@@ -0,0 +1,425 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// A command is one of the subcommands of the binary. Every command takes
+// the flags of the configuration, followed by flags of its own
+type command struct {
+	name    string
+	args    string
+	summary string
+	// setup registers the flags of the command, and returns what runs it
+	setup func(fs *flag.FlagSet) func(cfg *Config, args []string, out io.Writer) error
+}
+
+var commands = []command{
+	{"serve", "", "run the HTTP server, creating and seeding the database if needed", setupServe},
+	{"migrate", "", "create or upgrade the tables of the database", setupMigrate},
+	{"seed", "[file]", "fill an empty catalog from a seed file, the configured or the built-in one by default", setupSeed},
+	{"import", "file", "add the albums of a JSON or CSV file to the catalog", setupImport},
+	{"export", "", "write the whole catalog as JSON or CSV", setupExport},
+	{"add", "", "add a single album", setupAdd},
+	{"list", "", "print the albums of the catalog", setupList},
+}
+
+// errUsage is returned by commands called with the wrong arguments
+var errUsage = errors.New("wrong arguments")
+
+// runCLI runs the command named by the first argument, and returns the exit
+// code of the process. Without a command, the server is run, as it was
+// before there were commands
+func runCLI(args []string, getenv func(string) string, stdout, stderr io.Writer) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage(stdout)
+		return 0
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", name)
+		usage(stderr)
+		return 2
+	}
+
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: %s %s [flags] %s\n\n%s\n\nflags:\n", programName(), cmd.name, cmd.args, cmd.summary)
+		fs.PrintDefaults()
+	}
+	run := cmd.setup(fs)
+	cfg, rest, err := LoadConfig(fs, args, getenv)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	cfg.Apply()
+
+	err = run(cfg, rest, stdout)
+	if err == errUsage {
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", cmd.name, err)
+		return 1
+	}
+	return 0
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [flags] [arguments]\n\ncommands:\n", programName())
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun '%s <command> -h' for the flags of a command.\n", programName())
+}
+
+func programName() string {
+	name := os.Args[0]
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// openDatabase opens the database of the configuration. Unless `migrate` is
+// set, its tables must already be the ones this build expects
+func openDatabase(cfg *Config, migrate bool) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", cfg.Database)
+	if err != nil {
+		return nil, err
+	}
+	if migrate {
+		err = migrateDatabase(db)
+	} else {
+		err = checkSchemaVersion(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrateDatabase creates the missing tables. Databases made by a newer
+// build are left alone, since this one doesn't know their tables
+func migrateDatabase(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("the database has schema version %d, this build only knows version %d", version, schemaVersion)
+	}
+	createTable(db)
+	createWebhookTables(db)
+	createListTables(db)
+	createCollectionTable(db)
+	createShopTables(db)
+	createPriceTables(db)
+	return setSchemaVersion(db)
+}
+
+func checkSchemaVersion(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version != schemaVersion {
+		return fmt.Errorf("the database has schema version %d instead of %d, run the migrate command", version, schemaVersion)
+	}
+	return nil
+}
+
+func setupServe(fs *flag.FlagSet) func(*Config, []string, io.Writer) error {
+	return func(cfg *Config, args []string, out io.Writer) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		if err := cfg.ValidateFiles(); err != nil {
+			return err
+		}
+		logger.Info("configuration", cfg.logFields()...)
+		if err := InitTemplates(cfg.TemplatesDir); err != nil {
+			return err
+		}
+
+		db, err := openDatabase(cfg, true)
+		if err != nil {
+			return err
+		}
+		InitStore(instrumentStore(&dbStore{db: db}))
+		InitDBMetrics(db)
+		InitReadiness(db)
+		InitWebhooks(&dbStore{db: db})
+		InitLists(&dbStore{db: db})
+		InitCollection(&dbStore{db: db})
+		InitShop(&dbStore{db: db})
+		InitPrices(&dbStore{db: db})
+		if _, fake := payments.(*fakePayments); fake {
+			logger.Warn("orders are paid with the fake payment provider, nobody is charged")
+		}
+
+		seeded, err := seedCatalog(store, cfg.SeedFile)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		if seeded > 0 {
+			logger.Info("seeded the catalog", "file", seedName(cfg.SeedFile), "albums", seeded)
+		}
+
+		servers, err := newServers(cfg, newRouter())
+		if err != nil {
+			db.Close()
+			return err
+		}
+		webhooks.Start(albumEvents)
+		logger.Info("serving", "addr", cfg.Addr, "tls", cfg.UseTLS(), "redirectAddr", cfg.RedirectAddr)
+		err = serve(servers...)
+
+		// The requests are done, so nothing uses the database anymore once
+		// the deliveries in progress stop. They stay pending, and can be
+		// replayed
+		webhooks.Close()
+		if closeErr := db.Close(); closeErr != nil {
+			logger.Error("closing the database failed", "error", closeErr)
+		}
+		if err == nil {
+			logger.Info("stopped")
+		}
+		return err
+	}
+}
+
+func setupMigrate(fs *flag.FlagSet) func(*Config, []string, io.Writer) error {
+	return func(cfg *Config, args []string, out io.Writer) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		db, err := openDatabase(cfg, true)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		fmt.Fprintf(out, "%s is at schema version %d\n", cfg.Database, schemaVersion)
+		return nil
+	}
+}
+
+func setupSeed(fs *flag.FlagSet) func(*Config, []string, io.Writer) error {
+	return func(cfg *Config, args []string, out io.Writer) error {
+		if len(args) > 1 {
+			return errUsage
+		}
+		file := cfg.SeedFile
+		if len(args) == 1 {
+			file = args[0]
+		}
+
+		return withStore(cfg, func(s Store) error {
+			seeded, err := seedCatalog(s, file)
+			if err != nil {
+				return err
+			}
+			if seeded == 0 {
+				fmt.Fprintln(out, "the catalog is not empty, nothing was seeded")
+				return nil
+			}
+			fmt.Fprintf(out, "seeded %d albums from %s\n", seeded, seedName(file))
+			return nil
+		})
+	}
+}
+
+// seedCatalog adds the albums of a seed file, in the format of albums.json,
+// to an empty catalog. A catalog that has albums is left as it is, so
+// seeding can be done on every start
+func seedCatalog(s Store, file string) (int, error) {
+	_, total, err := s.ListAlbums(AlbumQuery{Limit: 1})
+	if err != nil || total > 0 {
+		return 0, err
+	}
+
+	data, err := readSeed(file)
+	if err != nil {
+		return 0, err
+	}
+	var seed Albums
+	if err := json.Unmarshal(data, &seed); err != nil {
+		return 0, fmt.Errorf("%s: %v", seedName(file), err)
+	}
+	for i, a := range seed.Albums {
+		album := &Album{Title: a.Title, Artist: a.Artist, Year: a.Year, Genre: a.Genre}
+		if err := s.CreateAlbum(album); err != nil {
+			return i, err
+		}
+	}
+	return len(seed.Albums), nil
+}
+
+// seedName names the seed file in messages
+func seedName(file string) string {
+	if file == "" {
+		return "the embedded catalog"
+	}
+	return file
+}
+
+func setupImport(fs *flag.FlagSet) func(*Config, []string, io.Writer) error {
+	format := fs.String("format", "", "json or csv, guessed from the file extension by default")
+	return func(cfg *Config, args []string, out io.Writer) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if *format == "" {
+			*format = formatOfFile(args[0])
+		}
+
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		albums, err := readAlbums(file, *format)
+		if err != nil {
+			return fmt.Errorf("%s: %v", args[0], err)
+		}
+
+		// Nothing is imported unless every album is valid
+		var problems []string
+		for i, album := range albums {
+			for _, e := range album.Validate() {
+				problems = append(problems, fmt.Sprintf("album %d: %v", i+1, e))
+			}
+		}
+		if problems != nil {
+			return errors.New("nothing was imported:\n  " + strings.Join(problems, "\n  "))
+		}
+
+		return withStore(cfg, func(s Store) error {
+			for i, album := range albums {
+				if err := s.CreateAlbum(album); err != nil {
+					return fmt.Errorf("only %d of %d albums were imported: %v", i, len(albums), err)
+				}
+			}
+			fmt.Fprintf(out, "imported %d albums\n", len(albums))
+			return nil
+		})
+	}
+}
+
+func setupExport(fs *flag.FlagSet) func(*Config, []string, io.Writer) error {
+	format := fs.String("format", formatJSON, "json or csv")
+	return func(cfg *Config, args []string, out io.Writer) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		return withStore(cfg, func(s Store) error {
+			albums, err := s.GetAlbums()
+			if err != nil {
+				return err
+			}
+			sort.Slice(albums, func(i, j int) bool { return albums[i].ID < albums[j].ID })
+			return writeAlbums(out, *format, albums)
+		})
+	}
+}
+
+func setupAdd(fs *flag.FlagSet) func(*Config, []string, io.Writer) error {
+	album := &Album{}
+	fs.StringVar(&album.Title, "title", "", "title of the album (required)")
+	fs.StringVar(&album.Artist, "artist", "", "artist of the album (required)")
+	fs.StringVar(&album.Price, "price", "", "price, like 9.99")
+	fs.StringVar(&album.Year, "year", "", "year of release")
+	fs.StringVar(&album.Genre, "genre", "", "genre")
+	return func(cfg *Config, args []string, out io.Writer) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		if errs := album.Validate(); errs != nil {
+			problems := make([]string, len(errs))
+			for i, e := range errs {
+				problems[i] = e.Error()
+			}
+			return errors.New(strings.Join(problems, ", "))
+		}
+		return withStore(cfg, func(s Store) error {
+			if err := s.CreateAlbum(album); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "added album %d\n", album.ID)
+			return nil
+		})
+	}
+}
+
+func setupList(fs *flag.FlagSet) func(*Config, []string, io.Writer) error {
+	query := AlbumQuery{}
+	fs.StringVar(&query.Title, "title", "", "only albums whose title contains this")
+	fs.StringVar(&query.Artist, "artist", "", "only albums of this artist")
+	fs.StringVar(&query.Genre, "genre", "", "only albums of this genre")
+	fs.StringVar(&query.Year, "year", "", "only albums of this year")
+	fs.StringVar(&query.Sort, "sort", "", "sort by id, title, artist, year or price, prefixed with - for the descending order")
+	fs.IntVar(&query.Limit, "limit", 0, "print at most this many albums, 0 for all")
+	return func(cfg *Config, args []string, out io.Writer) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		if !validAlbumSort(query.Sort) {
+			return fmt.Errorf("unknown sort %q", query.Sort)
+		}
+		return withStore(cfg, func(s Store) error {
+			albums, total, err := s.ListAlbums(query)
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tTITLE\tARTIST\tYEAR\tGENRE\tPRICE")
+			for _, album := range albums {
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", album.ID, album.Title, album.Artist, album.Year, album.Genre, album.Price)
+			}
+			tw.Flush()
+			if len(albums) < total {
+				fmt.Fprintf(out, "%d of %d albums\n", len(albums), total)
+			}
+			return nil
+		})
+	}
+}
+
+// withStore runs `f` with the store of the configured database
+func withStore(cfg *Config, f func(s Store) error) error {
+	db, err := openDatabase(cfg, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return f(&dbStore{db: db})
+}
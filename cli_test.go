@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cli runs a command on a database of its own, and returns its exit code
+// and what it printed
+func cli(t *testing.T, database string, args ...string) (int, string, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := runCLI(args, env(map[string]string{"ALBUMPEDIA_DATABASE": database}), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLICatalogCommands(t *testing.T) {
+	dir := t.TempDir()
+	database := filepath.Join(dir, "catalog.db")
+
+	// Nothing works before the tables are created
+	if code, _, stderr := cli(t, database, "list"); code != 1 || !strings.Contains(stderr, "migrate") {
+		t.Fatalf("list should ask for a migration, got %d: %s", code, stderr)
+	}
+
+	if code, _, stderr := cli(t, database, "migrate"); code != 0 {
+		t.Fatalf("migrate failed with %d: %s", code, stderr)
+	}
+	if code, stdout, stderr := cli(t, database, "seed", "albums.json"); code != 0 || !strings.Contains(stdout, "seeded 29 albums") {
+		t.Fatalf("seed failed with %d: %s%s", code, stdout, stderr)
+	}
+	// Seeding again does nothing, the catalog isn't empty anymore
+	if _, stdout, _ := cli(t, database, "seed", "albums.json"); !strings.Contains(stdout, "nothing was seeded") {
+		t.Errorf("the second seed should do nothing, got %s", stdout)
+	}
+
+	if code, _, stderr := cli(t, database, "add", "-title", "Kind of Blue", "-artist", "Miles Davis", "-year", "1959"); code != 0 {
+		t.Fatalf("add failed with %d: %s", code, stderr)
+	}
+	if code, _, stderr := cli(t, database, "add", "-title", "Untitled"); code != 1 || !strings.Contains(stderr, "artist") {
+		t.Errorf("add without an artist should fail, got %d: %s", code, stderr)
+	}
+
+	_, stdout, _ := cli(t, database, "list", "-artist", "Miles Davis")
+	if !strings.Contains(stdout, "Kind of Blue") || strings.Contains(stdout, "Nevermind") {
+		t.Errorf("unexpected list:\n%s", stdout)
+	}
+
+	// What is exported can be imported into another catalog
+	_, exported, _ := cli(t, database, "export", "-format", "json")
+	albums := []*Album{}
+	if err := json.Unmarshal([]byte(exported), &albums); err != nil || len(albums) != 30 {
+		t.Fatalf("expected 30 exported albums, got %d (%v)", len(albums), err)
+	}
+	file := filepath.Join(dir, "export.json")
+	if err := ioutil.WriteFile(file, []byte(exported), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "other.db")
+	cli(t, other, "migrate")
+	if code, stdout, stderr := cli(t, other, "import", file); code != 0 || !strings.Contains(stdout, "imported 30 albums") {
+		t.Fatalf("import failed with %d: %s%s", code, stdout, stderr)
+	}
+}
+
+func TestCLIImportIsAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	database := filepath.Join(dir, "catalog.db")
+	cli(t, database, "migrate")
+
+	file := filepath.Join(dir, "albums.csv")
+	csv := "title,artist,year\nBlue,Joni Mitchell,1971\nNo Artist,,1999\n"
+	if err := ioutil.WriteFile(file, []byte(csv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	code, _, stderr := cli(t, database, "import", file)
+	if code != 1 || !strings.Contains(stderr, "album 2: artist") {
+		t.Errorf("the second album should be refused, got %d: %s", code, stderr)
+	}
+	if _, stdout, _ := cli(t, database, "list"); strings.Contains(stdout, "Blue") {
+		t.Errorf("nothing should have been imported:\n%s", stdout)
+	}
+}
+
+func TestCLIUsage(t *testing.T) {
+	if code, _, stderr := cli(t, "unused.db", "dance"); code != 2 || !strings.Contains(stderr, "unknown command") {
+		t.Errorf("expected an unknown command error, got %d: %s", code, stderr)
+	}
+	if code, stdout, _ := cli(t, "unused.db", "help"); code != 0 || !strings.Contains(stdout, "export") {
+		t.Errorf("help should list the commands, got %d: %s", code, stdout)
+	}
+	if code, _, _ := cli(t, "unused.db", "import"); code != 2 {
+		t.Errorf("import without a file should print the usage, got %d", code)
+	}
+}
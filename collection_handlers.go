@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// The formats albums are owned in
+var collectionFormats = []string{"vinyl", "cd", "cassette", "digital"}
+
+// conditionGrades are the grades of the Goldmine standard, from mint to
+// poor, with the share of the catalog price a copy in this condition is
+// worth, in percent
+var conditionGrades = []struct {
+	Grade string
+	Value int64
+}{
+	{"M", 100},
+	{"NM", 90},
+	{"VG+", 75},
+	{"VG", 50},
+	{"G+", 35},
+	{"G", 25},
+	{"F", 15},
+	{"P", 10},
+}
+
+const (
+	maxPressingLength = 200
+	maxLocationLength = 200
+)
+
+// registerCollectionRoutes adds the routes of the collection of the user of
+// the API key to `r`. Nobody else sees it
+func registerCollectionRoutes(r *mux.Router) {
+	r.Handle("/me/collection", requireAPIKey(getCollectionHandler)).Methods("GET")
+	r.Handle("/me/collection", requireAPIKey(addCollectionItemHandler)).Methods("POST")
+	r.Handle("/me/collection/{id:[0-9]+}", requireAPIKey(getCollectionItemHandler)).Methods("GET")
+	r.Handle("/me/collection/{id:[0-9]+}", requireAPIKey(updateCollectionItemHandler)).Methods("PUT")
+	r.Handle("/me/collection/{id:[0-9]+}", requireAPIKey(deleteCollectionItemHandler)).Methods("DELETE")
+}
+
+// collectionItemURLv1 is where version 1 of the API serves the copy with
+// this ID
+func collectionItemURLv1(id int64) string {
+	return apiV1Prefix + "/me/collection/" + strconv.FormatInt(id, 10)
+}
+
+// collectionItemRequest is the body of a request adding a copy to the
+// collection or replacing its details. The album of a copy can't change
+type collectionItemRequest struct {
+	AlbumID         int64  `json:"albumId"`
+	Format          string `json:"format"`
+	Pressing        string `json:"pressing"`
+	MediaCondition  string `json:"mediaCondition"`
+	SleeveCondition string `json:"sleeveCondition"`
+	PurchaseDate    string `json:"purchaseDate"`
+	PurchasePrice   string `json:"purchasePrice"`
+	Location        string `json:"location"`
+}
+
+// Validate checks the fields of the copy, once their leading and trailing
+// spaces are removed. Formats are lowercased and grades uppercased, so that
+// "Vinyl" and "nm" are accepted
+func (req *collectionItemRequest) Validate() []fieldError {
+	req.Format = strings.ToLower(strings.TrimSpace(req.Format))
+	req.Pressing = strings.TrimSpace(req.Pressing)
+	req.MediaCondition = strings.ToUpper(strings.TrimSpace(req.MediaCondition))
+	req.SleeveCondition = strings.ToUpper(strings.TrimSpace(req.SleeveCondition))
+	req.PurchaseDate = strings.TrimSpace(req.PurchaseDate)
+	req.PurchasePrice = strings.TrimSpace(req.PurchasePrice)
+	req.Location = strings.TrimSpace(req.Location)
+
+	var errs []fieldError
+	if req.AlbumID <= 0 {
+		errs = append(errs, fieldError{"albumId", "required", "is required"})
+	}
+
+	if req.Format == "" {
+		errs = append(errs, fieldError{"format", "required", "is required"})
+	} else if !isCollectionFormat(req.Format) {
+		errs = append(errs, fieldError{"format", "invalid_format", "must be one of " + strings.Join(collectionFormats, ", ")})
+	}
+
+	if utf8.RuneCountInString(req.Pressing) > maxPressingLength {
+		errs = append(errs, fieldError{"pressing", "too_long", "must be at most " + strconv.Itoa(maxPressingLength) + " characters"})
+	}
+
+	for _, condition := range []struct{ field, grade string }{
+		{"mediaCondition", req.MediaCondition},
+		{"sleeveCondition", req.SleeveCondition},
+	} {
+		switch {
+		case condition.grade == "":
+		case req.Format == "digital":
+			errs = append(errs, fieldError{condition.field, "invalid_format", "must be empty for digital copies"})
+		case conditionValue(condition.grade) == 0:
+			grades := make([]string, len(conditionGrades))
+			for i, g := range conditionGrades {
+				grades[i] = g.Grade
+			}
+			errs = append(errs, fieldError{condition.field, "invalid_format", "must be one of " + strings.Join(grades, ", ")})
+		}
+	}
+
+	if req.PurchaseDate != "" {
+		date, err := time.Parse("2006-01-02", req.PurchaseDate)
+		if err != nil {
+			errs = append(errs, fieldError{"purchaseDate", "invalid_format", "must be a date such as 2024-05-31"})
+		} else if date.After(time.Now()) {
+			errs = append(errs, fieldError{"purchaseDate", "out_of_range", "must not be in the future"})
+		}
+	}
+
+	if req.PurchasePrice != "" && !priceFormat.MatchString(req.PurchasePrice) {
+		errs = append(errs, fieldError{"purchasePrice", "invalid_format", "must be a decimal amount such as 22.99"})
+	}
+
+	if utf8.RuneCountInString(req.Location) > maxLocationLength {
+		errs = append(errs, fieldError{"location", "too_long", "must be at most " + strconv.Itoa(maxLocationLength) + " characters"})
+	}
+	return errs
+}
+
+// apply copies the details of the request to a copy
+func (req *collectionItemRequest) apply(item *CollectionItem) {
+	item.Format = req.Format
+	item.Pressing = req.Pressing
+	item.MediaCondition = req.MediaCondition
+	item.SleeveCondition = req.SleeveCondition
+	item.PurchaseDate = req.PurchaseDate
+	item.PurchasePrice = req.PurchasePrice
+	item.Location = req.Location
+}
+
+func isCollectionFormat(format string) bool {
+	for _, f := range collectionFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionValue returns the share of the catalog price a copy in this
+// condition is worth, in percent, or 0 for an unknown grade
+func conditionValue(grade string) int64 {
+	for _, g := range conditionGrades {
+		if g.Grade == grade {
+			return g.Value
+		}
+	}
+	return 0
+}
+
+// EstimatedValue estimates what a copy is worth, in cents: the catalog price
+// of the album, or what the user paid for the copy if the album has no price,
+// lowered by its condition. The media counts three times as much as the
+// sleeve, and copies with no grade are valued as mint. It returns false when
+// neither price is known
+func (item *CollectionItem) EstimatedValue() (int64, bool) {
+	price, ok := priceCents(item.Album.Price)
+	if !ok {
+		price, ok = priceCents(item.PurchasePrice)
+	}
+	if !ok {
+		return 0, false
+	}
+
+	media, sleeve := conditionValue(item.MediaCondition), conditionValue(item.SleeveCondition)
+	switch {
+	case media == 0 && sleeve == 0:
+		return price, true
+	case sleeve == 0:
+		return price * media / 100, true
+	case media == 0:
+		return price * sleeve / 100, true
+	}
+	return price * (3*media + sleeve) / 400, true
+}
+
+// collectionTotals sums up a collection
+type collectionTotals struct {
+	// Copies counts every copy, Albums only the different albums
+	Copies   int            `json:"copies"`
+	Albums   int            `json:"albums"`
+	ByFormat map[string]int `json:"byFormat"`
+	// Spent is what the copies with a purchase price cost
+	Spent string `json:"spent"`
+	// EstimatedValue leaves out the copies that have no price at all, which
+	// Unvalued counts
+	EstimatedValue string `json:"estimatedValue"`
+	Unvalued       int    `json:"unvalued"`
+}
+
+// collection is the response of `GET /me/collection`
+type collection struct {
+	Items  []*CollectionItem `json:"items"`
+	Totals collectionTotals  `json:"totals"`
+}
+
+func totalCollection(items []*CollectionItem) collectionTotals {
+	totals := collectionTotals{Copies: len(items), ByFormat: map[string]int{}}
+	for _, format := range collectionFormats {
+		totals.ByFormat[format] = 0
+	}
+
+	albums := map[int64]bool{}
+	var spent, value int64
+	for _, item := range items {
+		albums[item.AlbumID] = true
+		totals.ByFormat[item.Format]++
+		if cents, ok := priceCents(item.PurchasePrice); ok {
+			spent += cents
+		}
+		if cents, ok := item.EstimatedValue(); ok {
+			value += cents
+		} else {
+			totals.Unvalued++
+		}
+	}
+	totals.Albums = len(albums)
+	totals.Spent = formatCents(spent)
+	totals.EstimatedValue = formatCents(value)
+	return totals
+}
+
+// getCollectionHandler lists the copies owned by the user, with their totals
+func getCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := apiUser(r)
+	items, err := collectionStore.ListCollection(user)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, collection{Items: items, Totals: totalCollection(items)})
+}
+
+func addCollectionItemHandler(w http.ResponseWriter, r *http.Request) {
+	req := collectionItemRequest{}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if errs := req.Validate(); errs != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The copy has invalid fields.", errs...)
+		return
+	}
+
+	user, _ := apiUser(r)
+	item := &CollectionItem{Owner: user, AlbumID: req.AlbumID}
+	req.apply(item)
+	err := collectionStore.CreateCollectionItem(item)
+	if errors.Is(err, ErrAlbumNotFound) {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The copy has invalid fields.",
+			fieldError{"albumId", "not_found", "must be the ID of an album"})
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", collectionItemURLv1(item.ID))
+	writeJSON(w, r, http.StatusCreated, item)
+}
+
+func getCollectionItemHandler(w http.ResponseWriter, r *http.Request) {
+	item, ok := findCollectionItem(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, item)
+}
+
+func updateCollectionItemHandler(w http.ResponseWriter, r *http.Request) {
+	item, ok := findCollectionItem(w, r)
+	if !ok {
+		return
+	}
+	req := collectionItemRequest{}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	// The album is the one of the copy, it may be left out
+	if req.AlbumID == 0 {
+		req.AlbumID = item.AlbumID
+	}
+	errs := req.Validate()
+	if req.AlbumID != item.AlbumID {
+		errs = append(errs, fieldError{"albumId", "invalid_format", "can't change, add a new copy instead"})
+	}
+	if errs != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The copy has invalid fields.", errs...)
+		return
+	}
+
+	req.apply(item)
+	err := collectionStore.UpdateCollectionItem(item)
+	if errors.Is(err, ErrCollectionItemNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "There is no copy with this ID in your collection.")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, item)
+}
+
+func deleteCollectionItemHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := apiUser(r)
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	err := collectionStore.DeleteCollectionItem(user, id)
+	if errors.Is(err, ErrCollectionItemNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "There is no copy with this ID in your collection.")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findCollectionItem loads the copy of the route from the collection of the
+// user, or answers with an error
+func findCollectionItem(w http.ResponseWriter, r *http.Request) (*CollectionItem, bool) {
+	user, _ := apiUser(r)
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	item, err := collectionStore.GetCollectionItem(user, id)
+	if errors.Is(err, ErrCollectionItemNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "There is no copy with this ID in your collection.")
+		return nil, false
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return nil, false
+	}
+	return item, true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCollection(t *testing.T) {
+	withListUsers(t)
+	dark, wish := &Album{Title: "The Dark Side of the Moon", Price: "20"}, &Album{Title: "Wish You Were Here"}
+	catalogAlbums(t, dark, wish)
+
+	add := func(key, body string) *CollectionItem {
+		response := callAPI("POST", "/api/v1/me/collection", key, body)
+		if response.Code != http.StatusCreated {
+			t.Fatalf("adding a copy failed with %d: %s", response.Code, response.Body)
+		}
+		item := &CollectionItem{}
+		if err := json.NewDecoder(response.Body).Decode(item); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { collectionStore.DeleteCollectionItem(item.Owner, item.ID) })
+		return item
+	}
+
+	// Two copies of the same album, and one with no catalog price
+	vinyl := add("alice-key-0123456", fmt.Sprintf(`{"albumId": %d, "format": "Vinyl", "pressing": "1973 UK", "mediaCondition": "vg+", "sleeveCondition": "VG",
+		"purchaseDate": "2019-04-13", "purchasePrice": "35", "location": "Shelf 3"}`, dark.ID))
+	add("alice-key-0123456", fmt.Sprintf(`{"albumId": %d, "format": "cd", "purchasePrice": "6.50"}`, dark.ID))
+	add("alice-key-0123456", fmt.Sprintf(`{"albumId": %d, "format": "digital"}`, wish.ID))
+	add("bob-key-0123456789", fmt.Sprintf(`{"albumId": %d, "format": "cassette"}`, wish.ID))
+	if vinyl.Format != "vinyl" || vinyl.MediaCondition != "VG+" || vinyl.Album.Title != dark.Title {
+		t.Errorf("unexpected copy %+v", vinyl)
+	}
+
+	response := callAPI("GET", "/api/v1/me/collection", "alice-key-0123456", "")
+	result := collection{}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	// The vinyl is worth 20 * (3*75% + 50%) / 4 = 13.75, the CD 20
+	totals := result.Totals
+	if len(result.Items) != 3 || totals.Copies != 3 || totals.Albums != 2 || totals.ByFormat["vinyl"] != 1 || totals.ByFormat["cassette"] != 0 ||
+		totals.Spent != "41.50" || totals.EstimatedValue != "33.75" || totals.Unvalued != 1 {
+		t.Errorf("unexpected totals %+v", totals)
+	}
+
+	// The copies of the others can't be seen nor changed
+	path := collectionItemURLv1(vinyl.ID)
+	if response := callAPI("GET", path, "bob-key-0123456789", ""); response.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for the copy of another user, got %d", response.Code)
+	}
+	if response := callAPI("DELETE", path, "bob-key-0123456789", ""); response.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for the copy of another user, got %d", response.Code)
+	}
+
+	response = callAPI("PUT", path, "alice-key-0123456", `{"format": "vinyl", "mediaCondition": "NM", "location": "Shelf 1"}`)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"location":"Shelf 1"`) {
+		t.Errorf("updating the copy failed with %d: %s", response.Code, response.Body)
+	}
+	response = callAPI("PUT", path, "alice-key-0123456", fmt.Sprintf(`{"albumId": %d, "format": "vinyl"}`, wish.ID))
+	if response.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 when changing the album, got %d", response.Code)
+	}
+
+	// Albums users have copies of stay in the catalog, with all that refers
+	// to them
+	stockAlbum(t, dark, 2)
+	if response := callAPI("DELETE", fmt.Sprintf("/api/v1/albums/%d", dark.ID), "", ""); response.Code != http.StatusConflict {
+		t.Errorf("expected 409 for deleting a collected album, got %d", response.Code)
+	}
+	if quantity, _ := shopStore.GetStock(dark.ID); quantity != 2 {
+		t.Errorf("expected the stock to be left alone, got %d", quantity)
+	}
+	response = submitForm(albumURL(wish.ID)+"/delete", nil, map[string]string{"Origin": "http://example.com"})
+	if body := followRedirect(t, response).Body.String(); !strings.Contains(body, "users have copies of it") {
+		t.Errorf("the album page should tell why it wasn't deleted:\n%s", body)
+	}
+	if _, err := collectionStore.GetCollectionItem("alice", vinyl.ID); err != nil {
+		t.Errorf("the copy should be kept, got %v", err)
+	}
+}
+
+func TestCollectionItemValidation(t *testing.T) {
+	req := collectionItemRequest{Format: "8-track", MediaCondition: "Good", PurchaseDate: "31/05/2024", PurchasePrice: "€9", Location: strings.Repeat("a", maxLocationLength+1)}
+	fields := []string{}
+	for _, e := range req.Validate() {
+		fields = append(fields, e.Field)
+	}
+	if actual := fmt.Sprint(fields); actual != "[albumId format mediaCondition purchaseDate purchasePrice location]" {
+		t.Errorf("unexpected invalid fields %s", actual)
+	}
+
+	req = collectionItemRequest{AlbumID: 1, Format: "digital", SleeveCondition: "M", PurchaseDate: "2999-01-01"}
+	errs := req.Validate()
+	if len(errs) != 2 || errs[0].Field != "sleeveCondition" || errs[1].Code != "out_of_range" {
+		t.Errorf("digital copies have no condition and purchases are not in the future, got %v", errs)
+	}
+}
+
+func TestPriceCents(t *testing.T) {
+	for price, expected := range map[string]int64{"22": 2200, "22.9": 2290, "22.99": 2299, "0.05": 5} {
+		if cents, ok := priceCents(price); !ok || cents != expected {
+			t.Errorf("%s: expected %d cents, got %d", price, expected, cents)
+		}
+	}
+	if _, ok := priceCents("22.999"); ok {
+		t.Errorf("prices with three decimals should be refused")
+	}
+	if formatCents(4150) != "41.50" {
+		t.Errorf("unexpected format %s", formatCents(4150))
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// A CollectionItem is a copy of an album on the shelves of a user. Users
+// can own several copies of an album, in different formats or pressings
+type CollectionItem struct {
+	ID      int64  `json:"id"`
+	Owner   string `json:"owner"`
+	AlbumID int64  `json:"albumId"`
+	Album   *Album `json:"album"`
+	// Format is one of `collectionFormats`
+	Format   string `json:"format"`
+	Pressing string `json:"pressing"`
+	// The conditions are grades of `conditionGrades`, empty when unknown.
+	// Digital copies have none
+	MediaCondition  string `json:"mediaCondition"`
+	SleeveCondition string `json:"sleeveCondition"`
+	// PurchaseDate is a date such as "2024-05-31", and PurchasePrice a
+	// decimal amount like the price of an album. Both may be empty
+	PurchaseDate  string    `json:"purchaseDate"`
+	PurchasePrice string    `json:"purchasePrice"`
+	Location      string    `json:"location"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// The collection store keeps the copies of albums owned by the users
+type CollectionStore interface {
+	CreateCollectionItem(item *CollectionItem) error
+	GetCollectionItem(owner string, id int64) (*CollectionItem, error)
+	ListCollection(owner string) ([]*CollectionItem, error)
+	UpdateCollectionItem(item *CollectionItem) error
+	DeleteCollectionItem(owner string, id int64) error
+}
+
+// ErrCollectionItemNotFound is returned when the user owns no copy with the
+// given ID
+var ErrCollectionItemNotFound = errors.New("collection item not found")
+
+var collectionStore CollectionStore
+
+func InitCollection(s CollectionStore) {
+	collectionStore = s
+}
+
+// CreateCollectionItem records a copy of an album. It returns
+// ErrAlbumNotFound if there is no such album
+func (store *dbStore) CreateCollectionItem(item *CollectionItem) error {
+	album, err := store.GetAlbum(item.AlbumID)
+	if err != nil {
+		return err
+	}
+	item.Album = album
+	item.CreatedAt = time.Now().UTC()
+	item.UpdatedAt = item.CreatedAt
+	res, err := store.exec(`INSERT INTO collection_items(owner, album_id, format, pressing, media_condition, sleeve_condition,
+		purchase_date, purchase_price, location, created_at, updated_at) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)`,
+		item.Owner, item.AlbumID, item.Format, item.Pressing, item.MediaCondition, item.SleeveCondition,
+		item.PurchaseDate, item.PurchasePrice, item.Location, item.CreatedAt, item.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	item.ID, err = res.LastInsertId()
+	return err
+}
+
+// GetCollectionItem returns a copy owned by `owner`. The copies of other
+// users are not found
+func (store *dbStore) GetCollectionItem(owner string, id int64) (*CollectionItem, error) {
+	items, err := store.queryCollection("WHERE c.owner = $1 AND c.id = $2", owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrCollectionItemNotFound
+	}
+	return items[0], nil
+}
+
+// ListCollection returns the copies owned by `owner`, by artist and title
+func (store *dbStore) ListCollection(owner string) ([]*CollectionItem, error) {
+	return store.queryCollection("WHERE c.owner = $1", owner)
+}
+
+func (store *dbStore) queryCollection(where string, args ...interface{}) ([]*CollectionItem, error) {
+	rows, err := store.query(`SELECT c.id, c.owner, c.album_id, c.format, c.pressing, c.media_condition, c.sleeve_condition,
+		c.purchase_date, c.purchase_price, c.location, c.created_at, c.updated_at,
+		a.title, a.artist, COALESCE(a.price, ''), COALESCE(a.year, ''), COALESCE(a.genre, '')
+		FROM collection_items c JOIN albums a ON a.idAlbum = c.album_id `+where+`
+		ORDER BY lower(a.artist), lower(a.title), c.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []*CollectionItem{}
+	for rows.Next() {
+		item := &CollectionItem{Album: &Album{}}
+		if err := rows.Scan(&item.ID, &item.Owner, &item.AlbumID, &item.Format, &item.Pressing, &item.MediaCondition,
+			&item.SleeveCondition, &item.PurchaseDate, &item.PurchasePrice, &item.Location, &item.CreatedAt, &item.UpdatedAt,
+			&item.Album.Title, &item.Album.Artist, &item.Album.Price, &item.Album.Year, &item.Album.Genre); err != nil {
+			return nil, err
+		}
+		item.Album.ID = item.AlbumID
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// UpdateCollectionItem replaces the details of a copy. The album it is a
+// copy of doesn't change
+func (store *dbStore) UpdateCollectionItem(item *CollectionItem) error {
+	item.UpdatedAt = time.Now().UTC()
+	res, err := store.exec(`UPDATE collection_items SET format = $1, pressing = $2, media_condition = $3, sleeve_condition = $4,
+		purchase_date = $5, purchase_price = $6, location = $7, updated_at = $8 WHERE owner = $9 AND id = $10`,
+		item.Format, item.Pressing, item.MediaCondition, item.SleeveCondition, item.PurchaseDate, item.PurchasePrice,
+		item.Location, item.UpdatedAt, item.Owner, item.ID)
+	if err != nil {
+		return err
+	}
+	return expectRow(res, ErrCollectionItemNotFound)
+}
+
+func (store *dbStore) DeleteCollectionItem(owner string, id int64) error {
+	res, err := store.exec("DELETE FROM collection_items WHERE owner = $1 AND id = $2", owner, id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res, ErrCollectionItemNotFound)
+}
+
+func createCollectionTable(db *sql.DB) {
+	createCollectionTableSQL := `CREATE TABLE IF NOT EXISTS collection_items (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"owner" TEXT NOT NULL,
+		"album_id" integer NOT NULL REFERENCES albums(idAlbum),
+		"format" TEXT NOT NULL,
+		"pressing" TEXT NOT NULL,
+		"media_condition" TEXT NOT NULL,
+		"sleeve_condition" TEXT NOT NULL,
+		"purchase_date" TEXT NOT NULL,
+		"purchase_price" TEXT NOT NULL,
+		"location" TEXT NOT NULL,
+		"created_at" DATETIME NOT NULL,
+		"updated_at" DATETIME NOT NULL
+	  );`
+	createOwnerIndexSQL := `CREATE INDEX IF NOT EXISTS collection_items_owner ON collection_items(owner)`
+
+	for _, statement := range []string{createCollectionTableSQL, createOwnerIndexSQL} {
+		if _, err := db.Exec(statement); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+}
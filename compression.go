@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Bodies smaller than this are sent as they are, compressing them would save
+// less than the headers it adds
+const minCompressSize = 1024
+
+// Content types that are already compressed, or that are streamed
+var uncompressedTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/gzip", "application/zip", "application/x-7z-compressed",
+	"application/pdf", "application/octet-stream",
+	"text/event-stream",
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+// negotiateEncoding picks the encoding the client prefers among gzip and
+// deflate, according to its `Accept-Encoding` header. It returns "" when the
+// response should be sent as it is
+func negotiateEncoding(r *http.Request) string {
+	header := r.Header.Get("Accept-Encoding")
+	// The wildcard stands for the codings the list doesn't name. Refused
+	// codings are dropped from the parsed list, so they are collected here
+	named := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		coding, _, _ := strings.Cut(part, ";")
+		named[contentCoding(coding)] = true
+	}
+
+	for _, accepted := range parseQualityList(header) {
+		switch coding := contentCoding(accepted.Value); coding {
+		case "gzip", "deflate":
+			return coding
+		case "identity":
+			return ""
+		case "*":
+			for _, coding := range []string{"gzip", "deflate"} {
+				if !named[coding] {
+					return coding
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// contentCoding normalizes a coding of `Accept-Encoding`. "x-gzip" is an old
+// name of gzip
+func contentCoding(coding string) string {
+	coding = strings.ToLower(strings.TrimSpace(coding))
+	if coding == "x-gzip" {
+		return "gzip"
+	}
+	return coding
+}
+
+// compressionMiddleware compresses the responses for the clients that accept
+// it. Range requests are left alone, since the ranges are offsets in the
+// uncompressed file
+func compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r)
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// A compressWriter buffers the beginning of the response until it knows
+// whether it is worth compressing: the body is large enough, or the handler
+// flushed it, and its headers allow it
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buffer   []byte
+	decided  bool
+	// encoder is nil when the response is sent uncompressed
+	encoder io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 || cw.decided {
+		return
+	}
+	// Informational responses are sent right away
+	if status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.decided {
+		cw.buffer = append(cw.buffer, b...)
+		if len(cw.buffer) < minCompressSize {
+			return len(b), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide sends the headers, compressing if `large` and the response allows
+// it, and then what was buffered
+func (cw *compressWriter) decide(large bool) error {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if large && cw.compressible() {
+		header := cw.Header()
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		// The ranges would be offsets in the compressed body
+		header.Del("Accept-Ranges")
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		if cw.encoding == "gzip" {
+			writer := gzipWriters.Get().(*gzip.Writer)
+			writer.Reset(cw.ResponseWriter)
+			cw.encoder = writer
+		} else {
+			writer := zlibWriters.Get().(*zlib.Writer)
+			writer.Reset(cw.ResponseWriter)
+			cw.encoder = writer
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buffered := cw.buffer
+	cw.buffer = nil
+	if len(buffered) == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buffered)
+	} else {
+		_, err = cw.ResponseWriter.Write(buffered)
+	}
+	return err
+}
+
+func (cw *compressWriter) compressible() bool {
+	header := cw.Header()
+	if cw.status == http.StatusNoContent || cw.status == http.StatusNotModified || cw.status == http.StatusPartialContent {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		// The server would sniff the compressed bytes otherwise
+		contentType = http.DetectContentType(cw.buffer)
+		header.Set("Content-Type", contentType)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range uncompressedTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush sends what was written so far. A streamed response is compressed
+// even if its beginning is small, the rest of it follows
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close sends a small response as it is, or ends the compressed body
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 {
+			// The handler wrote nothing, let the server send its defaults
+			cw.decided = true
+			return nil
+		}
+		return cw.decide(false)
+	}
+	if cw.encoder == nil {
+		return nil
+	}
+	err := cw.encoder.Close()
+	switch writer := cw.encoder.(type) {
+	case *gzip.Writer:
+		writer.Reset(nil)
+		gzipWriters.Put(writer)
+	case *zlib.Writer:
+		writer.Reset(nil)
+		zlibWriters.Put(writer)
+	}
+	cw.encoder = nil
+	return err
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("hijacking is not supported")
+}
+
+// Unwrap lets `http.ResponseController` reach the original writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
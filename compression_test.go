@@ -0,0 +1,110 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func compressedRequest(target, encoding string, header map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", target, nil)
+	request.Header.Set("Accept-Encoding", encoding)
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestCompressedJSON(t *testing.T) {
+	plain := compressedRequest("/openapi.json", "identity", nil)
+	if plain.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("identity should not be compressed")
+	}
+
+	for encoding, reader := range map[string]func(io.Reader) (io.Reader, error){
+		"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	} {
+		response := compressedRequest("/openapi.json", encoding+", br;q=0.5", nil)
+		if response.Header().Get("Content-Encoding") != encoding {
+			t.Fatalf("expected %s, got %q", encoding, response.Header().Get("Content-Encoding"))
+		}
+		if !strings.Contains(response.Header().Get("Vary"), "Accept-Encoding") {
+			t.Errorf("the response should vary with Accept-Encoding")
+		}
+		decoder, err := reader(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(decoder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != plain.Body.String() {
+			t.Errorf("the %s body differs from the uncompressed one", encoding)
+		}
+	}
+}
+
+func TestSmallResponsesAreNotCompressed(t *testing.T) {
+	response := compressedRequest("/healthz", "gzip", nil)
+	if response.Header().Get("Content-Encoding") != "" || !strings.Contains(response.Body.String(), "ok") {
+		t.Errorf("a small body should be sent as it is, got %q", response.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestCompressedAssetsAndRanges(t *testing.T) {
+	response := compressedRequest("/assets/", "gzip", nil)
+	if response.Header().Get("Content-Encoding") != "gzip" || response.Header().Get("Accept-Ranges") != "" {
+		t.Errorf("the page should be compressed without ranges, got %v", response.Header())
+	}
+
+	response = compressedRequest("/assets/", "gzip", map[string]string{"Range": "bytes=0-99"})
+	if response.Code != http.StatusPartialContent || response.Header().Get("Content-Encoding") != "" || response.Body.Len() != 100 {
+		t.Errorf("a range should be served uncompressed, got %d %q with %d bytes",
+			response.Code, response.Header().Get("Content-Encoding"), response.Body.Len())
+	}
+}
+
+func TestCompressionSkipsCompressedTypes(t *testing.T) {
+	handler := compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(make([]byte, 4*minCompressSize))
+	}))
+	request := httptest.NewRequest("GET", "/cover.png", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Header().Get("Content-Encoding") != "" || recorder.Body.Len() != 4*minCompressSize {
+		t.Errorf("an image should be sent as it is")
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                         "",
+		"gzip, deflate, br":        "gzip",
+		"deflate, gzip;q=0.5":      "deflate",
+		"br":                       "",
+		"*":                        "gzip",
+		"gzip;q=0, *;q=0.1":        "deflate",
+		"gzip;q=0, deflate;q=0, *": "",
+		"x-gzip;q=0.5, *":          "deflate",
+		"x-gzipped-custom, *":      "gzip",
+		"identity, gzip;q=0.5":     "",
+	}
+	for header, expected := range cases {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Header.Set("Accept-Encoding", header)
+		if encoding := negotiateEncoding(request); encoding != expected {
+			t.Errorf("%q: expected %q, got %q", header, expected, encoding)
+		}
+	}
+}
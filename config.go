@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Config holds every setting of the server. Each setting is read, by order
+// of precedence, from a command-line flag, an environment variable, the
+// config file, or else keeps its default value
+type Config struct {
+	Addr         string  `json:"addr"`
+	Database     string  `json:"database"`
+	SeedFile     string  `json:"seedFile"`
+	AssetsDir    string  `json:"assetsDir"`
+	TemplatesDir string  `json:"templatesDir"`
+	LogLevel     string  `json:"logLevel"`
+	ReadRate     float64 `json:"readRate"`
+	ReadBurst    int     `json:"readBurst"`
+	WriteRate    float64 `json:"writeRate"`
+	WriteBurst   int     `json:"writeBurst"`
+	// APIKeys maps the API keys to the user they belong to
+	APIKeys map[string]string `json:"apiKeys"`
+	// Staff are the users who manage the stock and ship the orders
+	Staff []string `json:"staff"`
+	// The server uses HTTPS when it has a certificate and its key. With
+	// TLSSelfSigned, they are generated if the files don't exist yet
+	TLSCert       string `json:"tlsCert"`
+	TLSKey        string `json:"tlsKey"`
+	TLSSelfSigned bool   `json:"tlsSelfSigned"`
+	// RedirectAddr is where plain HTTP requests are redirected to HTTPS
+	RedirectAddr string `json:"redirectAddr"`
+	HSTSMaxAge   int    `json:"hstsMaxAge"`
+	// The origins, methods and headers of the pages that may call the API
+	// from a browser
+	CORSOrigins     []string `json:"corsOrigins"`
+	CORSMethods     []string `json:"corsMethods"`
+	CORSHeaders     []string `json:"corsHeaders"`
+	CORSCredentials bool     `json:"corsCredentials"`
+	CORSMaxAge      int      `json:"corsMaxAge"`
+
+	// sources tells where each setting came from, by setting name
+	sources map[string]string
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Addr:            ":8080",
+		Database:        "sqlite-database-alb.db",
+		LogLevel:        "info",
+		ReadRate:        rateLimits.Read.Rate,
+		ReadBurst:       rateLimits.Read.Burst,
+		WriteRate:       rateLimits.Write.Rate,
+		WriteBurst:      rateLimits.Write.Burst,
+		APIKeys:         map[string]string{},
+		HSTSMaxAge:      365 * 24 * 60 * 60,
+		CORSOrigins:     corsPolicy.Origins,
+		CORSMethods:     corsPolicy.Methods,
+		CORSHeaders:     corsPolicy.Headers,
+		CORSCredentials: corsPolicy.Credentials,
+		CORSMaxAge:      corsPolicy.MaxAge,
+		sources:         map[string]string{},
+	}
+}
+
+// The environment variables are the names of the settings in upper case,
+// with this prefix: `addr` is read from ALBUMPEDIA_ADDR
+const configEnvPrefix = "ALBUMPEDIA_"
+
+// A configSetting knows how to read and write one field of the Config, as
+// text. Secrets are never printed, and can't be given as flags, since the
+// command line of a process is visible to every user of the machine
+type configSetting struct {
+	name   string
+	usage  string
+	secret bool
+	// Boolean settings can be given as a flag without a value
+	isBool bool
+	get    func(*Config) string
+	set    func(*Config, string) error
+}
+
+// A settingFlag keeps the value of a flag as text, until it is known whether
+// the flag was given and should override the other sources
+type settingFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *settingFlag) String() string     { return f.value }
+func (f *settingFlag) Set(v string) error { f.value = v; return nil }
+func (f *settingFlag) IsBoolFlag() bool   { return f.isBool }
+
+var configSettings = []configSetting{
+	{name: "addr", usage: "address to listen on",
+		get: func(c *Config) string { return c.Addr },
+		set: func(c *Config, v string) error { c.Addr = v; return nil }},
+	{name: "database", usage: "SQLite database file",
+		get: func(c *Config) string { return c.Database },
+		set: func(c *Config, v string) error { c.Database = v; return nil }},
+	{name: "seed-file", usage: "JSON file an empty catalog is seeded from, instead of the built-in one",
+		get: func(c *Config) string { return c.SeedFile },
+		set: func(c *Config, v string) error { c.SeedFile = v; return nil }},
+	{name: "assets-dir", usage: "directory of the web interface files, instead of the built-in ones",
+		get: func(c *Config) string { return c.AssetsDir },
+		set: func(c *Config, v string) error { c.AssetsDir = v; return nil }},
+	{name: "templates-dir", usage: "directory of the HTML page templates, instead of the built-in ones",
+		get: func(c *Config) string { return c.TemplatesDir },
+		set: func(c *Config, v string) error { c.TemplatesDir = v; return nil }},
+	{name: "log-level", usage: "lowest level logged: debug, info, warn or error",
+		get: func(c *Config) string { return c.LogLevel },
+		set: func(c *Config, v string) error { c.LogLevel = v; return nil }},
+	{name: "read-rate", usage: "reads per second allowed per client, 0 for no limit",
+		get: func(c *Config) string { return strconv.FormatFloat(c.ReadRate, 'g', -1, 64) },
+		set: func(c *Config, v string) (err error) { c.ReadRate, err = strconv.ParseFloat(v, 64); return err }},
+	{name: "read-burst", usage: "reads a client may make at once",
+		get: func(c *Config) string { return strconv.Itoa(c.ReadBurst) },
+		set: func(c *Config, v string) (err error) { c.ReadBurst, err = strconv.Atoi(v); return err }},
+	{name: "write-rate", usage: "writes per second allowed per client, 0 for no limit",
+		get: func(c *Config) string { return strconv.FormatFloat(c.WriteRate, 'g', -1, 64) },
+		set: func(c *Config, v string) (err error) { c.WriteRate, err = strconv.ParseFloat(v, 64); return err }},
+	{name: "write-burst", usage: "writes a client may make at once",
+		get: func(c *Config) string { return strconv.Itoa(c.WriteBurst) },
+		set: func(c *Config, v string) (err error) { c.WriteBurst, err = strconv.Atoi(v); return err }},
+	{name: "api-keys", usage: "API keys and their users, as key:user pairs separated by commas", secret: true,
+		get: func(c *Config) string { return formatAPIKeys(c.APIKeys) },
+		set: func(c *Config, v string) (err error) { c.APIKeys, err = parseAPIKeys(v); return err }},
+	{name: "staff", usage: "users of API keys who manage the stock and the orders, separated by commas",
+		get: func(c *Config) string { return strings.Join(c.Staff, ",") },
+		set: func(c *Config, v string) error { c.Staff = splitList(v); return nil }},
+	{name: "tls-cert", usage: "PEM certificate file, serving HTTPS when set",
+		get: func(c *Config) string { return c.TLSCert },
+		set: func(c *Config, v string) error { c.TLSCert = v; return nil }},
+	{name: "tls-key", usage: "PEM private key file of the certificate",
+		get: func(c *Config) string { return c.TLSKey },
+		set: func(c *Config, v string) error { c.TLSKey = v; return nil }},
+	{name: "tls-self-signed", usage: "generate a self-signed certificate into tls-cert and tls-key if they don't exist, for development", isBool: true,
+		get: func(c *Config) string { return strconv.FormatBool(c.TLSSelfSigned) },
+		set: func(c *Config, v string) (err error) { c.TLSSelfSigned, err = strconv.ParseBool(v); return err }},
+	{name: "redirect-addr", usage: "address to listen on for plain HTTP requests, which are redirected to HTTPS",
+		get: func(c *Config) string { return c.RedirectAddr },
+		set: func(c *Config, v string) error { c.RedirectAddr = v; return nil }},
+	{name: "hsts-max-age", usage: "seconds browsers should only use HTTPS for, sent with HTTPS responses, 0 to disable",
+		get: func(c *Config) string { return strconv.Itoa(c.HSTSMaxAge) },
+		set: func(c *Config, v string) (err error) { c.HSTSMaxAge, err = strconv.Atoi(v); return err }},
+	{name: "cors-origins", usage: "origins of the pages that may call the API from a browser, separated by commas, * for any",
+		get: func(c *Config) string { return strings.Join(c.CORSOrigins, ",") },
+		set: func(c *Config, v string) error { c.CORSOrigins = splitList(v); return nil }},
+	{name: "cors-methods", usage: "methods pages of other origins may use, separated by commas",
+		get: func(c *Config) string { return strings.Join(c.CORSMethods, ",") },
+		set: func(c *Config, v string) error { c.CORSMethods = splitList(v); return nil }},
+	{name: "cors-headers", usage: "request headers pages of other origins may send, separated by commas, * for any",
+		get: func(c *Config) string { return strings.Join(c.CORSHeaders, ",") },
+		set: func(c *Config, v string) error { c.CORSHeaders = splitList(v); return nil }},
+	{name: "cors-credentials", usage: "let pages of other origins send cookies and credentials", isBool: true,
+		get: func(c *Config) string { return strconv.FormatBool(c.CORSCredentials) },
+		set: func(c *Config, v string) (err error) { c.CORSCredentials, err = strconv.ParseBool(v); return err }},
+	{name: "cors-max-age", usage: "seconds browsers may cache the answer to a preflight",
+		get: func(c *Config) string { return strconv.Itoa(c.CORSMaxAge) },
+		set: func(c *Config, v string) (err error) { c.CORSMaxAge, err = strconv.Atoi(v); return err }},
+}
+
+func configEnvName(setting string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// LoadConfig builds the configuration from the command-line arguments, the
+// environment and the config file. The file is given with `-config` or
+// ALBUMPEDIA_CONFIG. The settings are added to the flags of `fs`, which may
+// already have flags of its own. The remaining arguments are returned as
+// well. When asked for the usage or the configuration, it prints it to the
+// output of `fs` and returns flag.ErrHelp
+func LoadConfig(fs *flag.FlagSet, args []string, getenv func(string) string) (*Config, []string, error) {
+	cfg := DefaultConfig()
+
+	configFile := fs.String("config", getenv(configEnvPrefix+"CONFIG"), "JSON config file (env "+configEnvPrefix+"CONFIG)")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+	flags := map[string]*settingFlag{}
+	for _, s := range configSettings {
+		if s.secret {
+			continue
+		}
+		flags[s.name] = &settingFlag{value: s.get(cfg), isBool: s.isBool}
+		fs.Var(flags[s.name], s.name, s.usage+" (env "+configEnvName(s.name)+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.readFile(*configFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, s := range configSettings {
+		if v := getenv(configEnvName(s.name)); v != "" {
+			if err := s.set(cfg, v); err != nil {
+				return nil, nil, fmt.Errorf("%s: invalid value %q: %v", configEnvName(s.name), v, err)
+			}
+			cfg.sources[s.name] = "env " + configEnvName(s.name)
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range configSettings {
+			if s.name == f.Name && flagErr == nil {
+				if err := s.set(cfg, flags[s.name].value); err != nil {
+					flagErr = fmt.Errorf("-%s: invalid value %q: %v", s.name, flags[s.name].value, err)
+				}
+				cfg.sources[s.name] = "flag"
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if *printConfig {
+		cfg.Print(fs.Output())
+		return nil, nil, flag.ErrHelp
+	}
+	return cfg, fs.Args(), nil
+}
+
+// readFile reads the settings of a JSON config file. Settings missing from
+// the file keep their current value
+func (cfg *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading the config file: %v", err)
+	}
+
+	// Decoding on top of the current values only changes what the file
+	// sets. Decoding into a map as well tells which settings these are
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	keys := map[string]json.RawMessage{}
+	json.Unmarshal(data, &keys)
+	for key := range keys {
+		cfg.sources[settingOfJSONKey(key)] = "file " + path
+	}
+	return nil
+}
+
+// settingOfJSONKey turns `seedFile` into `seed-file`
+func settingOfJSONKey(key string) string {
+	var b strings.Builder
+	for _, c := range key {
+		if c >= 'A' && c <= 'Z' {
+			b.WriteByte('-')
+			c += 'a' - 'A'
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Validate checks every setting, and reports all the invalid ones at once
+func (cfg *Config) Validate() error {
+	var problems []string
+	if _, port, err := net.SplitHostPort(cfg.Addr); err != nil || port == "" {
+		problems = append(problems, fmt.Sprintf("addr %q must be host:port or :port", cfg.Addr))
+	}
+	if cfg.Database == "" {
+		problems = append(problems, "database is required")
+	}
+	if _, err := parseLevel(cfg.LogLevel); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, limit := range []struct {
+		name  string
+		rate  float64
+		burst int
+	}{{"read", cfg.ReadRate, cfg.ReadBurst}, {"write", cfg.WriteRate, cfg.WriteBurst}} {
+		if limit.rate < 0 {
+			problems = append(problems, limit.name+"-rate can't be negative")
+		}
+		if limit.rate > 0 && limit.burst < 1 {
+			problems = append(problems, limit.name+"-burst must be at least 1")
+		}
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		problems = append(problems, "tls-cert and tls-key must be set together")
+	}
+	if cfg.TLSSelfSigned && cfg.TLSCert == "" {
+		problems = append(problems, "tls-self-signed needs tls-cert and tls-key to store the certificate")
+	}
+	if cfg.RedirectAddr != "" {
+		if cfg.TLSCert == "" {
+			problems = append(problems, "redirect-addr needs HTTPS to redirect to")
+		}
+		if _, _, err := net.SplitHostPort(cfg.RedirectAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("redirect-addr %q must be host:port or :port", cfg.RedirectAddr))
+		}
+	}
+	if cfg.HSTSMaxAge < 0 {
+		problems = append(problems, "hsts-max-age can't be negative")
+	}
+	for _, origin := range cfg.CORSOrigins {
+		if origin == "*" {
+			if cfg.CORSCredentials {
+				problems = append(problems, "cors-credentials can't be used with any origin, list them in cors-origins")
+			}
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			problems = append(problems, fmt.Sprintf("cors-origins %q must be a scheme and a host, like https://app.example.com", origin))
+		}
+	}
+	if cfg.CORSMaxAge < 0 {
+		problems = append(problems, "cors-max-age can't be negative")
+	}
+	for key, user := range cfg.APIKeys {
+		if len(key) < minAPIKeyLength || user == "" {
+			problems = append(problems, fmt.Sprintf("api-keys must be at least %d characters long and have a user", minAPIKeyLength))
+			break
+		}
+	}
+	users := map[string]bool{}
+	for _, user := range cfg.APIKeys {
+		users[user] = true
+	}
+	for _, user := range cfg.Staff {
+		if !users[user] {
+			problems = append(problems, fmt.Sprintf("staff %q has no API key", user))
+		}
+	}
+
+	if problems != nil {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// UseTLS tells whether the server serves HTTPS
+func (cfg *Config) UseTLS() bool {
+	return cfg.TLSCert != ""
+}
+
+// ValidateFiles checks that the files the server needs are there. The other
+// commands don't need them, so it isn't part of `Validate`
+func (cfg *Config) ValidateFiles() error {
+	var problems []string
+	if cfg.SeedFile != "" {
+		if info, err := os.Stat(cfg.SeedFile); err != nil || info.IsDir() {
+			problems = append(problems, fmt.Sprintf("seed-file %q is not a readable file", cfg.SeedFile))
+		}
+	}
+	for _, dir := range []struct{ setting, path string }{
+		{"assets-dir", cfg.AssetsDir},
+		{"templates-dir", cfg.TemplatesDir},
+	} {
+		if dir.path == "" {
+			continue
+		}
+		if info, err := os.Stat(dir.path); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s %q is not a directory", dir.setting, dir.path))
+		}
+	}
+	// Self-signed certificates are created when missing
+	if cfg.TLSCert != "" && !cfg.TLSSelfSigned {
+		for _, file := range []string{cfg.TLSCert, cfg.TLSKey} {
+			if _, err := os.Stat(file); err != nil {
+				problems = append(problems, fmt.Sprintf("%q is not a readable file", file))
+			}
+		}
+	}
+	if problems != nil {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Short keys could be guessed
+const minAPIKeyLength = 16
+
+// Print writes the effective configuration and where each setting comes
+// from. Secrets are redacted
+func (cfg *Config) Print(w io.Writer) {
+	for _, s := range configSettings {
+		value := s.get(cfg)
+		if s.secret {
+			value = redact(cfg, s)
+		}
+		source := cfg.sources[s.name]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Fprintf(w, "%-12s = %-30s (%s)\n", s.name, value, source)
+	}
+}
+
+// logFields are the settings as key/value pairs for the logger, with the
+// secrets redacted
+func (cfg *Config) logFields() []interface{} {
+	fields := []interface{}{}
+	for _, s := range configSettings {
+		value := s.get(cfg)
+		if s.secret {
+			value = redact(cfg, s)
+		}
+		fields = append(fields, s.name, value)
+	}
+	return fields
+}
+
+// redact hides the API keys but keeps their users, which helps checking
+// that the right keys were loaded
+func redact(cfg *Config, s configSetting) string {
+	if s.name != "api-keys" {
+		return "[redacted]"
+	}
+	users := []string{}
+	for _, user := range cfg.APIKeys {
+		users = append(users, "[redacted]:"+user)
+	}
+	sort.Strings(users)
+	return strings.Join(users, ",")
+}
+
+// Apply makes the configuration the one used by the server
+func (cfg *Config) Apply() {
+	level, _ := parseLevel(cfg.LogLevel)
+	InitLogger(NewLogger(os.Stderr, level))
+	InitRateLimits(RateLimitConfig{
+		Read:  RateLimit{Rate: cfg.ReadRate, Burst: cfg.ReadBurst},
+		Write: RateLimit{Rate: cfg.WriteRate, Burst: cfg.WriteBurst},
+	})
+	InitAPIKeys(cfg.APIKeys)
+	InitStaff(cfg.Staff)
+	InitCORS(CORSPolicy{
+		Origins:     cfg.CORSOrigins,
+		Methods:     cfg.CORSMethods,
+		Headers:     cfg.CORSHeaders,
+		Credentials: cfg.CORSCredentials,
+		MaxAge:      cfg.CORSMaxAge,
+	})
+	InitAssets(cfg.AssetsDir)
+}
+
+func parseAPIKeys(v string) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, pair := range strings.Split(v, ",") {
+		key, user, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, errors.New("expected key:user pairs")
+		}
+		keys[key] = user
+	}
+	return keys, nil
+}
+
+// splitList splits a comma-separated setting, dropping the empty values
+func splitList(v string) []string {
+	values := []string{}
+	for _, value := range strings.Split(v, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func formatAPIKeys(keys map[string]string) string {
+	pairs := []string{}
+	for key, user := range keys {
+		pairs = append(pairs, key+":"+user)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func testFlagSet(output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(output)
+	return fs
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "albumpedia.json")
+	if err := ioutil.WriteFile(file, []byte(`{"addr": ":7000", "database": "file.db", "logLevel": "warn", "readRate": 3}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file sets four settings, the environment overrides two of them,
+	// and a flag overrides one of those again
+	cfg, rest, err := LoadConfig(testFlagSet(ioutil.Discard), []string{"-config", file, "-addr", ":9000", "extra"},
+		env(map[string]string{"ALBUMPEDIA_ADDR": ":8000", "ALBUMPEDIA_DATABASE": "env.db"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"addr":       ":9000",
+		"database":   "env.db",
+		"log-level":  "warn",
+		"read-rate":  "3",
+		"write-rate": "2",
+	}
+	for _, s := range configSettings {
+		if value, ok := expected[s.name]; ok && s.get(cfg) != value {
+			t.Errorf("%s should be %s, got %s", s.name, value, s.get(cfg))
+		}
+	}
+	if len(rest) != 1 || rest[0] != "extra" {
+		t.Errorf("the remaining arguments should be returned, got %v", rest)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	_, _, err := LoadConfig(testFlagSet(ioutil.Discard), []string{"-addr", "8080", "-read-rate", "-1", "-log-level", "loud"}, env(nil))
+	if err == nil {
+		t.Fatal("the configuration should be invalid")
+	}
+	for _, problem := range []string{"addr", "read-rate", "log-level"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("the error should mention %s, got %v", problem, err)
+		}
+	}
+
+	_, _, err = LoadConfig(testFlagSet(ioutil.Discard), []string{"-read-burst", "many"}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "-read-burst") {
+		t.Errorf("expected an error about -read-burst, got %v", err)
+	}
+}
+
+func TestConfigUnknownFileSetting(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "albumpedia.json")
+	if err := ioutil.WriteFile(file, []byte(`{"port": 8080}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadConfig(testFlagSet(ioutil.Discard), nil, env(map[string]string{"ALBUMPEDIA_CONFIG": file})); err == nil {
+		t.Errorf("an unknown setting should be refused")
+	}
+}
+
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+	out := &bytes.Buffer{}
+	_, _, err := LoadConfig(testFlagSet(out), []string{"-print-config"},
+		env(map[string]string{"ALBUMPEDIA_API_KEYS": "0123456789abcdef-secret:ops"}))
+	if err != flag.ErrHelp {
+		t.Fatalf("expected flag.ErrHelp, got %v", err)
+	}
+	if strings.Contains(out.String(), "0123456789abcdef-secret") {
+		t.Errorf("the API key should be redacted:\n%s", out)
+	}
+	if !strings.Contains(out.String(), "[redacted]:ops") || !strings.Contains(out.String(), "(env ALBUMPEDIA_API_KEYS)") {
+		t.Errorf("the users and the source of the keys should be printed:\n%s", out)
+	}
+}
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := DefaultConfig().ValidateFiles(); err != nil {
+		t.Error(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.AssetsDir = "nowhere"
+	if err := cfg.ValidateFiles(); err == nil || !strings.Contains(err.Error(), "assets-dir") {
+		t.Errorf("expected an error about assets-dir, got %v", err)
+	}
+}
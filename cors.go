@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// CORSPolicy tells which web pages served by other origins may call the
+// API from a browser. Without origins, browsers only let pages served by the
+// API itself call it
+type CORSPolicy struct {
+	// Origins are like "https://app.example.com", or "*" for any origin
+	Origins []string
+	Methods []string
+	// Headers are the request headers pages may send, "*" for any header
+	Headers []string
+	// Credentials lets pages send cookies and authorization headers
+	Credentials bool
+	// MaxAge is how long browsers may cache a preflight, in seconds
+	MaxAge int
+}
+
+var corsPolicy = CORSPolicy{
+	Methods: []string{"GET", "HEAD", "POST", "PUT", "DELETE"},
+	Headers: []string{"Content-Type", "X-API-Key", "X-Request-ID", "Last-Event-ID"},
+	MaxAge:  600,
+}
+
+func InitCORS(policy CORSPolicy) {
+	corsPolicy = policy
+}
+
+// The response headers pages may read, besides the ones every page may
+var corsExposedHeaders = strings.Join([]string{
+	"Location", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", requestIDHeader,
+}, ", ")
+
+type cors struct {
+	policy CORSPolicy
+}
+
+func newCORS(policy CORSPolicy) *cors {
+	return &cors{policy: policy}
+}
+
+func (c *cors) enabled() bool {
+	return len(c.policy.Origins) > 0
+}
+
+func (c *cors) allowsOrigin(origin string) bool {
+	for _, allowed := range c.policy.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cors) allowsMethod(method string) bool {
+	for _, allowed := range c.policy.Methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders checks the comma-separated headers of a preflight
+func (c *cors) allowsHeaders(headers string) bool {
+	for _, header := range strings.Split(headers, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		allowed := false
+		for _, name := range c.policy.Headers {
+			if name == "*" || strings.EqualFold(name, header) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// allowOrigin sets the headers shared by preflights and the requests that
+// follow them. It returns false if the origin is not allowed
+func (c *cors) allowOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !c.allowsOrigin(origin) {
+		return false
+	}
+	// Any origin can be answered with "*", which caches better, unless
+	// the response depends on the credentials
+	if len(c.policy.Origins) == 1 && c.policy.Origins[0] == "*" && !c.policy.Credentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.policy.Credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
+
+// isPreflight tells whether a request is a browser asking whether it may
+// send the actual request
+func isPreflight(r *http.Request, _ *mux.RouteMatch) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// Middleware lets the pages of the allowed origins read the responses.
+// Preflights are answered by `Preflight`
+func (c *cors) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.enabled() && !isPreflight(r, nil) {
+			w.Header().Add("Vary", "Origin")
+			if c.allowOrigin(w, r) {
+				w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Preflight answers the preflights for the routes of `router`. Preflights
+// for paths or methods the router doesn't serve fail as the actual request
+// would, and the ones the policy refuses get no CORS headers, which tells
+// the browser not to send the request
+func (c *cors) Preflight(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.Header.Get("Access-Control-Request-Method")
+		actual := r.Clone(r.Context())
+		actual.Method = method
+		var match mux.RouteMatch
+		if !router.Match(actual, &match) || match.MatchErr == mux.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if match.MatchErr == mux.ErrMethodMismatch {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		headers := r.Header.Get("Access-Control-Request-Headers")
+		if c.enabled() && c.allowsMethod(method) && c.allowsHeaders(headers) && c.allowOrigin(w, r) {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.policy.Methods, ", "))
+			if headers != "" {
+				// The headers are echoed, since "*" isn't understood by
+				// every browser, and not at all with credentials
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			if c.policy.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.policy.MaxAge))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
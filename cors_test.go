@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withCORS runs a test with a policy, and restores the default one after it
+func withCORS(t *testing.T, policy CORSPolicy) {
+	previous := corsPolicy
+	InitCORS(policy)
+	t.Cleanup(func() { InitCORS(previous) })
+}
+
+func corsRequest(method, target string, header map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, nil)
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestCORSPreflight(t *testing.T) {
+	withCORS(t, CORSPolicy{
+		Origins:     []string{"https://app.example.com"},
+		Methods:     []string{"GET", "POST"},
+		Headers:     []string{"Content-Type", "X-API-Key"},
+		Credentials: true,
+		MaxAge:      300,
+	})
+
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		return corsRequest("OPTIONS", apiV1Prefix+"/albums", map[string]string{
+			"Origin":                         origin,
+			"Access-Control-Request-Method":  method,
+			"Access-Control-Request-Headers": headers,
+		})
+	}
+
+	response := preflight("https://app.example.com", "POST", "content-type, x-api-key")
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", response.Code)
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Methods":     "GET, POST",
+		"Access-Control-Allow-Headers":     "content-type, x-api-key",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "300",
+	}
+	for name, value := range expected {
+		if response.Header().Get(name) != value {
+			t.Errorf("%s should be %q, got %q", name, value, response.Header().Get(name))
+		}
+	}
+
+	// Refused preflights get no CORS headers
+	for _, refused := range [][3]string{
+		{"https://evil.example.com", "GET", ""},
+		{"https://app.example.com", "DELETE", ""},
+		{"https://app.example.com", "GET", "X-Custom"},
+	} {
+		response := preflight(refused[0], refused[1], refused[2])
+		if response.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%v should be refused", refused)
+		}
+	}
+
+	// The routes that don't exist fail as they would without a preflight
+	response = corsRequest("OPTIONS", "/nowhere", map[string]string{
+		"Origin": "https://app.example.com", "Access-Control-Request-Method": "GET",
+	})
+	if response.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing route, got %d", response.Code)
+	}
+	response = preflight("https://app.example.com", "PATCH", "")
+	if response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for a missing method, got %d", response.Code)
+	}
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	withCORS(t, CORSPolicy{Origins: []string{"*"}, Methods: []string{"GET"}})
+
+	response := corsRequest("GET", "/hello", map[string]string{"Origin": "https://app.example.com"})
+	if response.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("any origin should be allowed, got %v", response.Header())
+	}
+	if !strings.Contains(response.Header().Get("Access-Control-Expose-Headers"), "RateLimit-Remaining") {
+		t.Errorf("the rate limit headers should be readable")
+	}
+
+	// Same-origin requests are left alone
+	response = corsRequest("GET", "/hello", nil)
+	if response.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("a request without an origin got CORS headers")
+	}
+}
+
+func TestCORSDisabledByDefault(t *testing.T) {
+	response := corsRequest("GET", "/hello", map[string]string{"Origin": "https://app.example.com"})
+	if response.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("no origin should be allowed by default")
+	}
+}
+
+func TestCORSConfigValidation(t *testing.T) {
+	_, _, err := LoadConfig(testFlagSet(ioutil.Discard), []string{"-cors-origins", "*,app.example.com", "-cors-credentials"}, env(nil))
+	if err == nil {
+		t.Fatal("the configuration should be invalid")
+	}
+	for _, problem := range []string{"cors-credentials", `"app.example.com"`} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("the error should mention %s, got %v", problem, err)
+		}
+	}
+
+	cfg, _, err := LoadConfig(testFlagSet(ioutil.Discard), nil,
+		env(map[string]string{"ALBUMPEDIA_CORS_ORIGINS": "https://app.example.com, http://localhost:3000"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.CORSOrigins) != 2 || cfg.CORSOrigins[1] != "http://localhost:3000" {
+		t.Errorf("unexpected origins %v", cfg.CORSOrigins)
+	}
+}
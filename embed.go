@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// The web interface files, the page templates and the default catalog are
+// built into the binary, so that it runs from any directory. The assets-dir,
+// templates-dir and seed-file settings replace them with files on disk, to
+// work on them without rebuilding
+
+//go:embed assets
+var embeddedAssets embed.FS
+
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
+
+//go:embed albums.json
+var embeddedSeed []byte
+
+// assetTypes are the content types of the web interface files. They don't
+// depend on the MIME types of the machine, unlike the file server's
+var assetTypes = map[string]string{
+	".html":  "text/html; charset=utf-8",
+	".css":   "text/css; charset=utf-8",
+	".js":    "text/javascript; charset=utf-8",
+	".json":  "application/json",
+	".txt":   "text/plain; charset=utf-8",
+	".svg":   "image/svg+xml",
+	".png":   "image/png",
+	".jpg":   "image/jpeg",
+	".ico":   "image/x-icon",
+	".woff2": "font/woff2",
+}
+
+// Embedded files only change with the binary, browsers can keep them for a
+// while and then check their ETag. Files on disk change while working on
+// them, so they are always checked
+const (
+	embeddedCacheControl = "public, max-age=3600"
+	diskCacheControl     = "no-cache"
+)
+
+// subFS returns the directory `dir` of an embedded file system. The
+// directories are embedded, so this can't fail
+func subFS(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// templatesFS returns the page templates of `dir`, or the embedded ones
+// if `dir` is empty
+func templatesFS(dir string) fs.FS {
+	if dir == "" {
+		return subFS(embeddedTemplates, "templates")
+	}
+	return os.DirFS(dir)
+}
+
+// readSeed reads the albums the catalog is seeded from: the ones of `file`,
+// or the embedded ones if `file` is empty
+func readSeed(file string) ([]byte, error) {
+	if file == "" {
+		return embeddedSeed, nil
+	}
+	return os.ReadFile(file)
+}
+
+var (
+	assetETagsOnce sync.Once
+	assetETags     map[string]string
+)
+
+// embeddedETags returns the ETags of the embedded assets by path, made from
+// their content when first needed
+func embeddedETags() map[string]string {
+	assetETagsOnce.Do(func() {
+		assetETags = map[string]string{}
+		assets := subFS(embeddedAssets, "assets")
+		fs.WalkDir(assets, ".", func(name string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			data, err := fs.ReadFile(assets, name)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			assetETags[name] = `"` + hex.EncodeToString(sum[:8]) + `"`
+			return nil
+		})
+	})
+	return assetETags
+}
+
+// assetsHandler serves the web interface files of `dir`, or the embedded
+// ones if `dir` is empty, under "/assets/"
+func assetsHandler(dir string) http.Handler {
+	var files http.Handler
+	var etags map[string]string
+	cacheControl := diskCacheControl
+	if dir == "" {
+		files = http.FileServer(http.FS(subFS(embeddedAssets, "assets")))
+		etags = embeddedETags()
+		cacheControl = embeddedCacheControl
+	} else {
+		files = http.FileServer(http.Dir(dir))
+	}
+
+	// The prefix is stripped, so that "/assets/index.html" is "index.html"
+	// in the directory
+	return http.StripPrefix("/assets/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if name == "" || strings.HasSuffix(name, "/") {
+			name += "index.html"
+		}
+		if contentType, ok := assetTypes[path.Ext(name)]; ok {
+			w.Header().Set("Content-Type", contentType)
+		}
+		// The file server answers conditional requests with the ETag
+		if etag, ok := etags[name]; ok {
+			w.Header().Set("ETag", etag)
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		files.ServeHTTP(w, r)
+	}))
+}
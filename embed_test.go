@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getAsset(target string, header map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", target, nil)
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestEmbeddedAssets(t *testing.T) {
+	response := getAsset("/assets/catalog.js", nil)
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "text/javascript; charset=utf-8" {
+		t.Fatalf("expected the script, got %d %s", response.Code, response.Header().Get("Content-Type"))
+	}
+	etag := response.Header().Get("ETag")
+	if etag == "" || response.Header().Get("Cache-Control") != embeddedCacheControl {
+		t.Errorf("embedded files should be cached, got %v", response.Header())
+	}
+
+	// A browser that has the file gets a 304 without the file
+	response = getAsset("/assets/catalog.js", map[string]string{"If-None-Match": etag})
+	if response.Code != http.StatusNotModified || response.Body.Len() != 0 {
+		t.Errorf("expected 304, got %d with %d bytes", response.Code, response.Body.Len())
+	}
+
+	if response := getAsset("/assets/missing.css", nil); response.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", response.Code)
+	}
+}
+
+func TestAssetsFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "catalog.css"), []byte("body { color: red; }"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	previous := assetsDir
+	InitAssets(dir)
+	defer InitAssets(previous)
+
+	response := getAsset("/assets/catalog.css", nil)
+	if !strings.Contains(response.Body.String(), "color: red") || response.Header().Get("Cache-Control") != diskCacheControl {
+		t.Errorf("the file on disk should be served without caching, got %v: %s", response.Header(), response.Body)
+	}
+}
+
+func TestEmbeddedTemplatesAndSeed(t *testing.T) {
+	parsed, err := parsePages("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"albums", "album", "album-edit", "album-delete", "not-found"} {
+		if parsed[name] == nil {
+			t.Errorf("the %s page is not embedded", name)
+		}
+	}
+
+	database := filepath.Join(t.TempDir(), "catalog.db")
+	cli(t, database, "migrate")
+	if code, stdout, stderr := cli(t, database, "seed"); code != 0 || !strings.Contains(stdout, "seeded 29 albums from the embedded catalog") {
+		t.Errorf("the embedded catalog should be seeded, got %d: %s%s", code, stdout, stderr)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The broker remembers this many events, so that clients that lost their
+	// connection can catch up on what they missed
+	eventHistorySize = 256
+	// A subscriber that falls this many events behind is disconnected. It
+	// reconnects with `Last-Event-ID` and catches up from the history
+	subscriberBuffer = 32
+	// Proxies close connections that stay silent for too long, so the stream
+	// sends a comment at this interval
+	eventHeartbeat = 15 * time.Second
+)
+
+// The types of events sent when the catalog changes
+const (
+	eventAlbumCreated = "album.created"
+	eventAlbumUpdated = "album.updated"
+	eventAlbumDeleted = "album.deleted"
+)
+
+// An AlbumEvent tells that an album changed. IDs increase by one with every
+// event, and start over when the server restarts. The stream tells them apart
+// with the epoch of the broker, see `eventID`
+type AlbumEvent struct {
+	ID    uint64    `json:"id"`
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	Album *Album    `json:"album"`
+}
+
+// The eventBroker hands every published event to all current subscribers,
+// and keeps the most recent ones in a ring buffer
+type eventBroker struct {
+	// epoch is different every time the server starts
+	epoch       string
+	mu          sync.Mutex
+	lastID      uint64
+	history     []AlbumEvent
+	subscribers map[chan AlbumEvent]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		subscribers: map[chan AlbumEvent]struct{}{},
+	}
+}
+
+// eventID is the ID of an event in the stream: its sequence number, prefixed
+// by the epoch of the broker, such as "lx3k9q2a1b-42"
+func (b *eventBroker) eventID(id uint64) string {
+	return b.epoch + "-" + strconv.FormatUint(id, 10)
+}
+
+// parseEventID reads an ID sent back by a client. It returns false with the
+// IDs of an earlier run, whose sequence numbers have nothing to do with the
+// current ones, and with the plain numbers older builds sent
+func (b *eventBroker) parseEventID(id string) (uint64, bool, error) {
+	epoch, seq, found := strings.Cut(id, "-")
+	if !found {
+		seq = epoch
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return n, found && epoch == b.epoch, nil
+}
+
+// albumEvents is the broker every mutation of the catalog publishes to
+var albumEvents = newEventBroker()
+
+// Publish sends an event to every subscriber. It never blocks: subscribers
+// that can't keep up are dropped
+func (b *eventBroker) Publish(eventType string, album *Album) AlbumEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	// The album is copied, so that later changes made by the caller don't
+	// leak into the history
+	copied := *album
+	event := AlbumEvent{ID: b.lastID, Type: eventType, Time: time.Now().UTC(), Album: &copied}
+
+	b.history = append(b.history, event)
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history)-eventHistorySize:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return event
+}
+
+// LastID is the ID of the latest event, or 0 if there was none yet
+func (b *eventBroker) LastID() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastID
+}
+
+// Subscribe registers a new subscriber. It returns the events published
+// after `lastID` that are still in the history, and whether the history
+// still had all of them. The channel is closed when the subscriber is
+// dropped or cancelled, and `cancel` must always be called
+func (b *eventBroker) Subscribe(lastID uint64) ([]AlbumEvent, bool, <-chan AlbumEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	complete := true
+	missed := []AlbumEvent{}
+	if lastID > b.lastID {
+		// The ID comes from before a restart, we can't know what was missed
+		complete = false
+	} else if lastID < b.lastID {
+		oldest := b.lastID - uint64(len(b.history)) + 1
+		complete = lastID+1 >= oldest
+		for _, event := range b.history {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	ch := make(chan AlbumEvent, subscriberBuffer)
+	b.subscribers[ch] = struct{}{}
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return missed, complete, ch, cancel
+}
+
+// albumEventsHandler streams album events as Server-Sent Events. Browsers
+// reconnect on their own and send the ID of the last event they got in the
+// `Last-Event-ID` header, so they only get the events they missed
+func albumEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeServerError(w, r, fmt.Errorf("streaming is not supported by %T", w))
+		return
+	}
+
+	// `lastEventId` in the query string is for clients that can't set headers
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	var since uint64
+	resume, current := lastID != "", true
+	if resume {
+		var err error
+		if since, current, err = albumEvents.parseEventID(lastID); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Last-Event-ID must be the ID of an event.")
+			return
+		}
+	}
+
+	missed, complete, events, cancel := albumEvents.Subscribe(since)
+	defer cancel()
+	if !current {
+		// The events the client saw are gone with the run that sent them
+		missed, complete = nil, false
+	}
+
+	// The stream lasts longer than the write timeout of the server, so the
+	// deadline is pushed forward before every write. A client that stops
+	// reading still gets disconnected
+	controller := http.NewResponseController(w)
+	extendDeadline := func() {
+		controller.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+
+	extendDeadline()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Tells nginx not to buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if resume && !complete {
+		// Some events are lost, the client has to reload the whole list
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	if resume {
+		for _, event := range missed {
+			writeEvent(w, r, event)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// We were too slow and got dropped. Closing the stream
+				// makes the client reconnect and catch up
+				return
+			}
+			extendDeadline()
+			writeEvent(w, r, event)
+			flusher.Flush()
+		case <-heartbeat.C:
+			extendDeadline()
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			// The server waits for every request before stopping. Clients
+			// reconnect to another instance and catch up from there, or
+			// from the history if it's this one again
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, r *http.Request, event AlbumEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		loggerFrom(r.Context()).Error("encoding an event failed", "event_id", event.ID, "error", err)
+		return
+	}
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", albumEvents.eventID(event.ID), event.Type, data)
+}
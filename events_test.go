@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBrokerResume(t *testing.T) {
+	b := newEventBroker()
+	for i := 0; i < 3; i++ {
+		b.Publish(eventAlbumCreated, &Album{Title: "Halo"})
+	}
+
+	// A client that saw the first event gets the two others
+	missed, complete, _, cancel := b.Subscribe(1)
+	cancel()
+	if !complete || len(missed) != 2 || missed[0].ID != 2 || missed[1].ID != 3 {
+		t.Errorf("expected events 2 and 3, got %v (complete: %v)", missed, complete)
+	}
+
+	// An ID from before a restart can't be resumed
+	_, complete, _, cancel = b.Subscribe(42)
+	cancel()
+	if complete {
+		t.Errorf("an unknown event ID should not be resumable")
+	}
+
+	// Events that fell out of the history can't be resumed either
+	for i := 0; i < eventHistorySize; i++ {
+		b.Publish(eventAlbumCreated, &Album{Title: "Halo"})
+	}
+	missed, complete, _, cancel = b.Subscribe(1)
+	cancel()
+	if complete || len(missed) != eventHistorySize {
+		t.Errorf("expected an incomplete history of %d events, got %d (complete: %v)", eventHistorySize, len(missed), complete)
+	}
+}
+
+func TestEventIDsOfEarlierRuns(t *testing.T) {
+	b, earlier := newEventBroker(), newEventBroker()
+	earlier.epoch = "earlier"
+
+	if id, current, err := b.parseEventID(b.eventID(7)); err != nil || !current || id != 7 {
+		t.Errorf("expected event 7 of the current run, got %d (current: %v, %v)", id, current, err)
+	}
+	for _, id := range []string{earlier.eventID(7), "7"} {
+		if _, current, err := b.parseEventID(id); err != nil || current {
+			t.Errorf("%s: expected an ID of an earlier run, got current: %v (%v)", id, current, err)
+		}
+	}
+	if _, _, err := b.parseEventID("earlier-seven"); err == nil {
+		t.Errorf("expected an invalid ID to be refused")
+	}
+}
+
+func TestEventBrokerDropsSlowSubscribers(t *testing.T) {
+	b := newEventBroker()
+	_, _, events, cancel := b.Subscribe(0)
+	defer cancel()
+
+	// Nobody reads the channel, so it fills up and the subscriber is dropped
+	for i := 0; i < subscriberBuffer+1; i++ {
+		b.Publish(eventAlbumCreated, &Album{Title: "Halo"})
+	}
+	received := 0
+	for range events {
+		received++
+	}
+	if received != subscriberBuffer {
+		t.Errorf("expected %d buffered events before the channel closed, got %d", subscriberBuffer, received)
+	}
+}
+
+func TestAlbumEventsHandler(t *testing.T) {
+	r := newRouter()
+	mockServer := httptest.NewServer(r)
+	defer mockServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Resume from the current event, so only the new album is streamed
+	last := albumEvents.Publish(eventAlbumCreated, &Album{Title: "Before"})
+	req, err := http.NewRequestWithContext(ctx, "GET", mockServer.URL+"/api/v1/albums/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", albumEvents.eventID(last.ID-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Wrong content type, expected text/event-stream, got %s", contentType)
+	}
+
+	// The handler subscribed before answering, so this event is streamed too
+	album := &Album{Title: "Renaissance", Artist: "Beyonce"}
+	if err := createAlbum(context.Background(), album); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read events until we get the one for our album
+	scanner := bufio.NewScanner(resp.Body)
+	sawLast := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "id: "+albumEvents.eventID(last.ID) {
+			sawLast = true
+		}
+		if strings.HasPrefix(line, "data: ") && strings.Contains(line, `"title":"Renaissance"`) {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !sawLast {
+		t.Errorf("the event %d published before connecting should have been resumed", last.ID)
+	}
+
+	// A client coming back from an earlier run can't resume, even if the
+	// sequence number of its last event exists in this one
+	req, err = http.NewRequestWithContext(ctx, "GET", mockServer.URL+"/api/v1/albums/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "earlier-1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	scanner = bufio.NewScanner(resp.Body)
+	for scanner.Scan() && scanner.Text() != "" {
+	}
+	if scanner.Scan(); scanner.Text() != "event: reset" {
+		t.Errorf("expected a reset after the retry delay, got %q", scanner.Text())
+	}
+	if scanner.Scan(); scanner.Text() != "data: {}" {
+		t.Errorf("expected the reset to be the only thing replayed, got %q", scanner.Text())
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// flashCookie carries a message from a form submission to the page the
+// browser is redirected to, so that reloading that page doesn't submit
+// the form again
+const flashCookie = "flash"
+
+// Browsers refuse cookies larger than 4kB, the submitted values are dropped
+// to fit
+const maxFlashSize = 3 << 10
+
+// A flash is shown once, on the next page the visitor sees
+type flash struct {
+	// Kind is "success" or "error"
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// Album and Errors are the values of an invalid form and what is wrong
+	// with them, by field, so that the form can be shown again as it was
+	Album  *Album            `json:"album,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+func setFlash(w http.ResponseWriter, f flash) {
+	value, err := json.Marshal(f)
+	if err == nil && base64.RawURLEncoding.EncodedLen(len(value)) > maxFlashSize {
+		f.Album = nil
+		value, err = json.Marshal(f)
+	}
+	if err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(value),
+		Path:     "/",
+		MaxAge:   60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// takeFlash returns the flash set by the previous response, if any, and
+// removes it. A malformed cookie is dropped as if there was none
+func takeFlash(w http.ResponseWriter, r *http.Request) *flash {
+	cookie, err := r.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{Name: flashCookie, Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+
+	value, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	f := &flash{}
+	if err := json.Unmarshal(value, f); err != nil || f.Message == "" {
+		return nil
+	}
+	return f
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+const (
+	// Queries nesting deeper than this are refused before they are run.
+	// Introspection fields are not counted, so tools can still load the schema
+	maxQueryDepth = 8
+	// The complexity of a query estimates how many fields it resolves, with
+	// the fields under a list counted once per element
+	maxQueryComplexity = 2000
+	// Lists are paged, and a page holds at most `maxPageSize` albums
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// The GraphQL schema is built once, when the package is initialized. All
+// resolvers go through the `store`, so the schema works with any `Store`
+var graphQLSchema = mustBuildGraphQLSchema()
+
+// A graphQLError is an error returned by a resolver, with a machine readable
+// code in its extensions
+type graphQLError struct {
+	message    string
+	extensions map[string]interface{}
+}
+
+func (e graphQLError) Error() string                      { return e.message }
+func (e graphQLError) Extensions() map[string]interface{} { return e.extensions }
+
+// internalError logs an error of the store with the logger of the request,
+// and hides it from the client, like `writeServerError` does
+func internalError(ctx context.Context, err error) error {
+	loggerFrom(ctx).Error("graphql resolver failed", "error", err)
+	return graphQLError{message: "internal error", extensions: map[string]interface{}{"code": "INTERNAL_ERROR"}}
+}
+
+func mustBuildGraphQLSchema() graphql.Schema {
+	pageArgs := graphql.FieldConfigArgument{
+		"first":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultPageSize},
+		"offset": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+	}
+
+	albumType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Album",
+		Fields: graphql.Fields{
+			"id":     &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"title":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"artist": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"price":  &graphql.Field{Type: graphql.String},
+			"year":   &graphql.Field{Type: graphql.String},
+			"genre":  &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	albumPageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "AlbumPage",
+		Fields: graphql.Fields{
+			"totalCount": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"nodes":      &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(albumType)))},
+		},
+	})
+
+	// Artists and genres have the same shape: a name, the number of albums,
+	// and a page of these albums
+	namedCountType := func(name, filter string) *graphql.Object {
+		return graphql.NewObject(graphql.ObjectConfig{
+			Name: name,
+			Fields: graphql.Fields{
+				"name": &graphql.Field{
+					Type:    graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(NamedCount).Name, nil },
+				},
+				"albumCount": &graphql.Field{
+					Type:    graphql.NewNonNull(graphql.Int),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(NamedCount).Albums, nil },
+				},
+				"albums": &graphql.Field{
+					Type: graphql.NewNonNull(albumPageType),
+					Args: pageArgs,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						p.Args[filter] = p.Source.(NamedCount).Name
+						return resolveAlbumPage(p)
+					},
+				},
+			},
+		})
+	}
+	artistType := namedCountType("Artist", "artist")
+	genreType := namedCountType("Genre", "genre")
+
+	// Albums link back to their artist and genre, which is what makes it
+	// possible to nest queries, and why their depth has to be limited
+	albumType.AddFieldConfig("byArtist", &graphql.Field{
+		Type: graphql.NewNonNull(artistType),
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return namedCountOf(p.Context, AlbumQuery{Artist: p.Source.(*Album).Artist})
+		},
+	})
+	albumType.AddFieldConfig("inGenre", &graphql.Field{
+		Type: genreType,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			genre := p.Source.(*Album).Genre
+			if genre == "" {
+				return nil, nil
+			}
+			return namedCountOf(p.Context, AlbumQuery{Genre: genre})
+		},
+	})
+
+	albumFilterArgs := graphql.FieldConfigArgument{
+		"title":  &graphql.ArgumentConfig{Type: graphql.String, Description: "Only albums whose title contains this text"},
+		"artist": &graphql.ArgumentConfig{Type: graphql.String},
+		"genre":  &graphql.ArgumentConfig{Type: graphql.String},
+		"year":   &graphql.ArgumentConfig{Type: graphql.String},
+	}
+	for name, arg := range pageArgs {
+		albumFilterArgs[name] = arg
+	}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"albums": &graphql.Field{
+				Type:    graphql.NewNonNull(albumPageType),
+				Args:    albumFilterArgs,
+				Resolve: resolveAlbumPage,
+			},
+			"album": &graphql.Field{
+				Type: albumType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: resolveAlbum,
+			},
+			"artists": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(artistType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					artists, err := storeFor(p.Context).ListArtists()
+					if err != nil {
+						return nil, internalError(p.Context, err)
+					}
+					return artists, nil
+				},
+			},
+			"genres": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(genreType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					genres, err := storeFor(p.Context).ListGenres()
+					if err != nil {
+						return nil, internalError(p.Context, err)
+					}
+					return genres, nil
+				},
+			},
+		},
+	})
+
+	albumInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "AlbumInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"artist": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"price":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"year":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"genre":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createAlbum": &graphql.Field{
+				Type: graphql.NewNonNull(albumType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(albumInput)},
+				},
+				Resolve: resolveCreateAlbum,
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// namedCountOf counts the albums of a single artist or genre
+func namedCountOf(ctx context.Context, query AlbumQuery) (interface{}, error) {
+	query.Limit = 1
+	_, total, err := storeFor(ctx).ListAlbums(query)
+	if err != nil {
+		return nil, internalError(ctx, err)
+	}
+	return NamedCount{Name: query.Artist + query.Genre, Albums: total}, nil
+}
+
+func resolveAlbumPage(p graphql.ResolveParams) (interface{}, error) {
+	query := AlbumQuery{Limit: defaultPageSize}
+	query.Title, _ = p.Args["title"].(string)
+	query.Artist, _ = p.Args["artist"].(string)
+	query.Genre, _ = p.Args["genre"].(string)
+	query.Year, _ = p.Args["year"].(string)
+	if first, ok := p.Args["first"].(int); ok {
+		query.Limit = first
+	}
+	if offset, ok := p.Args["offset"].(int); ok {
+		query.Offset = offset
+	}
+	if query.Limit < 1 || query.Limit > maxPageSize || query.Offset < 0 {
+		return nil, graphQLError{
+			message:    fmt.Sprintf("first must be between 1 and %d, and offset can't be negative", maxPageSize),
+			extensions: map[string]interface{}{"code": "BAD_PAGE"},
+		}
+	}
+
+	albums, total, err := storeFor(p.Context).ListAlbums(query)
+	if err != nil {
+		return nil, internalError(p.Context, err)
+	}
+	return map[string]interface{}{"totalCount": total, "nodes": albums}, nil
+}
+
+func resolveAlbum(p graphql.ResolveParams) (interface{}, error) {
+	id, err := strconv.ParseInt(p.Args["id"].(string), 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	album, err := storeFor(p.Context).GetAlbum(id)
+	// A missing album is not an error, the field is simply null
+	if err == ErrAlbumNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, internalError(p.Context, err)
+	}
+	return album, nil
+}
+
+func resolveCreateAlbum(p graphql.ResolveParams) (interface{}, error) {
+	input := p.Args["input"].(map[string]interface{})
+	album := &Album{}
+	album.Title, _ = input["title"].(string)
+	album.Artist, _ = input["artist"].(string)
+	album.Price, _ = input["price"].(string)
+	album.Year, _ = input["year"].(string)
+	album.Genre, _ = input["genre"].(string)
+
+	if errs := album.Validate(); errs != nil {
+		return nil, graphQLError{
+			message:    "The album has invalid fields.",
+			extensions: map[string]interface{}{"code": "INVALID_ALBUM", "errors": errs},
+		}
+	}
+	if err := createAlbum(p.Context, album); err != nil {
+		return nil, internalError(p.Context, err)
+	}
+	return album, nil
+}
+
+// A graphQLRequest is the body of a GraphQL request, as sent by every
+// GraphQL client
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// graphQLHandler serves queries over `GET` and `POST`, and mutations over
+// `POST` only, so that a link or an image tag can never change the catalog
+func graphQLHandler(w http.ResponseWriter, r *http.Request) {
+	req := graphQLRequest{}
+	if r.Method == http.MethodGet {
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if variables := r.URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				writeGraphQLErrors(w, http.StatusBadRequest, "variables must be a JSON object")
+				return
+			}
+		}
+	} else {
+		body := http.MaxBytesReader(w, r.Body, maxAlbumBodySize)
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			writeGraphQLErrors(w, http.StatusBadRequest, "The request body could not be parsed: "+err.Error())
+			return
+		}
+	}
+	if req.Query == "" {
+		writeGraphQLErrors(w, http.StatusBadRequest, "The request has no query")
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(req.Query), Name: "GraphQL request"}),
+	})
+	if err != nil {
+		writeGraphQLErrors(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	validation := graphql.ValidateDocument(&graphQLSchema, doc, nil)
+	if !validation.IsValid {
+		writeJSON(w, r, http.StatusBadRequest, &graphql.Result{Errors: validation.Errors})
+		return
+	}
+
+	operation := findOperation(doc, req.OperationName)
+	if operation == nil {
+		writeGraphQLErrors(w, http.StatusBadRequest, "Unknown operation "+strconv.Quote(req.OperationName))
+		return
+	}
+	if operation.Operation == ast.OperationTypeMutation && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeGraphQLErrors(w, http.StatusMethodNotAllowed, "Mutations must be sent with POST")
+		return
+	}
+
+	// The limits are checked before anything is resolved, so an expensive
+	// query costs us nothing more than parsing it
+	cost := queryCost{fragments: fragmentsOf(doc), variables: req.Variables}
+	depth, complexity := cost.measure(operation.SelectionSet, 1)
+	if depth > maxQueryDepth {
+		writeGraphQLErrors(w, http.StatusBadRequest, fmt.Sprintf("The query is %d levels deep, the limit is %d", depth, maxQueryDepth))
+		return
+	}
+	if complexity > maxQueryComplexity {
+		writeGraphQLErrors(w, http.StatusBadRequest, fmt.Sprintf("The query has a complexity of %d, the limit is %d", complexity, maxQueryComplexity))
+		return
+	}
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        graphQLSchema,
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       r.Context(),
+	})
+	writeJSON(w, r, http.StatusOK, result)
+}
+
+// writeGraphQLErrors answers with a GraphQL response that only has an error.
+// GraphQL clients expect this shape rather than a problem, even for requests
+// that could not be run at all
+func writeGraphQLErrors(w http.ResponseWriter, status int, message string) {
+	body, _ := json.Marshal(&graphql.Result{Errors: []gqlerrors.FormattedError{{Message: message}}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// findOperation returns the operation of the document that will be run
+func findOperation(doc *ast.Document, name string) *ast.OperationDefinition {
+	for _, def := range doc.Definitions {
+		operation, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if name == "" || (operation.Name != nil && operation.Name.Value == name) {
+			return operation
+		}
+	}
+	return nil
+}
+
+func fragmentsOf(doc *ast.Document) map[string]*ast.FragmentDefinition {
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, def := range doc.Definitions {
+		if fragment, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[fragment.Name.Value] = fragment
+		}
+	}
+	return fragments
+}
+
+// queryCost measures the depth and complexity of a query. The document has
+// already been validated, so fragments exist and do not form cycles
+type queryCost struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+}
+
+// measure returns the depth and the complexity of a selection set found at
+// the given depth
+func (c queryCost) measure(set *ast.SelectionSet, depth int) (int, int) {
+	if set == nil {
+		return depth - 1, 0
+	}
+
+	maxDepth, complexity := depth, 0
+	for _, selection := range set.Selections {
+		var d, n int
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(selection.Name.Value, "__") {
+				continue
+			}
+			d, n = c.measure(selection.SelectionSet, depth+1)
+			n = 1 + c.listSize(selection)*n
+		case *ast.FragmentSpread:
+			d, n = c.measure(c.fragments[selection.Name.Value].SelectionSet, depth)
+		case *ast.InlineFragment:
+			d, n = c.measure(selection.SelectionSet, depth)
+		}
+		if d > maxDepth {
+			maxDepth = d
+		}
+		complexity += n
+	}
+	return maxDepth, complexity
+}
+
+// listSize estimates how many elements a field resolves to. Paged fields
+// return at most `first` elements, and the artists and genres are assumed to
+// be as many as a default page
+func (c queryCost) listSize(field *ast.Field) int {
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "first" {
+			continue
+		}
+		n := maxPageSize
+		switch value := arg.Value.(type) {
+		case *ast.IntValue:
+			n, _ = strconv.Atoi(value.Value)
+		case *ast.Variable:
+			if f, ok := c.variables[value.Name.Value].(float64); ok {
+				n = int(f)
+			}
+		}
+		// Invalid sizes are refused by the resolver, they only need to
+		// not make the complexity negative
+		if n < 1 {
+			n = 1
+		}
+		return n
+	}
+
+	switch field.Name.Value {
+	case "albums", "artists", "genres":
+		return defaultPageSize
+	}
+	return 1
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// graphQLResponse is what our tests decode GraphQL answers into
+type graphQLResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func postGraphQL(t *testing.T, query string, variables map[string]interface{}) (int, graphQLResponse) {
+	body, err := json.Marshal(graphQLRequest{Query: query, Variables: variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/graphql", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(graphQLHandler).ServeHTTP(recorder, req)
+
+	resp := graphQLResponse{}
+	if err := json.NewDecoder(recorder.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return recorder.Code, resp
+}
+
+func TestGraphQLCreateAndQueryAlbums(t *testing.T) {
+	// The artist is unique, so that only our album matches the filter
+	artist := "John Coltrane " + strconv.FormatInt(time.Now().UnixNano(), 36)
+	status, resp := postGraphQL(t, `mutation ($input: AlbumInput!) {
+		createAlbum(input: $input) { id title }
+	}`, map[string]interface{}{
+		"input": map[string]interface{}{"title": "Blue Train", "artist": artist, "genre": "Jazz", "year": "1957"},
+	})
+	if status != http.StatusOK || len(resp.Errors) != 0 {
+		t.Fatalf("createAlbum failed with status %d: %v", status, resp.Errors)
+	}
+	created := resp.Data["createAlbum"].(map[string]interface{})
+	if created["title"] != "Blue Train" || created["id"] == "" {
+		t.Errorf("unexpected album %v", created)
+	}
+
+	// Only the requested fields come back, for the albums matching the filter
+	status, resp = postGraphQL(t, `query ($artist: String) {
+		albums(artist: $artist, first: 5) { totalCount nodes { title year } }
+	}`, map[string]interface{}{"artist": artist})
+	if status != http.StatusOK || len(resp.Errors) != 0 {
+		t.Fatalf("albums query failed with status %d: %v", status, resp.Errors)
+	}
+	page := resp.Data["albums"].(map[string]interface{})
+	nodes := page["nodes"].([]interface{})
+	if page["totalCount"] != float64(1) || len(nodes) != 1 {
+		t.Fatalf("expected one album, got %v", page)
+	}
+	expected := map[string]interface{}{"title": "Blue Train", "year": "1957"}
+	if node := nodes[0].(map[string]interface{}); len(node) != 2 || node["title"] != expected["title"] || node["year"] != expected["year"] {
+		t.Errorf("expected %v, got %v", expected, node)
+	}
+
+	// Albums can also be reached through their genre
+	status, resp = postGraphQL(t, `{ genres { name albumCount albums(first: 1) { nodes { artist } } } }`, nil)
+	if status != http.StatusOK || len(resp.Errors) != 0 {
+		t.Fatalf("genres query failed with status %d: %v", status, resp.Errors)
+	}
+	found := false
+	for _, genre := range resp.Data["genres"].([]interface{}) {
+		if genre.(map[string]interface{})["name"] == "Jazz" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("the Jazz genre is missing from %v", resp.Data["genres"])
+	}
+}
+
+func TestGraphQLCreateAlbumValidation(t *testing.T) {
+	status, resp := postGraphQL(t, `mutation { createAlbum(input: {title: " ", artist: "Nobody"}) { id } }`, nil)
+	if status != http.StatusOK {
+		t.Errorf("Status should be ok, got %d", status)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != "INVALID_ALBUM" {
+		t.Errorf("expected an INVALID_ALBUM error, got %v", resp.Errors)
+	}
+}
+
+func TestGraphQLRefusesMutationsOverGET(t *testing.T) {
+	query := url.Values{}
+	query.Set("query", `mutation { createAlbum(input: {title: "Halo", artist: "Beyonce"}) { id } }`)
+	req, err := http.NewRequest("GET", "/graphql?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(graphQLHandler).ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Status should be 405, got %d", recorder.Code)
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	tests := []struct {
+		query   string
+		message string
+	}{
+		{`{ albums(first: 10) { nodes { title byArtist { name albums(first: 5) { nodes { title } } } } } }`, ""},
+		{`{ album(id: 1) { byArtist { albums { nodes { byArtist { albums { nodes { byArtist { name } } } } } } } } }`, "levels deep"},
+		// Fragments count towards the depth of the fields they are spread into
+		{`fragment deep on Album { byArtist { albums { nodes { byArtist { albums { nodes { byArtist { name } } } } } } } }
+		  { album(id: 1) { ...deep } }`, "levels deep"},
+		{`{ albums(first: 100) { nodes { byArtist { albums(first: 100) { nodes { title } } } } } }`, "complexity"},
+		{`query ($n: Int) { artists { albums(first: $n) { nodes { id title artist price year genre } } } }`, "complexity"},
+	}
+	for _, test := range tests {
+		status, resp := postGraphQL(t, test.query, map[string]interface{}{"n": 100})
+		if test.message == "" {
+			if status != http.StatusOK || len(resp.Errors) != 0 {
+				t.Errorf("%s: expected the query to be accepted, got %d %v", test.query, status, resp.Errors)
+			}
+			continue
+		}
+		if status != http.StatusBadRequest || len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, test.message) {
+			t.Errorf("%s: expected a %q error, got %d %v", test.query, test.message, status, resp.Errors)
+		}
+	}
+}
+
+func TestGraphQLRoute(t *testing.T) {
+	r := newRouter()
+	mockServer := httptest.NewServer(r)
+
+	// Introspection is not counted in the depth, so tools can load the schema
+	query := url.Values{}
+	query.Set("query", `{ __schema { types { name fields { name type { name ofType { name ofType { name ofType { name } } } } } } } }`)
+	resp, err := http.Get(mockServer.URL + "/graphql?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Status should be ok, got %d", resp.StatusCode)
+	}
+}
+
+func TestGraphQLHidesStoreErrors(t *testing.T) {
+	previous := store
+	InitStore(failingStore{})
+	defer InitStore(previous)
+
+	status, resp := postGraphQL(t, `{ album(id: "1") { title } }`, nil)
+	if status != http.StatusOK || len(resp.Errors) != 1 || resp.Errors[0].Message != "internal error" ||
+		resp.Errors[0].Extensions["code"] != "INTERNAL_ERROR" {
+		t.Errorf("expected a generic internal error, got %d %v", status, resp.Errors)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Every readiness check has to answer within this time, so that a stuck
+// database makes the probe fail instead of hanging
+const readinessTimeout = 2 * time.Second
+
+// A healthCheck is one thing that must work for the server to be ready
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// checkResult is the outcome of a check, as reported by `/readyz`
+type checkResult struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	DurationMS float64 `json:"durationMs"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+// readinessChecks are run by every readiness probe. There are none until
+// the database is known
+var readinessChecks []healthCheck
+
+// InitReadiness checks that the database answers, that its tables are the
+// ones this build expects, and that the catalog was seeded
+func InitReadiness(db *sql.DB) {
+	readinessChecks = []healthCheck{
+		{"database", db.PingContext},
+		{"schema", func(ctx context.Context) error {
+			version, err := readSchemaVersion(ctx, db)
+			if err != nil {
+				return err
+			}
+			if version != schemaVersion {
+				return fmt.Errorf("schema version is %d, expected %d", version, schemaVersion)
+			}
+			return nil
+		}},
+		{"seed", func(ctx context.Context) error {
+			var albums int
+			if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM albums").Scan(&albums); err != nil {
+				return err
+			}
+			if albums == 0 {
+				return errors.New("the catalog has no albums")
+			}
+			return nil
+		}},
+	}
+}
+
+// notShuttingDown fails while the server drains: it still answers, but wants
+// no new clients
+func notShuttingDown(ctx context.Context) error {
+	if isShuttingDown() {
+		return errors.New("the server is shutting down")
+	}
+	return nil
+}
+
+// healthzHandler tells whether the process is alive. It checks nothing else,
+// so that a database outage doesn't get the process restarted for nothing
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, healthReport{Status: "ok", Checks: []checkResult{}})
+}
+
+// readyzHandler tells whether the server can serve requests. It answers with
+// a 503 when any check fails, with the outcome of every check
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{Status: "ok", Checks: []checkResult{}}
+	checks := append([]healthCheck{{"shutdown", notShuttingDown}}, readinessChecks...)
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		start := time.Now()
+		err := c.check(ctx)
+		cancel()
+
+		result := checkResult{Name: c.name, Status: "ok", DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			result.Status = "failing"
+			result.Error = err.Error()
+			report.Status = "unavailable"
+			loggerFrom(r.Context()).Warn("readiness check failed", "check", c.name, "error", err)
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	// Probes must see the current state, never a cached one
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, r, status, report)
+}
+
+// The version and the commit are set when building a release:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD)"
+//
+// Without them, the commit recorded by the Go toolchain is used
+var (
+	version = "dev"
+	commit  = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Modified  bool   `json:"modified"`
+	BuildTime string `json:"buildTime,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+func currentBuildInfo() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, GoVersion: runtime.Version()}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				info.BuildTime = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, currentBuildInfo())
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	r := newRouter()
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Status should be 200, got %d", recorder.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	// The test database starts empty, the seed check needs an album
+	if err := createAlbum(context.Background(), &Album{Title: "Blue", Artist: "Joni Mitchell"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newRouter()
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Status should be 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+
+	report := healthReport{}
+	if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, check := range report.Checks {
+		names = append(names, check.Name)
+		if check.Status != "ok" {
+			t.Errorf("check %s should pass, got %+v", check.Name, check)
+		}
+	}
+	if len(report.Checks) != 4 {
+		t.Errorf("expected the shutdown, database, schema and seed checks, got %v", names)
+	}
+}
+
+func TestReadyzReportsFailingChecks(t *testing.T) {
+	previous := readinessChecks
+	defer func() { readinessChecks = previous }()
+	readinessChecks = append(append([]healthCheck{}, previous...), healthCheck{"broken", func(ctx context.Context) error {
+		return errors.New("out of order")
+	}})
+
+	r := newRouter()
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Status should be 503, got %d", recorder.Code)
+	}
+
+	report := healthReport{}
+	if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	last := report.Checks[len(report.Checks)-1]
+	if report.Status != "unavailable" || last.Name != "broken" || last.Status != "failing" || last.Error != "out of order" {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	r := newRouter()
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/version", nil))
+
+	info := buildInfo{}
+	if err := json.NewDecoder(recorder.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != version || info.GoVersion == "" {
+		t.Errorf("unexpected build info %+v", info)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The translations of the web interface, one catalog per language, named
+// after its language tag. English is complete, the other catalogs fall
+// back to it for the messages they miss
+//
+//go:embed locales/*.json
+var embeddedLocales embed.FS
+
+const defaultLocale = "en"
+
+// localeCookie remembers the language the visitor picked, which wins over
+// the languages of their browser
+const localeCookie = "lang"
+
+// A locale translates the messages of the web interface, and formats
+// numbers the way its language does
+type locale struct {
+	Tag  string
+	Name string `json:"name"`
+	// The decimal and grouping separators of numbers
+	Decimal string `json:"decimal"`
+	Group   string `json:"group"`
+	// ZeroIsOne is for languages that use the singular for 0, like French
+	ZeroIsOne bool              `json:"zeroIsOne"`
+	Messages  map[string]string `json:"messages"`
+	fallback  *locale
+}
+
+// locales are the available locales by tag, and localeList the same
+// locales sorted by tag, for the language picker
+var (
+	locales    = map[string]*locale{}
+	localeList []*locale
+)
+
+func init() {
+	files, err := fs.Glob(embeddedLocales, "locales/*.json")
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range files {
+		data, err := embeddedLocales.ReadFile(file)
+		if err != nil {
+			panic(err)
+		}
+		l := &locale{Tag: strings.TrimSuffix(path.Base(file), ".json")}
+		if err := json.Unmarshal(data, l); err != nil {
+			panic(fmt.Sprintf("%s: %v", file, err))
+		}
+		locales[l.Tag] = l
+		localeList = append(localeList, l)
+	}
+	for _, l := range localeList {
+		if l.Tag != defaultLocale {
+			l.fallback = locales[defaultLocale]
+		}
+	}
+	sort.Slice(localeList, func(i, j int) bool { return localeList[i].Tag < localeList[j].Tag })
+}
+
+// T translates a message, formatting `args` into it as `fmt.Sprintf` does.
+// A message missing from every catalog shows its key, which is easy to spot
+func (l *locale) T(key string, args ...interface{}) string {
+	message, ok := l.Messages[key]
+	if !ok && l.fallback != nil {
+		message, ok = l.fallback.Messages[key]
+	}
+	if !ok {
+		return key
+	}
+	if len(args) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
+
+// N translates a message about `n` things, with the singular ("key.one")
+// or the plural ("key.other") of the language. `n` is formatted with
+// `Number`, so the message takes it as a string
+func (l *locale) N(key string, n int) string {
+	form := ".other"
+	if n == 1 || (n == 0 && l.ZeroIsOne) {
+		form = ".one"
+	}
+	return l.T(key+form, l.Number(n))
+}
+
+// Number formats an integer with the grouping separator of the language
+func (l *locale) Number(n int) string {
+	digits := strconv.Itoa(n)
+	sign := ""
+	if n < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	var grouped strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			grouped.WriteString(l.Group)
+		}
+		grouped.WriteRune(digit)
+	}
+	return sign + grouped.String()
+}
+
+// Price formats a price of the catalog, which is a plain decimal amount,
+// with two decimals and the separators of the language. Prices that aren't
+// in the format of the catalog are shown as they are
+func (l *locale) Price(price string) string {
+	cents, ok := priceCents(price)
+	if !ok {
+		return price
+	}
+	return l.Number(int(cents/100)) + l.Decimal + fmt.Sprintf("%02d", cents%100)
+}
+
+// localeFor picks the locale of a request: the one the visitor picked if
+// any, else the one their browser prefers, else English
+func localeFor(r *http.Request) *locale {
+	if cookie, err := r.Cookie(localeCookie); err == nil {
+		if l, ok := locales[cookie.Value]; ok {
+			return l
+		}
+	}
+	return negotiateLocale(r.Header.Get("Accept-Language"))
+}
+
+// negotiateLocale picks the locale of an `Accept-Language` header. Regional
+// variants get their language, so "fr-CA" is French
+func negotiateLocale(header string) *locale {
+	for _, accepted := range parseQualityList(header) {
+		tag := accepted.Value
+		if tag == "*" {
+			break
+		}
+		if l, ok := locales[tag]; ok {
+			return l
+		}
+		if base, _, found := strings.Cut(tag, "-"); found {
+			if l, ok := locales[base]; ok {
+				return l
+			}
+		}
+	}
+	return locales[defaultLocale]
+}
+
+// localeHandler remembers the language picked by the visitor, and sends them
+// back to the page they picked it on
+func localeHandler(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(w, r) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "The form could not be parsed: "+err.Error())
+		return
+	}
+	l, ok := locales[r.Form.Get("lang")]
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "There is no such language.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     localeCookie,
+		Value:    l.Tag,
+		Path:     "/",
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// Only pages of this site, "//evil.example.com" is another site
+	next := r.Form.Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/albums"
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// localizeAlbumErrors translates the messages of the errors of
+// `Album.Validate`
+func localizeAlbumErrors(l *locale, errs []fieldError) []fieldError {
+	localized := make([]fieldError, len(errs))
+	for i, e := range errs {
+		switch e.Code {
+		case "required":
+			e.Message = l.T("validation.required")
+		case "too_long":
+			e.Message = l.T("validation.tooLong", albumFieldLengths[e.Field])
+		case "out_of_range":
+			e.Message = l.T("validation.yearRange", minAlbumYear, maxAlbumYear())
+		case "invalid_format":
+			e.Message = l.T("validation.priceFormat")
+		}
+		localized[i] = e
+	}
+	return localized
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLocalesAreComplete(t *testing.T) {
+	for _, l := range localeList {
+		for key := range locales[defaultLocale].Messages {
+			if _, ok := l.Messages[key]; !ok {
+				t.Errorf("%s misses %s", l.Tag, key)
+			}
+		}
+	}
+}
+
+func TestNegotiateLocale(t *testing.T) {
+	tests := map[string]string{
+		"":                        "en",
+		"fr-CA,fr;q=0.9,en;q=0.8": "fr",
+		"it,de;q=0.5":             "de",
+		"en;q=0.1,de":             "de",
+		"it,*":                    "en",
+		"pt-BR":                   "en",
+	}
+	for header, expected := range tests {
+		if l := negotiateLocale(header); l.Tag != expected {
+			t.Errorf("%q: expected %s, got %s", header, expected, l.Tag)
+		}
+	}
+
+	// The language the visitor picked wins over their browser's
+	request := httptest.NewRequest("GET", "/albums", nil)
+	request.Header.Set("Accept-Language", "fr")
+	request.AddCookie(&http.Cookie{Name: localeCookie, Value: "de"})
+	if l := localeFor(request); l.Tag != "de" {
+		t.Errorf("the cookie should win, got %s", l.Tag)
+	}
+}
+
+func TestLocaleFormatsNumbers(t *testing.T) {
+	en, fr, de := locales["en"], locales["fr"], locales["de"]
+	tests := []struct{ actual, expected string }{
+		{en.Number(1234567), "1,234,567"},
+		{de.Number(1234), "1.234"},
+		{de.Number(-1234), "-1.234"},
+		{en.Number(999), "999"},
+		{fr.Price("22.99"), "22,99"},
+		{de.Price("1234.5"), "1.234,50"},
+		{en.Price("9"), "9.00"},
+		{en.Price("$9"), "$9"},
+		{en.Price("0.29"), "0.29"},
+		{en.Price("Inf"), "Inf"},
+		{en.Price("NaN"), "NaN"},
+		{en.Price("1e3"), "1e3"},
+		{en.N("catalog.total", 0), "0 albums"},
+		{fr.N("catalog.total", 0), "0 album"},
+		{fr.N("catalog.total", 2), "2 albums"},
+	}
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, test.actual)
+		}
+	}
+}
+
+// The English messages are the ones of Validate, so that the API reads the
+// same whatever the client accepts
+func TestEnglishValidationMessages(t *testing.T) {
+	album := Album{Title: strings.Repeat("a", maxTitleLength+1), Year: "1850", Price: "$9", Genre: strings.Repeat("g", maxGenreLength+1)}
+	errs := album.Validate()
+	for i, e := range localizeAlbumErrors(locales[defaultLocale], errs) {
+		if e.Message != errs[i].Message {
+			t.Errorf("%s: expected %q, got %q", e.Field, errs[i].Message, e.Message)
+		}
+	}
+}
+
+func TestCreateAlbumLocalizesErrors(t *testing.T) {
+	form := url.Values{"artist": {"Beyonce"}}
+	request := httptest.NewRequest("POST", "/api/v1/albums", bytes.NewBufferString(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept-Language", "fr-CA")
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusUnprocessableEntity || recorder.Header().Get("Content-Language") != "fr" {
+		t.Fatalf("expected a French 422, got %d in %q", recorder.Code, recorder.Header().Get("Content-Language"))
+	}
+	p := problem{}
+	if err := json.NewDecoder(recorder.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Errors) != 1 || p.Errors[0].Message != "est obligatoire" || p.Errors[0].Code != "required" {
+		t.Errorf("unexpected errors %+v", p.Errors)
+	}
+}
+
+func TestLocaleHandler(t *testing.T) {
+	response := submitForm("/locale", url.Values{"lang": {"fr"}, "next": {"/albums?genre=Rock"}}, nil)
+	if response.Code != http.StatusSeeOther || response.Header().Get("Location") != "/albums?genre=Rock" {
+		t.Fatalf("expected a redirect to the page, got %d to %s", response.Code, response.Header().Get("Location"))
+	}
+	body := followRedirect(t, response).Body.String()
+	if !strings.Contains(body, `<html lang="fr">`) || !strings.Contains(body, "Tous les genres") {
+		t.Errorf("the page should be in French:\n%s", body)
+	}
+
+	// Other sites aren't pages to go back to
+	for _, next := range []string{"//evil.example.com", "https://evil.example.com", `/\evil.example.com`} {
+		response = submitForm("/locale", url.Values{"lang": {"de"}, "next": {next}}, nil)
+		if location := response.Header().Get("Location"); location != "/albums" {
+			t.Errorf("%s: expected a redirect to the catalog, got %s", next, location)
+		}
+	}
+
+	if response = submitForm("/locale", url.Values{"lang": {"xx"}}, nil); response.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown language, got %d", response.Code)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxListTitleLength       = 100
+	maxListDescriptionLength = 1000
+	maxListNoteLength        = 500
+)
+
+// registerListRoutes adds the album list routes to `r`. Everybody can read
+// the public lists, but lists belong to the user of an API key, who is the
+// only one to see them while they are private, and to change them
+func registerListRoutes(r *mux.Router) {
+	r.HandleFunc("/lists", listListsHandler).Methods("GET")
+	r.Handle("/lists", requireAPIKey(createListHandler)).Methods("POST")
+	r.HandleFunc("/lists/{id:[0-9]+}", getListHandler).Methods("GET")
+	r.Handle("/lists/{id:[0-9]+}", requireAPIKey(updateListHandler)).Methods("PUT")
+	r.Handle("/lists/{id:[0-9]+}", requireAPIKey(deleteListHandler)).Methods("DELETE")
+	r.Handle("/lists/{id:[0-9]+}/items", requireAPIKey(addListItemHandler)).Methods("POST")
+	r.Handle("/lists/{id:[0-9]+}/items/{album:[0-9]+}", requireAPIKey(updateListItemHandler)).Methods("PUT")
+	r.Handle("/lists/{id:[0-9]+}/items/{album:[0-9]+}", requireAPIKey(removeListItemHandler)).Methods("DELETE")
+	r.Handle("/lists/{id:[0-9]+}/order", requireAPIKey(reorderListHandler)).Methods("PUT")
+}
+
+// listURLv1 is where version 1 of the API serves the list with this ID
+func listURLv1(id int64) string {
+	return apiV1Prefix + "/lists/" + strconv.FormatInt(id, 10)
+}
+
+// listRequest is the body of a request creating or replacing a list
+type listRequest struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Public      bool   `json:"public"`
+}
+
+// Validate checks the fields of the list, once their leading and trailing
+// spaces are removed
+func (req *listRequest) Validate() []fieldError {
+	req.Title = strings.TrimSpace(req.Title)
+	req.Description = strings.TrimSpace(req.Description)
+
+	var errs []fieldError
+	errs = appendRequired(errs, "title", req.Title, maxListTitleLength)
+	if utf8.RuneCountInString(req.Description) > maxListDescriptionLength {
+		errs = append(errs, fieldError{"description", "too_long", "must be at most " + strconv.Itoa(maxListDescriptionLength) + " characters"})
+	}
+	return errs
+}
+
+// listItemRequest is the body of a request adding an album to a list, or
+// changing its note, in which case the album is the one of the route
+type listItemRequest struct {
+	AlbumID int64  `json:"albumId"`
+	Note    string `json:"note"`
+}
+
+func (req *listItemRequest) Validate() []fieldError {
+	req.Note = strings.TrimSpace(req.Note)
+
+	var errs []fieldError
+	if req.AlbumID <= 0 {
+		errs = append(errs, fieldError{"albumId", "required", "is required"})
+	}
+	if utf8.RuneCountInString(req.Note) > maxListNoteLength {
+		errs = append(errs, fieldError{"note", "too_long", "must be at most " + strconv.Itoa(maxListNoteLength) + " characters"})
+	}
+	return errs
+}
+
+// listOrderRequest is the body of a request reordering a list. It has every
+// album of the list, in their new order
+type listOrderRequest struct {
+	AlbumIDs []int64 `json:"albumIds"`
+}
+
+func (req *listOrderRequest) Validate(list *AlbumList) []fieldError {
+	seen := map[int64]bool{}
+	for _, id := range req.AlbumIDs {
+		seen[id] = true
+	}
+	same := len(seen) == len(req.AlbumIDs) && len(seen) == len(list.Items)
+	for _, item := range list.Items {
+		same = same && seen[item.AlbumID]
+	}
+	if !same {
+		return []fieldError{{"albumIds", "invalid_format", "must have every album of the list once"}}
+	}
+	return nil
+}
+
+// decodeJSONBody reads a JSON request body into `v`, or answers with an
+// error. Unknown fields are refused, like for albums
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAlbumBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "The request body could not be parsed: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// listListsHandler lists the public lists and the ones of the caller. The
+// `owner` parameter only keeps the lists of a user
+func listListsHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := apiUser(r)
+	lists, err := listStore.ListLists(user, r.URL.Query().Get("owner"))
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, lists)
+}
+
+func createListHandler(w http.ResponseWriter, r *http.Request) {
+	req := listRequest{}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if errs := req.Validate(); errs != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The list has invalid fields.", errs...)
+		return
+	}
+
+	user, _ := apiUser(r)
+	list := &AlbumList{Owner: user, Title: req.Title, Description: req.Description, Public: req.Public}
+	if err := listStore.CreateList(list); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", listURLv1(list.ID))
+	writeJSON(w, r, http.StatusCreated, list)
+}
+
+func getListHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := findList(w, r, false)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, list)
+}
+
+// updateListHandler replaces the title, the description and the visibility
+// of a list. Its items are changed with their own routes
+func updateListHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := findList(w, r, true)
+	if !ok {
+		return
+	}
+	req := listRequest{}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if errs := req.Validate(); errs != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The list has invalid fields.", errs...)
+		return
+	}
+
+	list.Title, list.Description, list.Public = req.Title, req.Description, req.Public
+	if !writeListError(w, r, listStore.UpdateList(list)) {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, list)
+}
+
+func deleteListHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := findList(w, r, true)
+	if !ok {
+		return
+	}
+	if !writeListError(w, r, listStore.DeleteList(list.ID)) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addListItemHandler appends an album to a list
+func addListItemHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := findList(w, r, true)
+	if !ok {
+		return
+	}
+	item := listItemRequest{}
+	if !decodeJSONBody(w, r, &item) {
+		return
+	}
+	if errs := item.Validate(); errs != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The item has invalid fields.", errs...)
+		return
+	}
+
+	added := &AlbumListItem{AlbumID: item.AlbumID, Note: item.Note}
+	err := listStore.AddListItem(list.ID, added)
+	if errors.Is(err, ErrAlbumNotFound) {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The item has invalid fields.",
+			fieldError{"albumId", "not_found", "must be the ID of an album"})
+		return
+	}
+	if !writeListError(w, r, err) {
+		return
+	}
+
+	w.Header().Set("Location", listURLv1(list.ID))
+	writeJSON(w, r, http.StatusCreated, added)
+}
+
+// updateListItemHandler changes the note of an album of a list
+func updateListItemHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := findList(w, r, true)
+	if !ok {
+		return
+	}
+	item := listItemRequest{}
+	if !decodeJSONBody(w, r, &item) {
+		return
+	}
+	item.AlbumID, _ = strconv.ParseInt(mux.Vars(r)["album"], 10, 64)
+	if errs := item.Validate(); errs != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The item has invalid fields.", errs...)
+		return
+	}
+
+	if !writeListError(w, r, listStore.UpdateListItem(list.ID, &AlbumListItem{AlbumID: item.AlbumID, Note: item.Note})) {
+		return
+	}
+	updated, err := listStore.GetList(list.ID)
+	if !writeListError(w, r, err) {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, updated)
+}
+
+func removeListItemHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := findList(w, r, true)
+	if !ok {
+		return
+	}
+	albumID, _ := strconv.ParseInt(mux.Vars(r)["album"], 10, 64)
+	if !writeListError(w, r, listStore.RemoveListItem(list.ID, albumID)) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reorderListHandler moves the albums of a list to the order of the request
+func reorderListHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := findList(w, r, true)
+	if !ok {
+		return
+	}
+	req := listOrderRequest{}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if errs := req.Validate(list); errs != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The order is invalid.", errs...)
+		return
+	}
+
+	if !writeListError(w, r, listStore.ReorderList(list.ID, req.AlbumIDs)) {
+		return
+	}
+	reordered, err := listStore.GetList(list.ID)
+	if !writeListError(w, r, err) {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, reordered)
+}
+
+// findList loads the list of the route, or answers with an error. Private
+// lists of other users don't exist as far as the caller knows, and `owned`
+// only lets the owner of the list through, for the routes changing it
+func findList(w http.ResponseWriter, r *http.Request, owned bool) (*AlbumList, bool) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	list, err := listStore.GetList(id)
+	if err != nil {
+		writeListError(w, r, err)
+		return nil, false
+	}
+	user, _ := apiUser(r)
+	if !list.Public && list.Owner != user {
+		writeListError(w, r, ErrListNotFound)
+		return nil, false
+	}
+	if owned && list.Owner != user {
+		writeProblem(w, r, http.StatusForbidden, "Only the owner of the list can change it.")
+		return nil, false
+	}
+	return list, true
+}
+
+// writeListError answers with the error of a list store call, if any, and
+// tells whether the handler can go on
+func writeListError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrListNotFound):
+		writeProblem(w, r, http.StatusNotFound, "There is no list with this ID.")
+	case errors.Is(err, ErrListItemNotFound):
+		writeProblem(w, r, http.StatusNotFound, "This album is not in the list.")
+	case errors.Is(err, ErrListItemExists):
+		writeProblem(w, r, http.StatusConflict, "This album is already in the list.")
+	default:
+		writeServerError(w, r, err)
+	}
+	return false
+}
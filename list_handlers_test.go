@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// callAPI sends a JSON request to the router, with the API key if any
+func callAPI(method, path, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, req)
+	return recorder
+}
+
+// withListUsers gives the tests two users with their own API key
+func withListUsers(t *testing.T) {
+	InitAPIKeys(map[string]string{"alice-key-0123456": "alice", "bob-key-0123456789": "bob"})
+	t.Cleanup(func() { InitAPIKeys(map[string]string{}) })
+}
+
+func createTestList(t *testing.T, body string) *AlbumList {
+	response := callAPI("POST", "/api/v1/lists", "alice-key-0123456", body)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("creating the list failed with %d: %s", response.Code, response.Body)
+	}
+	list := &AlbumList{}
+	if err := json.NewDecoder(response.Body).Decode(list); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listStore.DeleteList(list.ID) })
+	return list
+}
+
+func TestAlbumLists(t *testing.T) {
+	withListUsers(t)
+	first, second, third := &Album{Title: "Kind of Blue"}, &Album{Title: "Blue Train"}, &Album{Title: "Blue"}
+	catalogAlbums(t, first, second, third)
+
+	list := createTestList(t, `{"title": "Desert island albums", "public": true}`)
+	if list.Owner != "alice" || len(list.Items) != 0 {
+		t.Errorf("the list should belong to alice and be empty, got %+v", list)
+	}
+	path := listURLv1(list.ID)
+
+	for i, album := range []*Album{first, second, third} {
+		response := callAPI("POST", path+"/items", "alice-key-0123456", fmt.Sprintf(`{"albumId": %d, "note": "number %d"}`, album.ID, i+1))
+		if response.Code != http.StatusCreated || !strings.Contains(response.Body.String(), fmt.Sprintf(`"position":%d`, i+1)) {
+			t.Fatalf("adding an album failed with %d: %s", response.Code, response.Body)
+		}
+	}
+	if response := callAPI("POST", path+"/items", "alice-key-0123456", fmt.Sprintf(`{"albumId": %d}`, first.ID)); response.Code != http.StatusConflict {
+		t.Errorf("expected 409 for an album already in the list, got %d", response.Code)
+	}
+
+	// Only the owner changes the list
+	if response := callAPI("PUT", path+"/order", "bob-key-0123456789", `{"albumIds": []}`); response.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for another user, got %d", response.Code)
+	}
+
+	// The order has to hold every album of the list once
+	if response := callAPI("PUT", path+"/order", "alice-key-0123456", fmt.Sprintf(`{"albumIds": [%d, %d, %d]}`, third.ID, first.ID, first.ID)); response.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for an incomplete order, got %d", response.Code)
+	}
+	response := callAPI("PUT", path+"/order", "alice-key-0123456", fmt.Sprintf(`{"albumIds": [%d, %d, %d]}`, third.ID, first.ID, second.ID))
+	if response.Code != http.StatusOK {
+		t.Fatalf("reordering failed with %d: %s", response.Code, response.Body)
+	}
+
+	// Removing an album moves the next ones up
+	if response := callAPI("DELETE", path+"/items/"+strconv.FormatInt(first.ID, 10), "alice-key-0123456", ""); response.Code != http.StatusNoContent {
+		t.Fatalf("removing an album failed with %d", response.Code)
+	}
+	got, _ := listStore.GetList(list.ID)
+	items := []string{}
+	for _, item := range got.Items {
+		items = append(items, fmt.Sprintf("%d:%s:%s", item.Position, item.Album.Title, item.Note))
+	}
+	if actual := strings.Join(items, " "); actual != "1:Blue:number 3 2:Blue Train:number 2" {
+		t.Errorf("unexpected items %s", actual)
+	}
+
+	// The album resource shows the public lists it is in
+	resource := struct {
+		Title string             `json:"title"`
+		Lists []AlbumListSummary `json:"lists"`
+	}{}
+	getJSON(t, newRouter(), albumURLv1(third.ID), &resource)
+	if resource.Title != "Blue" || len(resource.Lists) != 1 || resource.Lists[0].ID != list.ID {
+		t.Errorf("the album should show its list, got %+v", resource)
+	}
+}
+
+func TestPrivateAlbumLists(t *testing.T) {
+	withListUsers(t)
+	album := &Album{Title: "Pink Moon"}
+	catalogAlbums(t, album)
+
+	list := createTestList(t, `{"title": "Guilty pleasures"}`)
+	path := listURLv1(list.ID)
+	if response := callAPI("POST", path+"/items", "alice-key-0123456", fmt.Sprintf(`{"albumId": %d}`, album.ID)); response.Code != http.StatusCreated {
+		t.Fatalf("adding an album failed with %d: %s", response.Code, response.Body)
+	}
+
+	// Private lists don't exist for the others
+	for _, key := range []string{"", "bob-key-0123456789"} {
+		if response := callAPI("GET", path, key, ""); response.Code != http.StatusNotFound {
+			t.Errorf("%q: expected 404 for a private list, got %d", key, response.Code)
+		}
+		if response := callAPI("GET", "/api/v1/lists?owner=alice", key, ""); strings.Contains(response.Body.String(), "Guilty pleasures") {
+			t.Errorf("%q: the private list should not be listed: %s", key, response.Body)
+		}
+	}
+	if response := callAPI("GET", "/api/v1/lists?owner=alice", "alice-key-0123456", ""); !strings.Contains(response.Body.String(), "Guilty pleasures") {
+		t.Errorf("the owner should see their private list: %s", response.Body)
+	}
+	if response := callAPI("GET", albumURLv1(album.ID), "", ""); !strings.Contains(response.Body.String(), `"lists":[]`) {
+		t.Errorf("the album should not show private lists: %s", response.Body)
+	}
+
+	// Deleting the album takes it out of the list
+	if err := store.DeleteAlbum(album.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := listStore.GetList(list.ID); len(got.Items) != 0 {
+		t.Errorf("the deleted album should leave the list, got %+v", got.Items)
+	}
+}
+
+func TestAlbumListValidation(t *testing.T) {
+	withListUsers(t)
+	if response := callAPI("POST", "/api/v1/lists", "", `{"title": "Mine"}`); response.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without an API key, got %d", response.Code)
+	}
+	response := callAPI("POST", "/api/v1/lists", "alice-key-0123456", `{"title": " ", "description": "`+strings.Repeat("a", maxListDescriptionLength+1)+`"}`)
+	if response.Code != http.StatusUnprocessableEntity || !strings.Contains(response.Body.String(), `"field":"description"`) {
+		t.Errorf("expected 422 for the title and the description, got %d: %s", response.Code, response.Body)
+	}
+
+	list := createTestList(t, `{"title": "Mine"}`)
+	response = callAPI("POST", listURLv1(list.ID)+"/items", "alice-key-0123456", `{"albumId": 999999999}`)
+	if response.Code != http.StatusUnprocessableEntity || !strings.Contains(response.Body.String(), "not_found") {
+		t.Errorf("expected 422 for an unknown album, got %d: %s", response.Code, response.Body)
+	}
+}
+
+func TestConcurrentListAdds(t *testing.T) {
+	withListUsers(t)
+	list := createTestList(t, `{"title": "Desert island albums"}`)
+	albums := []*Album{{Title: "Kind of Blue"}, {Title: "Blue Train"}, {Title: "A Love Supreme"}, {Title: "Mingus Ah Um"}}
+	catalogAlbums(t, albums...)
+
+	// Every album is added twice at the same time, only once successfully
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*len(albums))
+	for i := 0; i < 2; i++ {
+		for _, album := range albums {
+			wg.Add(1)
+			go func(albumID int64) {
+				defer wg.Done()
+				errs <- listStore.AddListItem(list.ID, &AlbumListItem{AlbumID: albumID})
+			}(album.ID)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	exists := 0
+	for err := range errs {
+		switch {
+		case errors.Is(err, ErrListItemExists):
+			exists++
+		case err != nil:
+			t.Errorf("adding failed with %v", err)
+		}
+	}
+	if exists != len(albums) {
+		t.Errorf("expected %d albums to be refused as already added, got %d", len(albums), exists)
+	}
+
+	// The stored positions are the ones the list is sorted by
+	var items, positions int
+	if err := listStore.(*dbStore).queryRow("SELECT COUNT(*), COUNT(DISTINCT position) FROM album_list_items WHERE list_id = $1",
+		[]interface{}{list.ID}, &items, &positions); err != nil {
+		t.Fatal(err)
+	}
+	if items != len(albums) || positions != items {
+		t.Errorf("expected %d items at their own position, got %d at %d positions", len(albums), items, positions)
+	}
+}
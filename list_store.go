@@ -0,0 +1,367 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// An AlbumList is a named, ordered selection of albums made by a user, such
+// as "Desert island albums". Private lists are only seen by their owner
+type AlbumList struct {
+	ID          int64           `json:"id"`
+	Owner       string          `json:"owner"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Public      bool            `json:"public"`
+	Items       []AlbumListItem `json:"items"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+// An AlbumListItem is an album of a list, with the note its owner left
+// about it. Positions start at 1 and have no gaps. The stored positions only
+// order the items, they get gaps when albums are deleted
+type AlbumListItem struct {
+	AlbumID  int64  `json:"albumId"`
+	Position int    `json:"position"`
+	Note     string `json:"note"`
+	Album    *Album `json:"album"`
+}
+
+// An AlbumListSummary tells about a list without its items, to show the
+// lists an album is in
+type AlbumListSummary struct {
+	ID    int64  `json:"id"`
+	Owner string `json:"owner"`
+	Title string `json:"title"`
+}
+
+// The list store keeps the lists of the users and their items
+type ListStore interface {
+	CreateList(list *AlbumList) error
+	GetList(id int64) (*AlbumList, error)
+	ListLists(viewer, owner string) ([]*AlbumList, error)
+	UpdateList(list *AlbumList) error
+	DeleteList(id int64) error
+	AddListItem(listID int64, item *AlbumListItem) error
+	UpdateListItem(listID int64, item *AlbumListItem) error
+	RemoveListItem(listID, albumID int64) error
+	ReorderList(listID int64, albumIDs []int64) error
+	PublicListsWithAlbum(albumID int64) ([]AlbumListSummary, error)
+}
+
+var (
+	// ErrListNotFound is returned when no list has the given ID
+	ErrListNotFound = errors.New("list not found")
+	// ErrListItemNotFound is returned when an album isn't in the list
+	ErrListItemNotFound = errors.New("album not in the list")
+	// ErrListItemExists is returned when adding an album a list already has
+	ErrListItemExists = errors.New("album already in the list")
+)
+
+var listStore ListStore
+
+func InitLists(s ListStore) {
+	listStore = s
+}
+
+func (store *dbStore) CreateList(list *AlbumList) error {
+	list.CreatedAt = time.Now().UTC()
+	list.UpdatedAt = list.CreatedAt
+	list.Items = []AlbumListItem{}
+	res, err := store.exec("INSERT INTO album_lists(owner, title, description, public, created_at, updated_at) VALUES ($1,$2,$3,$4,$5,$6)",
+		list.Owner, list.Title, list.Description, list.Public, list.CreatedAt, list.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	list.ID, err = res.LastInsertId()
+	return err
+}
+
+func (store *dbStore) GetList(id int64) (*AlbumList, error) {
+	lists, err := store.queryLists("WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(lists) == 0 {
+		return nil, ErrListNotFound
+	}
+	return lists[0], nil
+}
+
+// ListLists returns the lists `viewer` can see: the public ones and their
+// own. A non empty `owner` only keeps the lists of this user
+func (store *dbStore) ListLists(viewer, owner string) ([]*AlbumList, error) {
+	if owner != "" {
+		return store.queryLists("WHERE owner = $1 AND (public OR owner = $2)", owner, viewer)
+	}
+	return store.queryLists("WHERE public OR owner = $1", viewer)
+}
+
+func (store *dbStore) queryLists(where string, args ...interface{}) ([]*AlbumList, error) {
+	rows, err := store.query("SELECT id, owner, title, description, public, created_at, updated_at FROM album_lists "+where+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []*AlbumList{}
+	for rows.Next() {
+		list := &AlbumList{}
+		if err := rows.Scan(&list.ID, &list.Owner, &list.Title, &list.Description, &list.Public, &list.CreatedAt, &list.UpdatedAt); err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The rows are closed before the items are read, so that the lists
+	// don't hold a connection of the pool meanwhile
+	rows.Close()
+	for _, list := range lists {
+		if list.Items, err = store.queryListItems(list.ID); err != nil {
+			return nil, err
+		}
+	}
+	return lists, nil
+}
+
+func (store *dbStore) queryListItems(listID int64) ([]AlbumListItem, error) {
+	rows, err := store.query(`SELECT i.album_id, i.note, a.title, a.artist,
+		COALESCE(a.price, ''), COALESCE(a.year, ''), COALESCE(a.genre, '')
+		FROM album_list_items i JOIN albums a ON a.idAlbum = i.album_id
+		WHERE i.list_id = $1 ORDER BY i.position`, listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []AlbumListItem{}
+	for rows.Next() {
+		item := AlbumListItem{Position: len(items) + 1, Album: &Album{}}
+		if err := rows.Scan(&item.AlbumID, &item.Note, &item.Album.Title, &item.Album.Artist,
+			&item.Album.Price, &item.Album.Year, &item.Album.Genre); err != nil {
+			return nil, err
+		}
+		item.Album.ID = item.AlbumID
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (store *dbStore) UpdateList(list *AlbumList) error {
+	list.UpdatedAt = time.Now().UTC()
+	res, err := store.exec("UPDATE album_lists SET title = $1, description = $2, public = $3, updated_at = $4 WHERE id = $5",
+		list.Title, list.Description, list.Public, list.UpdatedAt, list.ID)
+	if err != nil {
+		return err
+	}
+	return expectRow(res, ErrListNotFound)
+}
+
+// DeleteList removes a list, and its items with it
+func (store *dbStore) DeleteList(id int64) error {
+	start := time.Now()
+	const remove = "DELETE FROM album_lists WHERE id = $1"
+	err := func() error {
+		tx, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec("DELETE FROM album_list_items WHERE list_id = $1", id); err != nil {
+			return err
+		}
+		res, err := tx.Exec(remove, id)
+		if err != nil {
+			return err
+		}
+		if err := expectRow(res, ErrListNotFound); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if errors.Is(err, ErrListNotFound) {
+		store.logQuery(remove, start, nil)
+	} else {
+		store.logQuery(remove, start, err)
+	}
+	return err
+}
+
+// AddListItem appends an album to a list. It returns ErrAlbumNotFound if
+// there is no such album, and ErrListItemExists if the list already has it
+func (store *dbStore) AddListItem(listID int64, item *AlbumListItem) error {
+	album, err := store.GetAlbum(item.AlbumID)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	// The position is read by the insert itself, so that albums added at the
+	// same time get their own
+	const insert = `INSERT INTO album_list_items(list_id, album_id, position, note)
+		SELECT $1, $2, COALESCE(MAX(position), 0) + 1, $3 FROM album_list_items WHERE list_id = $1`
+	err = func() error {
+		tx, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(insert, listID, item.AlbumID, item.Note); err != nil {
+			if isConstraintViolation(err) {
+				return ErrListItemExists
+			}
+			return err
+		}
+		if err := tx.QueryRow("SELECT COUNT(*) FROM album_list_items WHERE list_id = $1", listID).Scan(&item.Position); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(touchListQuery, time.Now().UTC(), listID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if errors.Is(err, ErrListItemExists) {
+		store.logQuery(insert, start, nil)
+	} else {
+		store.logQuery(insert, start, err)
+	}
+	if err != nil {
+		return err
+	}
+	item.Album = album
+	return nil
+}
+
+// isConstraintViolation tells whether a statement failed because of a
+// constraint of the schema, such as a duplicate primary key
+func isConstraintViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint
+}
+
+func (store *dbStore) UpdateListItem(listID int64, item *AlbumListItem) error {
+	res, err := store.exec("UPDATE album_list_items SET note = $1 WHERE list_id = $2 AND album_id = $3", item.Note, listID, item.AlbumID)
+	if err != nil {
+		return err
+	}
+	if err := expectRow(res, ErrListItemNotFound); err != nil {
+		return err
+	}
+	return store.touchList(listID)
+}
+
+// RemoveListItem removes an album from a list. The albums after it move up
+// one position, since positions are counted when reading the list
+func (store *dbStore) RemoveListItem(listID, albumID int64) error {
+	res, err := store.exec("DELETE FROM album_list_items WHERE list_id = $1 AND album_id = $2", listID, albumID)
+	if err != nil {
+		return err
+	}
+	if err := expectRow(res, ErrListItemNotFound); err != nil {
+		return err
+	}
+	return store.touchList(listID)
+}
+
+// ReorderList gives the albums of a list the order of `albumIDs`, which the
+// caller checked to hold every album of the list once. The positions change
+// together, so readers never see two albums at the same position
+func (store *dbStore) ReorderList(listID int64, albumIDs []int64) error {
+	start := time.Now()
+	const reorder = "UPDATE album_list_items SET position = $1 WHERE list_id = $2 AND album_id = $3"
+	err := func() error {
+		tx, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for i, albumID := range albumIDs {
+			if _, err := tx.Exec(reorder, i+1, listID, albumID); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	store.logQuery(reorder, start, err)
+	if err != nil {
+		return err
+	}
+	return store.touchList(listID)
+}
+
+// PublicListsWithAlbum returns the public lists an album is in, oldest first
+func (store *dbStore) PublicListsWithAlbum(albumID int64) ([]AlbumListSummary, error) {
+	rows, err := store.query(`SELECT l.id, l.owner, l.title FROM album_lists l
+		JOIN album_list_items i ON i.list_id = l.id
+		WHERE i.album_id = $1 AND l.public ORDER BY l.id`, albumID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []AlbumListSummary{}
+	for rows.Next() {
+		list := AlbumListSummary{}
+		if err := rows.Scan(&list.ID, &list.Owner, &list.Title); err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	return lists, rows.Err()
+}
+
+const touchListQuery = "UPDATE album_lists SET updated_at = $1 WHERE id = $2"
+
+// touchList records that the items of a list changed
+func (store *dbStore) touchList(id int64) error {
+	_, err := store.exec(touchListQuery, time.Now().UTC(), id)
+	return err
+}
+
+// expectRow turns an update or delete that matched nothing into `notFound`
+func expectRow(res sql.Result, notFound error) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+func createListTables(db *sql.DB) {
+	createListsTableSQL := `CREATE TABLE IF NOT EXISTS album_lists (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"owner" TEXT NOT NULL,
+		"title" TEXT NOT NULL,
+		"description" TEXT NOT NULL,
+		"public" BOOLEAN NOT NULL,
+		"created_at" DATETIME NOT NULL,
+		"updated_at" DATETIME NOT NULL
+	  );`
+	createItemsTableSQL := `CREATE TABLE IF NOT EXISTS album_list_items (
+		"list_id" integer NOT NULL REFERENCES album_lists(id),
+		"album_id" integer NOT NULL REFERENCES albums(idAlbum),
+		"position" integer NOT NULL,
+		"note" TEXT NOT NULL,
+		PRIMARY KEY (list_id, album_id)
+	  );`
+	createItemsIndexSQL := `CREATE INDEX IF NOT EXISTS album_list_items_album ON album_list_items(album_id)`
+
+	for _, statement := range []string{createListsTableSQL, createItemsTableSQL, createItemsIndexSQL} {
+		if _, err := db.Exec(statement); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The levels of log lines. Lines below the level of the logger are dropped
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// parseLevel returns the level with the given name
+func parseLevel(name string) (int, error) {
+	for level, levelName := range levelNames {
+		if name == levelName {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("log-level %q must be one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// A Logger writes one JSON object per line. Every line has the time, the
+// level, the message and the fields of the logger, followed by the fields
+// given to the call
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  int
+	fields []interface{}
+}
+
+func NewLogger(out io.Writer, level int) *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: out, level: level}
+}
+
+// logger is the base logger. Requests get a copy of it with their request ID
+var logger = NewLogger(os.Stderr, LevelInfo)
+
+func InitLogger(l *Logger) {
+	logger = l
+}
+
+// With returns a logger that adds the given key/value pairs to every line
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(append(fields, l.fields...), keyValues...)
+	return &Logger{mu: l.mu, out: l.out, level: l.level, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, keyValues ...interface{}) { l.log(LevelDebug, msg, keyValues) }
+func (l *Logger) Info(msg string, keyValues ...interface{})  { l.log(LevelInfo, msg, keyValues) }
+func (l *Logger) Warn(msg string, keyValues ...interface{})  { l.log(LevelWarn, msg, keyValues) }
+func (l *Logger) Error(msg string, keyValues ...interface{}) { l.log(LevelError, msg, keyValues) }
+
+func (l *Logger) log(level int, msg string, keyValues []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	line := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": levelNames[level],
+		"msg":   msg,
+	}
+	all := append(append([]interface{}{}, l.fields...), keyValues...)
+	for i := 0; i+1 < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		// Errors don't marshal to anything useful, so they are logged as
+		// their message
+		if err, ok := all[i+1].(error); ok {
+			line[key] = err.Error()
+		} else {
+			line[key] = all[i+1]
+		}
+	}
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		data = []byte(fmt.Sprintf(`{"level":"error","msg":"unloggable line","error":%q}`, err.Error()))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(data, '\n'))
+}
+
+type loggerKey struct{}
+
+// withLogger returns a context carrying a request-scoped logger
+func withLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom returns the logger of the request the context belongs to, or
+// the base logger outside of requests
+func loggerFrom(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return logger
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// requestID returns the ID sent by the client or a proxy in front of us, so
+// that one ID follows a request across services. IDs that are too long or
+// contain odd characters are replaced, as they end up in our logs
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 128 && isSafeRequestID(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// The ID only correlates log lines, a clock-based one will do
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func isSafeRequestID(id string) bool {
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// loggingMiddleware gives every request an ID and a logger carrying it, and
+// writes one line per request once it is served
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set(requestIDHeader, id)
+
+		l := logger.With("request_id", id)
+		r = r.WithContext(withLogger(r.Context(), l))
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		elapsed := time.Since(start)
+		route := routeTemplate(r)
+		observeRequest(route, r.Method, recorder.Status(), elapsed)
+
+		// Requests that matched no route are logged without a template
+		var routeField interface{}
+		if route != "" {
+			routeField = route
+		}
+		l.Info("request",
+			"method", r.Method,
+			"route", routeField,
+			"path", r.URL.Path,
+			"status", recorder.Status(),
+			"latency_ms", float64(elapsed.Microseconds())/1000,
+			"bytes", recorder.bytes,
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
+// routeTemplate is the template of the route that matched the request, or an
+// empty string
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return ""
+}
+
+// A responseRecorder remembers the status code and the size of a response.
+// It forwards `Flush` and `Hijack`, so that streaming keeps working
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Status is the status code sent, which is 200 when the handler wrote nothing
+func (rec *responseRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := rec.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("hijacking is not supported")
+}
+
+// Unwrap lets `http.ResponseController` reach the original writer
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
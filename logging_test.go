@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends the log lines to a buffer until the returned function is
+// called
+func captureLogs(level int) (*bytes.Buffer, func()) {
+	buf := &bytes.Buffer{}
+	previous := logger
+	InitLogger(NewLogger(buf, level))
+	return buf, func() { InitLogger(previous) }
+}
+
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+func TestRequestLogLine(t *testing.T) {
+	buf, restore := captureLogs(LevelInfo)
+	defer restore()
+
+	r := newRouter()
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/v1/albums/1", nil))
+
+	id := recorder.Header().Get(requestIDHeader)
+	if len(id) != 32 {
+		t.Errorf("expected a generated request ID, got %q", id)
+	}
+
+	lines := logLines(t, buf)
+	if len(lines) != 1 {
+		t.Fatalf("expected one log line, got %v", lines)
+	}
+	line := lines[0]
+	expected := map[string]interface{}{
+		"msg":        "request",
+		"request_id": id,
+		"method":     "GET",
+		"route":      "/api/v1/albums/{id:[0-9]+}",
+		"path":       "/api/v1/albums/1",
+		"status":     float64(recorder.Code),
+		"bytes":      float64(recorder.Body.Len()),
+	}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Errorf("%s should be %v, got %v", key, value, line[key])
+		}
+	}
+	if _, ok := line["latency_ms"].(float64); !ok {
+		t.Errorf("the line has no latency: %v", line)
+	}
+}
+
+func TestRequestIDIsPropagated(t *testing.T) {
+	buf, restore := captureLogs(LevelDebug)
+	defer restore()
+
+	r := newRouter()
+	req := httptest.NewRequest("GET", "/api/v1/albums/1", nil)
+	req.Header.Set(requestIDHeader, "upstream-id.42")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+
+	if id := recorder.Header().Get(requestIDHeader); id != "upstream-id.42" {
+		t.Errorf("the request ID should be kept, got %q", id)
+	}
+	// The queries of the store are logged with the ID of the request
+	queries := 0
+	for _, line := range logLines(t, buf) {
+		if line["request_id"] != "upstream-id.42" {
+			t.Errorf("line without the request ID: %v", line)
+		}
+		if line["query"] != nil {
+			queries++
+		}
+	}
+	if queries == 0 {
+		t.Errorf("the store logged no query")
+	}
+}
+
+func TestUnsafeRequestIDIsReplaced(t *testing.T) {
+	r := newRouter()
+	req := httptest.NewRequest("GET", "/hello", nil)
+	req.Header.Set(requestIDHeader, "bad id\nwith a newline")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+
+	if id := recorder.Header().Get(requestIDHeader); len(id) != 32 {
+		t.Errorf("expected a generated request ID, got %q", id)
+	}
+}
+
+func TestUnmatchedRequestsAreLogged(t *testing.T) {
+	buf, restore := captureLogs(LevelInfo)
+	defer restore()
+
+	r := newRouter()
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/nowhere", nil))
+
+	lines := logLines(t, buf)
+	if len(lines) != 1 || lines[0]["status"] != float64(http.StatusNotFound) || lines[0]["route"] != nil {
+		t.Errorf("expected a 404 line without a route, got %v", lines)
+	}
+}
@@ -2,9 +2,7 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -14,29 +12,68 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// assetsDir is the directory of the web interface files, which are the
+// embedded ones if it is empty
+var assetsDir = ""
+
+func InitAssets(dir string) {
+	assetsDir = dir
+}
+
 // The new router function creates the router and
 // returns it to us. We can now use this function
 // to instantiate and test the router outside of the main function
 func newRouter() *mux.Router {
 	r := mux.NewRouter()
+	// Browsers ask before calling the API from a page of another origin,
+	// whatever the route
+	c := newCORS(corsPolicy)
+	r.Methods("OPTIONS").MatcherFunc(isPreflight).Handler(c.Preflight(r))
 	r.HandleFunc("/hello", handler).Methods("GET")
-	// Declare the static file directory and point it to the
-	// directory we just made
-	staticFileDirectory := http.Dir("./assets/")
-	// Declare the handler, that routes requests to their respective filename.
-	// The fileserver is wrapped in the `stripPrefix` method, because we want to
-	// remove the "/assets/" prefix when looking for files.
-	// For example, if we type "/assets/index.html" in our browser, the file server
-	// will look for only "index.html" inside the directory declared above.
-	// If we did not strip the prefix, the file server would look for
-	// "./assets/assets/index.html", and yield an error
-	staticFileHandler := http.StripPrefix("/assets/", http.FileServer(staticFileDirectory))
+	r.HandleFunc("/openapi.json", openAPIHandler).Methods("GET")
+	r.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	// Probes for the orchestrator: `/healthz` fails only when the process is
+	// stuck, `/readyz` when it can't serve requests
+	r.HandleFunc("/healthz", healthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", readyzHandler).Methods("GET")
+	r.HandleFunc("/version", versionHandler).Methods("GET")
 	// The "PathPrefix" method acts as a matcher, and matches all routes starting
 	// with "/assets/", instead of the absolute route itself
-	r.PathPrefix("/assets/").Handler(staticFileHandler).Methods("GET")
-	// These lines are added inside the newRouter() function before returning r
-	r.HandleFunc("/album", getAlbumHandler).Methods("GET")
-	r.HandleFunc("/album", createAlbumHandler).Methods("POST")
+	r.PathPrefix("/assets/").Handler(assetsHandler(assetsDir)).Methods("GET")
+	// The catalog pages are rendered on the server, so they work without
+	// JavaScript
+	r.Handle("/", http.RedirectHandler("/albums", http.StatusFound)).Methods("GET")
+	r.HandleFunc("/albums", catalogHandler).Methods("GET")
+	r.HandleFunc("/albums/{id:[0-9]+}", albumPageHandler).Methods("GET")
+	r.HandleFunc("/albums/{id:[0-9]+}/edit", editAlbumPageHandler).Methods("GET")
+	r.HandleFunc("/albums/{id:[0-9]+}/edit", editAlbumFormHandler).Methods("POST")
+	r.HandleFunc("/albums/{id:[0-9]+}/delete", deleteAlbumPageHandler).Methods("GET")
+	r.HandleFunc("/albums/{id:[0-9]+}/delete", deleteAlbumFormHandler).Methods("POST")
+	// The language picked for the pages, instead of the browser's
+	r.HandleFunc("/locale", localeHandler).Methods("POST")
+	// The JSON API is versioned, so that its payloads can change without
+	// breaking existing integrations
+	registerAPIv1(r.PathPrefix(apiV1Prefix).Subrouter())
+	// The old unversioned routes still work, but are deprecated
+	registerLegacyRoutes(r)
+	// GraphQL lets clients fetch exactly the fields they need
+	r.HandleFunc("/graphql", graphQLHandler).Methods("GET", "POST")
+
+	// Every request is logged, including the ones the rate limiter refuses
+	// and the ones that match no route
+	r.Use(loggingMiddleware)
+	r.NotFoundHandler = loggingMiddleware(c.Middleware(http.NotFoundHandler()))
+	r.MethodNotAllowedHandler = loggingMiddleware(c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})))
+	// Pages of other origins can read every response, including the
+	// refusals of the rate limiter
+	r.Use(c.Middleware)
+	// Every client gets its own token bucket for reads and for writes, so a
+	// single script flooding the API cannot starve everybody else
+	r.Use(newRateLimiter(rateLimits).Middleware)
+	// The JSON and the assets are compressed for the clients that accept it
+	r.Use(compressionMiddleware)
 	return r
 }
 
@@ -58,53 +95,11 @@ type album struct {
 }
 
 func main() {
-	// The router is now formed by calling the `newRouter` constructor function
-	// that we defined above. The rest of the code stays the same
-
-	jsonFile, err := os.Open("albums.json")
-	// if we os.Open returns an error then handle it
-	if err != nil {
-		fmt.Println(err)
-	}
-	fmt.Println("Successfully Opened albums.json")
-	// defer the closing of our jsonFile so that we can parse it later on
-	defer jsonFile.Close()
-
-	byteValue, _ := ioutil.ReadAll(jsonFile)
-
-	var albums Albums
-
-	json.Unmarshal(byteValue, &albums)
-	fmt.Println("First album title is:", albums.Albums[0].Title)
-
-	log.Println("Creating sqlite-database.db...")
-	file, err := os.Create("sqlite-database-alb.db")
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	file.Close()
-	log.Println("sqlite-database.db created")
-
-	sqliteDatabase, _ := sql.Open("sqlite3", "./sqlite-database-alb.db")
-	defer sqliteDatabase.Close() // Defer Closing the database
-	createTable(sqliteDatabase)
-
-	for i := 0; i < len(albums.Albums); i++ {
-		album := albums.Albums[i]
-		_, err1 := sqliteDatabase.Exec("INSERT INTO albums(title, artist, class, genre, year) VALUES ($1,$2,$3,$4,$5)", album.Title, album.Artist,
-			album.Class, album.Genre, album.Year)
-		_ = err1
-	}
-
-	InitStore(&dbStore{db: sqliteDatabase})
-
-	r := newRouter()
-	fmt.Println("Serving on port 8080")
-	http.ListenAndServe(":8080", r)
+	os.Exit(runCLI(os.Args[1:], os.Getenv, os.Stdout, os.Stderr))
 }
 
 func createTable(db *sql.DB) {
-	createAlbumsTableSQL := `CREATE TABLE albums (
+	createAlbumsTableSQL := `CREATE TABLE IF NOT EXISTS albums (
 		"idAlbum" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
 		"title" TEXT,
 		"artist" TEXT,
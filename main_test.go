@@ -12,16 +12,20 @@ import (
 	"testing"
 )
 
+// The store suite drops the albums of its database, so the other tests get
+// a database of their own
+const apiTestDatabase = "sqlite-database-api-test.db"
+
 func init() {
 	var albums Albums
 
-	file, err := os.Create("sqlite-database-album-test.db")
+	file, err := os.Create(apiTestDatabase)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 	file.Close()
 
-	sqliteDatabase, _ := sql.Open("sqlite3", "./sqlite-database-album-test.db")
+	sqliteDatabase, _ := sql.Open("sqlite3", "./"+apiTestDatabase)
 	createTable(sqliteDatabase)
 
 	for i := 0; i < len(albums.Albums); i++ {
@@ -31,7 +35,21 @@ func init() {
 		_ = err1
 	}
 
-	InitStore(&dbStore{db: sqliteDatabase})
+	createWebhookTables(sqliteDatabase)
+	createListTables(sqliteDatabase)
+	createCollectionTable(sqliteDatabase)
+	createShopTables(sqliteDatabase)
+	createPriceTables(sqliteDatabase)
+	setSchemaVersion(sqliteDatabase)
+
+	InitStore(instrumentStore(&dbStore{db: sqliteDatabase}))
+	InitDBMetrics(sqliteDatabase)
+	InitReadiness(sqliteDatabase)
+	InitWebhooks(&dbStore{db: sqliteDatabase})
+	InitLists(&dbStore{db: sqliteDatabase})
+	InitCollection(&dbStore{db: sqliteDatabase})
+	InitShop(&dbStore{db: sqliteDatabase})
+	InitPrices(&dbStore{db: sqliteDatabase})
 
 }
 
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics are written in the Prometheus text exposition format, which is
+// simple enough not to need the Prometheus client library. Every metric is
+// a family of series, told apart by the values of their labels
+
+// latencyBuckets are the upper bounds of the latency histograms, in seconds
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A collector writes one metric family
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+type metricsRegistry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func (reg *metricsRegistry) register(c collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.collectors = append(reg.collectors, c)
+}
+
+func (reg *metricsRegistry) writeTo(w io.Writer) {
+	reg.mu.Lock()
+	collectors := append([]collector{}, reg.collectors...)
+	reg.mu.Unlock()
+	for _, c := range collectors {
+		c.writeTo(w)
+	}
+}
+
+// metrics holds every metric the server exposes
+var metrics = &metricsRegistry{}
+
+var (
+	httpRequests = newCounterVec("albumpedia_http_requests_total",
+		"HTTP requests served, by route template, method and status.", "route", "method", "status")
+	httpRequestDuration = newHistogramVec("albumpedia_http_request_duration_seconds",
+		"Time spent serving HTTP requests, by route template, method and status.", "route", "method", "status")
+	storeDuration = newHistogramVec("albumpedia_store_operation_duration_seconds",
+		"Time spent in store operations, by operation.", "operation")
+	storeErrors = newCounterVec("albumpedia_store_operation_errors_total",
+		"Store operations that failed, by operation.", "operation")
+)
+
+// metricsDB is the database whose connection pool is reported, if any
+var metricsDB *sql.DB
+
+func InitDBMetrics(db *sql.DB) {
+	metricsDB = db
+}
+
+func init() {
+	metrics.register(httpRequests)
+	metrics.register(httpRequestDuration)
+	metrics.register(storeDuration)
+	metrics.register(storeErrors)
+	registerDBStats()
+	registerCatalogGauges()
+}
+
+// registerDBStats reports the connection pool of `metricsDB`, as it is when
+// the metrics are scraped
+func registerDBStats() {
+	stat := func(name, typ, help string, value func(sql.DBStats) float64) {
+		metrics.register(&metricFunc{name: name, typ: typ, help: help, collect: func() ([]float64, error) {
+			if metricsDB == nil {
+				return nil, nil
+			}
+			return []float64{value(metricsDB.Stats())}, nil
+		}})
+	}
+	stat("albumpedia_db_max_open_connections", "gauge", "Maximum number of open connections to the database.",
+		func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) })
+	stat("albumpedia_db_open_connections", "gauge", "Established connections to the database, in use or idle.",
+		func(s sql.DBStats) float64 { return float64(s.OpenConnections) })
+	stat("albumpedia_db_in_use_connections", "gauge", "Connections to the database currently in use.",
+		func(s sql.DBStats) float64 { return float64(s.InUse) })
+	stat("albumpedia_db_idle_connections", "gauge", "Idle connections to the database.",
+		func(s sql.DBStats) float64 { return float64(s.Idle) })
+	stat("albumpedia_db_wait_count_total", "counter", "Times a query waited for a free connection.",
+		func(s sql.DBStats) float64 { return float64(s.WaitCount) })
+	stat("albumpedia_db_wait_duration_seconds_total", "counter", "Time spent waiting for a free connection.",
+		func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() })
+}
+
+// registerCatalogGauges reports the size of the catalog. The store is asked
+// on every scrape, which is cheap compared to how rarely scrapes happen. The
+// scrapes skip the instrumentation, which measures the traffic
+func registerCatalogGauges() {
+	gauge := func(name, help string, count func(Store) (int, error)) {
+		metrics.register(&metricFunc{name: name, typ: "gauge", help: help, collect: func() ([]float64, error) {
+			if store == nil {
+				return nil, nil
+			}
+			n, err := count(uninstrumented(store))
+			return []float64{float64(n)}, err
+		}})
+	}
+	gauge("albumpedia_albums", "Albums in the catalog.", func(s Store) (int, error) {
+		_, total, err := s.ListAlbums(AlbumQuery{Limit: 1})
+		return total, err
+	})
+	gauge("albumpedia_artists", "Artists with at least one album in the catalog.", func(s Store) (int, error) {
+		artists, err := s.ListArtists()
+		return len(artists), err
+	})
+	gauge("albumpedia_genres", "Genres with at least one album in the catalog.", func(s Store) (int, error) {
+		genres, err := s.ListGenres()
+		return len(genres), err
+	})
+}
+
+// metricsHandler serves every metric to Prometheus
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf := bufio.NewWriter(w)
+	metrics.writeTo(buf)
+	buf.Flush()
+}
+
+// observeRequest records a served request. Requests that matched no route
+// share one label value, and so do unknown methods, so that scanners can't
+// create a series per path or per method
+func observeRequest(route, method string, status int, elapsed time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+	default:
+		method = "other"
+	}
+	statusText := strconv.Itoa(status)
+	httpRequests.inc(route, method, statusText)
+	httpRequestDuration.observe(elapsed.Seconds(), route, method, statusText)
+}
+
+// A counterVec is a family of counters
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	series     map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: map[string]*counterSeries{}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := seriesKey(labelValues)
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: labelValues}
+		c.series[key] = s
+	}
+	s.value++
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, "counter", c.help)
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labelValues), formatValue(s.value))
+	}
+}
+
+// A histogramVec is a family of histograms, sharing `latencyBuckets`
+type histogramVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// counts[i] is the number of observations not above latencyBuckets[i]
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, series: map[string]*histogramSeries{}}
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := seriesKey(labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(latencyBuckets))}
+		h.series[key] = s
+	}
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, "histogram", h.help)
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i, bound := range latencyBuckets {
+			values := append(append([]string{}, s.labelValues...), formatValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, values), s.counts[i])
+		}
+		values := append(append([]string{}, s.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(bucketLabels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labelValues), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labelValues), s.count)
+	}
+}
+
+// A metricFunc is a metric without labels, whose value is read when the
+// metrics are scraped. It is left out when there is nothing to report
+type metricFunc struct {
+	name, typ, help string
+	collect         func() ([]float64, error)
+}
+
+func (m *metricFunc) writeTo(w io.Writer) {
+	values, err := m.collect()
+	if err != nil {
+		logger.Error("collecting a metric failed", "metric", m.name, "error", err)
+		return
+	}
+	if len(values) == 0 {
+		return
+	}
+	writeHeader(w, m.name, m.typ, m.help)
+	fmt.Fprintf(w, "%s %s\n", m.name, formatValue(values[0]))
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// sortedKeys keeps the order of the series stable between scrapes
+func sortedKeys[V any](series map[string]V) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// An instrumentedStore measures how long the operations of a store take, and
+// counts the ones that fail. Missing albums and refused deletes are answers,
+// not failures
+type instrumentedStore struct {
+	next Store
+}
+
+func instrumentStore(s Store) Store {
+	return &instrumentedStore{next: s}
+}
+
+// uninstrumented returns the store an instrumented store measures
+func uninstrumented(s Store) Store {
+	if instrumented, ok := s.(*instrumentedStore); ok {
+		return instrumented.next
+	}
+	return s
+}
+
+func (s *instrumentedStore) observe(operation string, start time.Time, err error) {
+	storeDuration.observe(time.Since(start).Seconds(), operation)
+	if err != nil && !isStoreAnswer(err) {
+		storeErrors.inc(operation)
+	}
+}
+
+// storeAnswers are the errors of the store that the handlers turn into
+// client errors
+var storeAnswers = []error{ErrAlbumNotFound, ErrAlbumInCollections}
+
+func isStoreAnswer(err error) bool {
+	for _, answer := range storeAnswers {
+		if errors.Is(err, answer) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithLogger keeps the instrumentation on the request-scoped copy of the store
+func (s *instrumentedStore) WithLogger(l *Logger) Store {
+	if next, ok := s.next.(interface{ WithLogger(*Logger) Store }); ok {
+		return &instrumentedStore{next: next.WithLogger(l)}
+	}
+	return s
+}
+
+func (s *instrumentedStore) CreateAlbum(album *Album) (err error) {
+	defer func(start time.Time) { s.observe("CreateAlbum", start, err) }(time.Now())
+	return s.next.CreateAlbum(album)
+}
+
+func (s *instrumentedStore) UpdateAlbum(album *Album) (previousPrice string, err error) {
+	defer func(start time.Time) { s.observe("UpdateAlbum", start, err) }(time.Now())
+	return s.next.UpdateAlbum(album)
+}
+
+func (s *instrumentedStore) DeleteAlbum(id int64) (err error) {
+	defer func(start time.Time) { s.observe("DeleteAlbum", start, err) }(time.Now())
+	return s.next.DeleteAlbum(id)
+}
+
+func (s *instrumentedStore) GetAlbum(id int64) (album *Album, err error) {
+	defer func(start time.Time) { s.observe("GetAlbum", start, err) }(time.Now())
+	return s.next.GetAlbum(id)
+}
+
+func (s *instrumentedStore) GetAlbums() (albums []*Album, err error) {
+	defer func(start time.Time) { s.observe("GetAlbums", start, err) }(time.Now())
+	return s.next.GetAlbums()
+}
+
+func (s *instrumentedStore) ListAlbums(query AlbumQuery) (albums []*Album, total int, err error) {
+	defer func(start time.Time) { s.observe("ListAlbums", start, err) }(time.Now())
+	return s.next.ListAlbums(query)
+}
+
+func (s *instrumentedStore) ListArtists() (artists []NamedCount, err error) {
+	defer func(start time.Time) { s.observe("ListArtists", start, err) }(time.Now())
+	return s.next.ListArtists()
+}
+
+func (s *instrumentedStore) ListGenres() (genres []NamedCount, err error) {
+	defer func(start time.Time) { s.observe("ListGenres", start, err) }(time.Now())
+	return s.next.ListGenres()
+}
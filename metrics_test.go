@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	r := newRouter()
+
+	// Serve a request first, so that it shows up in the metrics
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/albums/1", nil))
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Status should be 200, got %d", recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"# TYPE albumpedia_http_requests_total counter\n",
+		`albumpedia_http_requests_total{route="/api/v1/albums/{id:[0-9]+}",method="GET",status="`,
+		`albumpedia_http_request_duration_seconds_bucket{route="/api/v1/albums/{id:[0-9]+}",method="GET",status="`,
+		`albumpedia_store_operation_duration_seconds_count{operation="GetAlbum"} `,
+		"# TYPE albumpedia_db_open_connections gauge\n",
+		"# TYPE albumpedia_albums gauge\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("the metrics should contain %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestUnknownMethodsShareALabel(t *testing.T) {
+	r := newRouter()
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("SCAN-4242", "/no/such/page", nil))
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	if strings.Contains(body, "SCAN-4242") || !strings.Contains(body, `route="unmatched",method="other"`) {
+		t.Errorf("expected the unknown method to be counted as other, got:\n%s", body)
+	}
+}
+
+func TestHistogramBucketsAreCumulative(t *testing.T) {
+	h := newHistogramVec("test_seconds", "A test histogram.", "name")
+	h.observe(0.003, `a "quoted" name`)
+	h.observe(0.3, `a "quoted" name`)
+
+	buf := &bytes.Buffer{}
+	h.writeTo(buf)
+	body := buf.String()
+	for _, expected := range []string{
+		`test_seconds_bucket{name="a \"quoted\" name",le="0.0025"} 0` + "\n",
+		`test_seconds_bucket{name="a \"quoted\" name",le="0.005"} 1` + "\n",
+		`test_seconds_bucket{name="a \"quoted\" name",le="0.5"} 2` + "\n",
+		`test_seconds_bucket{name="a \"quoted\" name",le="+Inf"} 2` + "\n",
+		`test_seconds_sum{name="a \"quoted\" name"} 0.303` + "\n",
+		`test_seconds_count{name="a \"quoted\" name"} 2` + "\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("the histogram should contain %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestScrapesArentMeasured(t *testing.T) {
+	previous := store
+	InitStore(instrumentStore(uninstrumented(store)))
+	defer InitStore(previous)
+	observed := func() uint64 {
+		storeDuration.mu.Lock()
+		defer storeDuration.mu.Unlock()
+		if series := storeDuration.series[seriesKey([]string{"ListArtists"})]; series != nil {
+			return series.count
+		}
+		return 0
+	}
+
+	before := observed()
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), "\nalbumpedia_artists ") {
+		t.Errorf("the metrics should count the artists, got:\n%s", recorder.Body)
+	}
+	if after := observed(); after != before {
+		t.Errorf("the scrape shouldn't be measured as store operations, %d were", after-before)
+	}
+}
+
+// failingStore fails to read albums, and refuses to delete them. Its other
+// operations are not used
+type failingStore struct{ Store }
+
+func (failingStore) GetAlbum(id int64) (*Album, error) { return nil, errors.New("disk on fire") }
+
+func (failingStore) DeleteAlbum(id int64) error { return ErrAlbumInCollections }
+
+func TestStoreErrorsAreCounted(t *testing.T) {
+	s := instrumentStore(failingStore{})
+	before := storeErrors.series[seriesKey([]string{"GetAlbum"})]
+	count := 0.0
+	if before != nil {
+		count = before.value
+	}
+
+	if _, err := s.GetAlbum(1); err == nil {
+		t.Fatal("the error should be passed on")
+	}
+	if after := storeErrors.series[seriesKey([]string{"GetAlbum"})]; after == nil || after.value != count+1 {
+		t.Errorf("the error should have been counted")
+	}
+}
+
+func TestRefusalsArentStoreErrors(t *testing.T) {
+	s := instrumentStore(failingStore{})
+	counted := func() float64 {
+		if series := storeErrors.series[seriesKey([]string{"DeleteAlbum"})]; series != nil {
+			return series.value
+		}
+		return 0
+	}
+	before := counted()
+	if err := s.DeleteAlbum(1); !errors.Is(err, ErrAlbumInCollections) {
+		t.Fatalf("the refusal should be passed on, got %v", err)
+	}
+	if counted() != before {
+		t.Errorf("the refusal shouldn't be counted as an error")
+	}
+}
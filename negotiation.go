@@ -0,0 +1,96 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A qualityValue is one entry of a header such as `Accept` or
+// `Accept-Language`, for example "text/html;q=0.8"
+type qualityValue struct {
+	Value   string
+	Quality float64
+}
+
+// parseQualityList splits a header into its values, ordered from the most to
+// the least preferred. Values with the same quality keep the order the client
+// sent them in. Values with a quality of 0 are explicitly refused and dropped
+func parseQualityList(header string) []qualityValue {
+	values := []qualityValue{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		value := strings.ToLower(strings.TrimSpace(fields[0]))
+		if value == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		values = append(values, qualityValue{value, quality})
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].Quality > values[j].Quality
+	})
+	return values
+}
+
+// negotiateContentType picks the media type from `offers` the client prefers,
+// according to its `Accept` header. Without an `Accept` header every offer is
+// acceptable, and the first one wins. It returns "" if no offer is acceptable
+func negotiateContentType(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+
+	for _, accepted := range parseQualityList(accept) {
+		for _, offer := range offers {
+			if mediaTypeMatches(accepted.Value, offer) {
+				return offer
+			}
+		}
+	}
+	return ""
+}
+
+// mediaTypeMatches reports whether `pattern` (which may be "*/*" or
+// "type/*") covers the media type `offer`
+func mediaTypeMatches(pattern, offer string) bool {
+	if pattern == "*/*" || pattern == offer {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(offer, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+// hasJSONBody reports whether the request body is declared as JSON
+func hasJSONBody(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// wantsJSON decides whether a request comes from an API client rather than
+// from a browser. Clients that send JSON get JSON back, and so do clients
+// that prefer JSON over HTML in their `Accept` header
+func wantsJSON(r *http.Request) bool {
+	if hasJSONBody(r) {
+		return true
+	}
+	return negotiateContentType(r, "text/html", "application/json") == "application/json"
+}
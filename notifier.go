@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// A Notifier tells users about something that happened, by whatever means
+// it knows of them: email, push notifications, a chat bot...
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// A Notification is a message to one user, the user of an API key
+type Notification struct {
+	User    string
+	Subject string
+	Text    string
+	// Link is the path of the page the notification is about, on this server
+	Link string
+}
+
+// Notifiers get this long to deliver a notification
+const notifyTimeout = 30 * time.Second
+
+// Until a real notifier is plugged in, notifications are only logged
+var notifier Notifier = logNotifier{}
+
+func InitNotifier(n Notifier) {
+	notifier = n
+}
+
+// logNotifier writes the notifications to the log
+type logNotifier struct{}
+
+func (logNotifier) Notify(ctx context.Context, n Notification) error {
+	logger.Info("notification", "user", n.User, "subject", n.Subject, "text", n.Text, "link", n.Link)
+	return nil
+}
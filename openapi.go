@@ -0,0 +1,19 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// The OpenAPI document is written by hand and compiled into the binary.
+// `TestOpenAPIDescribesEveryRoute` makes sure it stays in sync with the
+// routes registered in `newRouter`
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
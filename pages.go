@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// templatesDir is the directory of the HTML page templates, which are the
+// embedded ones if it is empty. Every page is rendered within `layout.html`
+var templatesDir = ""
+
+var (
+	pagesMu sync.Mutex
+	pages   map[string]*template.Template
+)
+
+// pageFuncs are the functions the templates can call
+var pageFuncs = template.FuncMap{
+	"field": field,
+}
+
+// InitTemplates parses the page templates of `dir`, so that a mistake in
+// them stops the server from starting rather than failing its requests
+func InitTemplates(dir string) error {
+	parsed, err := parsePages(dir)
+	if err != nil {
+		return err
+	}
+	pagesMu.Lock()
+	defer pagesMu.Unlock()
+	templatesDir, pages = dir, parsed
+	return nil
+}
+
+// parsePages parses every template of `dir` with the layout. Each page is
+// named after its file, without the extension
+func parsePages(dir string) (map[string]*template.Template, error) {
+	fsys := templatesFS(dir)
+	files, err := fs.Glob(fsys, "*.html")
+	if err != nil {
+		return nil, err
+	}
+	parsed := map[string]*template.Template{}
+	for _, file := range files {
+		if file == "layout.html" {
+			continue
+		}
+		name := strings.TrimSuffix(file, ".html")
+		page, err := template.New(name).Funcs(pageFuncs).ParseFS(fsys, "layout.html", file)
+		if err != nil {
+			return nil, err
+		}
+		parsed[name] = page
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("no page templates in %s", dir)
+	}
+	return parsed, nil
+}
+
+// page returns the template of a page, parsing the templates on first use
+// if `InitTemplates` wasn't called
+func page(name string) (*template.Template, error) {
+	pagesMu.Lock()
+	defer pagesMu.Unlock()
+	if pages == nil {
+		parsed, err := parsePages(templatesDir)
+		if err != nil {
+			return nil, err
+		}
+		pages = parsed
+	}
+	tmpl, ok := pages[name]
+	if !ok {
+		return nil, fmt.Errorf("there is no %s page template", name)
+	}
+	return tmpl, nil
+}
+
+// renderPage writes a page. It is rendered before anything is sent, so that
+// a failing template gives a clean error instead of half a page. `data`
+// embeds a `pageContext`, for the layout
+func renderPage(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	tmpl, err := page(name)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	var body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&body, "layout", data); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Even if some markup escaped the templates, it couldn't run scripts
+	// from anywhere else
+	w.Header().Set("Content-Security-Policy", "default-src 'self'")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// pageContext is what the layout shows around every page, each page embeds
+// it
+type pageContext struct {
+	Flash   *flash
+	L       *locale
+	Locales []*locale
+	// Path is the URL of the page, where the language picker comes back to
+	Path string
+}
+
+// newPageContext takes the flash of the request, and picks its locale. The
+// page depends on the language of the browser, and on the cookies
+func newPageContext(w http.ResponseWriter, r *http.Request) pageContext {
+	l := localeFor(r)
+	w.Header().Set("Content-Language", l.Tag)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Add("Vary", "Cookie")
+	return pageContext{Flash: takeFlash(w, r), L: l, Locales: localeList, Path: r.URL.RequestURI()}
+}
+
+// A catalogQuery is what the catalog page shows, as read from its URL. Pages
+// have as many albums as the GraphQL ones by default
+type catalogQuery struct {
+	Title, Artist, Genre, Year string
+	Sort                       string
+	Page, Size                 int
+}
+
+func parseCatalogQuery(r *http.Request) catalogQuery {
+	values := r.URL.Query()
+	query := catalogQuery{
+		Title:  strings.TrimSpace(values.Get("title")),
+		Artist: values.Get("artist"),
+		Genre:  values.Get("genre"),
+		Year:   strings.TrimSpace(values.Get("year")),
+		Sort:   values.Get("sort"),
+		Page:   1,
+		Size:   defaultPageSize,
+	}
+	// Hand-edited URLs get the defaults rather than an error page
+	if !validAlbumSort(query.Sort) {
+		query.Sort = ""
+	}
+	if page, err := strconv.Atoi(values.Get("page")); err == nil && page > 1 {
+		query.Page = page
+	}
+	if size, err := strconv.Atoi(values.Get("size")); err == nil && size > 0 {
+		query.Size = size
+		if size > maxPageSize {
+			query.Size = maxPageSize
+		}
+	}
+	return query
+}
+
+// CustomSize tells whether the visitor asked for a page size
+func (query catalogQuery) CustomSize() bool {
+	return query.Size != defaultPageSize
+}
+
+// URL links to the catalog page of the query. The defaults are left out,
+// which keeps the links short
+func (query catalogQuery) URL() string {
+	values := url.Values{}
+	for _, param := range []struct{ name, value string }{
+		{"title", query.Title},
+		{"artist", query.Artist},
+		{"genre", query.Genre},
+		{"year", query.Year},
+		{"sort", query.Sort},
+	} {
+		if param.value != "" {
+			values.Set(param.name, param.value)
+		}
+	}
+	if query.Page > 1 {
+		values.Set("page", strconv.Itoa(query.Page))
+	}
+	if query.CustomSize() {
+		values.Set("size", strconv.Itoa(query.Size))
+	}
+	if len(values) == 0 {
+		return "/albums"
+	}
+	return "/albums?" + values.Encode()
+}
+
+// A sortColumn is the header of a column the catalog can be sorted by.
+// Following its link sorts by the column, or reverses the order if the
+// catalog is already sorted by it
+type sortColumn struct {
+	Label string
+	URL   string
+	// Order is "ascending" or "descending" for the column the catalog is
+	// sorted by, as in the `aria-sort` attribute
+	Order string
+}
+
+// A pageLink links to a page of the catalog. A zero `Number` stands for the
+// pages left out between two links
+type pageLink struct {
+	Number  int
+	URL     string
+	Current bool
+}
+
+type catalogPage struct {
+	pageContext
+	Query           catalogQuery
+	Albums          []*Album
+	Total           int
+	Page, Pages     int
+	Columns         []sortColumn
+	PageLinks       []pageLink
+	Previous, Next  string
+	Artists, Genres []NamedCount
+}
+
+func (p *catalogPage) columns() []sortColumn {
+	columns := []sortColumn{}
+	for _, column := range []struct{ label, sort string }{
+		{"album.title", "title"},
+		{"album.artist", "artist"},
+		{"album.year", "year"},
+		{"album.price", "price"},
+	} {
+		query := p.Query
+		query.Page = 1
+		query.Sort = column.sort
+		order := ""
+		switch p.Query.Sort {
+		case column.sort:
+			order, query.Sort = "ascending", "-"+column.sort
+		case "-" + column.sort:
+			order = "descending"
+		}
+		columns = append(columns, sortColumn{Label: p.L.T(column.label), URL: query.URL(), Order: order})
+	}
+	return columns
+}
+
+// pageLinks links to the first and the last pages, and to the ones around
+// the current page
+func (p *catalogPage) pageLinks() []pageLink {
+	links := []pageLink{}
+	for number := 1; number <= p.Pages; number++ {
+		if number != 1 && number != p.Pages && (number < p.Page-2 || number > p.Page+2) {
+			if links[len(links)-1].Number != 0 {
+				links = append(links, pageLink{})
+			}
+			continue
+		}
+		links = append(links, pageLink{Number: number, URL: p.pageURL(number), Current: number == p.Page})
+	}
+	return links
+}
+
+func (p *catalogPage) pageURL(number int) string {
+	query := p.Query
+	query.Page = number
+	return query.URL()
+}
+
+// catalogHandler renders a page of the catalog, filtered and sorted as the
+// query string says
+func catalogHandler(w http.ResponseWriter, r *http.Request) {
+	query := parseCatalogQuery(r)
+	s := storeFor(r.Context())
+	albums, total, err := s.ListAlbums(AlbumQuery{
+		Title:  query.Title,
+		Artist: query.Artist,
+		Genre:  query.Genre,
+		Year:   query.Year,
+		Sort:   query.Sort,
+		Limit:  query.Size,
+		Offset: (query.Page - 1) * query.Size,
+	})
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	p := &catalogPage{Query: query, Albums: albums, Total: total, Page: query.Page}
+	p.Pages = (total + query.Size - 1) / query.Size
+	// Past the last page, because albums were deleted since the link was
+	// made, the last page is more useful than an empty one
+	if p.Pages > 0 && query.Page > p.Pages {
+		http.Redirect(w, r, p.pageURL(p.Pages), http.StatusFound)
+		return
+	}
+	if p.Artists, err = s.ListArtists(); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if p.Genres, err = s.ListGenres(); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	p.pageContext = newPageContext(w, r)
+	p.Columns = p.columns()
+	p.PageLinks = p.pageLinks()
+	if p.Page > 1 {
+		p.Previous = p.pageURL(p.Page - 1)
+	}
+	if p.Page < p.Pages {
+		p.Next = p.pageURL(p.Page + 1)
+	}
+	renderPage(w, r, http.StatusOK, "albums", p)
+}
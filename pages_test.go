@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// catalogAlbums adds albums of an artist of their own, so that the catalog
+// can be filtered down to them, and deletes them after the test
+func catalogAlbums(t *testing.T, albums ...*Album) string {
+	artist := fmt.Sprintf("Catalog Test %d", time.Now().UnixNano())
+	for _, album := range albums {
+		album.Artist = artist
+		if err := store.CreateAlbum(album); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, album := range albums {
+			store.DeleteAlbum(album.ID)
+		}
+	})
+	return artist
+}
+
+func getPage(target string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+	return recorder
+}
+
+func TestCatalogPageEscapesMarkup(t *testing.T) {
+	artist := catalogAlbums(t, &Album{Title: `<script>alert("pwned")</script>`, Price: "9.99"})
+
+	response := getPage("/albums?artist=" + url.QueryEscape(artist))
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", response.Code)
+	}
+	if response.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("unexpected content type %s", response.Header().Get("Content-Type"))
+	}
+	body := response.Body.String()
+	if strings.Contains(body, `<script>alert`) || !strings.Contains(body, "&lt;script&gt;alert(&#34;pwned&#34;)&lt;/script&gt;") {
+		t.Errorf("the title should be escaped:\n%s", body)
+	}
+}
+
+func TestCatalogPageSortsAndPages(t *testing.T) {
+	artist := catalogAlbums(t,
+		&Album{Title: "Bravo", Price: "10"},
+		&Album{Title: "alpha", Price: "100"},
+		&Album{Title: "Charlie", Price: "9.5"},
+	)
+	filter := "/albums?artist=" + url.QueryEscape(artist)
+
+	order := func(body string, titles ...string) bool {
+		last := -1
+		for _, title := range titles {
+			i := strings.Index(body, ">"+title+"</a></td>")
+			if i < last {
+				return false
+			}
+			last = i
+		}
+		return true
+	}
+
+	// Prices are sorted as numbers, titles ignoring case
+	if body := getPage(filter + "&sort=price").Body.String(); !order(body, "Charlie", "Bravo", "alpha") {
+		t.Errorf("unexpected order by price:\n%s", body)
+	}
+	body := getPage(filter + "&sort=-title").Body.String()
+	if !order(body, "Charlie", "Bravo", "alpha") {
+		t.Errorf("unexpected order by descending title:\n%s", body)
+	}
+	// The column the page is sorted by links to the other order
+	if !strings.Contains(body, `<th aria-sort="descending"><a href="/albums?artist=`) ||
+		!strings.Contains(body, "sort=title") {
+		t.Errorf("the title column should link to the ascending order:\n%s", body)
+	}
+
+	body = getPage(filter + "&size=2&page=2").Body.String()
+	if !strings.Contains(body, "Charlie") || strings.Contains(body, "Bravo") || !strings.Contains(body, `rel="prev"`) {
+		t.Errorf("the second page should only have the last album:\n%s", body)
+	}
+
+	// Past the last page, the visitor is sent to the last one
+	response := getPage(filter + "&size=2&page=9")
+	if response.Code != http.StatusFound || !strings.Contains(response.Header().Get("Location"), "page=2") {
+		t.Errorf("expected a redirect to the second page, got %d to %s", response.Code, response.Header().Get("Location"))
+	}
+}
+
+func TestCatalogQueryDefaults(t *testing.T) {
+	request := httptest.NewRequest("GET", "/albums?sort=name;drop&page=-3&size=5000", nil)
+	query := parseCatalogQuery(request)
+	if query.Sort != "" || query.Page != 1 || query.Size != maxPageSize {
+		t.Errorf("invalid parameters should fall back to the defaults, got %+v", query)
+	}
+	if url := query.URL(); url != "/albums?size=100" {
+		t.Errorf("unexpected URL %s", url)
+	}
+}
+
+func TestCatalogPageLinks(t *testing.T) {
+	p := &catalogPage{Query: catalogQuery{Size: defaultPageSize}, Page: 6, Pages: 12}
+	numbers := []int{}
+	for _, link := range p.pageLinks() {
+		numbers = append(numbers, link.Number)
+	}
+	if fmt.Sprint(numbers) != "[1 0 4 5 6 7 8 0 12]" {
+		t.Errorf("unexpected page links %v", numbers)
+	}
+}
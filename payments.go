@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A PaymentProvider charges the customers for their orders. Amounts are in
+// cents. The method is whatever the customer gave to pay with, such as a
+// card token, which only the provider understands
+type PaymentProvider interface {
+	// Charge takes the amount of an order, and returns the reference of the
+	// payment, which refunds need
+	Charge(ctx context.Context, orderID, amount int64, method string) (string, error)
+	Refund(ctx context.Context, reference string, amount int64) error
+}
+
+// ErrPaymentDeclined is returned by providers when the customer can't pay
+// with the method they gave. Other errors are failures of the provider
+var ErrPaymentDeclined = errors.New("payment declined")
+
+// Until a real provider is plugged in, orders are paid with the fake one
+var payments PaymentProvider = &fakePayments{}
+
+func InitPayments(p PaymentProvider) {
+	payments = p
+}
+
+// fakePayments accepts every payment without charging anything, except for
+// the methods starting with "decline", like the test cards of real
+// providers. It remembers the payments, so that refunds can be checked
+type fakePayments struct {
+	mu       sync.Mutex
+	last     int
+	payments map[string]int64
+}
+
+func (p *fakePayments) Charge(ctx context.Context, orderID, amount int64, method string) (string, error) {
+	if method == "" || strings.HasPrefix(method, "decline") {
+		return "", ErrPaymentDeclined
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.payments == nil {
+		p.payments = map[string]int64{}
+	}
+	p.last++
+	reference := "fake_" + strconv.Itoa(p.last) + "_order_" + strconv.FormatInt(orderID, 10)
+	p.payments[reference] = amount
+	return reference, nil
+}
+
+func (p *fakePayments) Refund(ctx context.Context, reference string, amount int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.payments[reference] < amount {
+		return errors.New("refund larger than the payment " + reference)
+	}
+	p.payments[reference] -= amount
+	return nil
+}
+
+// Balance returns what is left of a payment once refunded
+func (p *fakePayments) Balance(reference string) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.payments[reference]
+}
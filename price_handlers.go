@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// registerPriceRoutes adds the price history of the albums to `r`, and the
+// price alerts of the user of the API key
+func registerPriceRoutes(r *mux.Router) {
+	r.HandleFunc("/albums/{id:[0-9]+}/prices", getPriceHistoryHandler).Methods("GET")
+	r.Handle("/me/price-alerts", requireAPIKey(listPriceAlertsHandler)).Methods("GET")
+	r.Handle("/me/price-alerts", requireAPIKey(createPriceAlertHandler)).Methods("POST")
+	r.Handle("/me/price-alerts/{id:[0-9]+}", requireAPIKey(getPriceAlertHandler)).Methods("GET")
+	r.Handle("/me/price-alerts/{id:[0-9]+}", requireAPIKey(deletePriceAlertHandler)).Methods("DELETE")
+}
+
+// priceAlertURLv1 is where version 1 of the API serves the alert with this
+// ID
+func priceAlertURLv1(id int64) string {
+	return apiV1Prefix + "/me/price-alerts/" + strconv.FormatInt(id, 10)
+}
+
+// priceHistory is the response of `GET /albums/{id}/prices`
+type priceHistory struct {
+	AlbumID int64         `json:"albumId"`
+	Price   string        `json:"price"`
+	Prices  []PriceChange `json:"prices"`
+}
+
+// getPriceHistoryHandler lists the prices the album had, oldest first, with
+// the current one
+func getPriceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := albumID(w, r)
+	if !ok {
+		return
+	}
+	album, err := storeFor(r.Context()).GetAlbum(id)
+	if errors.Is(err, ErrAlbumNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "There is no album with this ID.")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	prices, err := priceStore.PriceHistory(id)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, priceHistory{AlbumID: id, Price: album.Price, Prices: prices})
+}
+
+// priceAlertRequest is the body of a request subscribing to the price drops
+// of an album
+type priceAlertRequest struct {
+	AlbumID     int64  `json:"albumId"`
+	TargetPrice string `json:"targetPrice"`
+}
+
+func (req *priceAlertRequest) Validate() []fieldError {
+	req.TargetPrice = strings.TrimSpace(req.TargetPrice)
+
+	var errs []fieldError
+	if req.AlbumID <= 0 {
+		errs = append(errs, fieldError{"albumId", "required", "is required"})
+	}
+	if req.TargetPrice == "" {
+		errs = append(errs, fieldError{"targetPrice", "required", "is required"})
+	} else if cents, ok := priceCents(req.TargetPrice); !ok {
+		errs = append(errs, fieldError{"targetPrice", "invalid_format", "must be a decimal amount such as 22.99"})
+	} else if cents == 0 {
+		errs = append(errs, fieldError{"targetPrice", "out_of_range", "must be more than 0"})
+	}
+	return errs
+}
+
+func listPriceAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := apiUser(r)
+	alerts, err := priceStore.ListPriceAlerts(user)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, alerts)
+}
+
+// createPriceAlertHandler subscribes the user to the price drops of an
+// album. Users have one alert per album, they delete it to change the target
+func createPriceAlertHandler(w http.ResponseWriter, r *http.Request) {
+	req := priceAlertRequest{}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if errs := req.Validate(); errs != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The alert has invalid fields.", errs...)
+		return
+	}
+
+	user, _ := apiUser(r)
+	alert := &PriceAlert{Owner: user, AlbumID: req.AlbumID, TargetPrice: req.TargetPrice}
+	err := priceStore.CreatePriceAlert(alert)
+	switch {
+	case errors.Is(err, ErrAlbumNotFound):
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The alert has invalid fields.",
+			fieldError{"albumId", "not_found", "must be the ID of an album"})
+	case errors.Is(err, ErrPriceAlertExists):
+		writeProblem(w, r, http.StatusConflict, "You already have an alert for this album.")
+	case err != nil:
+		writeServerError(w, r, err)
+	default:
+		w.Header().Set("Location", priceAlertURLv1(alert.ID))
+		writeJSON(w, r, http.StatusCreated, alert)
+	}
+}
+
+func getPriceAlertHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := apiUser(r)
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	alert, err := priceStore.GetPriceAlert(user, id)
+	if errors.Is(err, ErrPriceAlertNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "You have no alert with this ID.")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, alert)
+}
+
+func deletePriceAlertHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := apiUser(r)
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	err := priceStore.DeletePriceAlert(user, id)
+	if errors.Is(err, ErrPriceAlertNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "You have no alert with this ID.")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingNotifier hands the notifications over to the test. `expect`
+// takes any user when given none. `expectNone` waits for the notifications
+// in progress to be done first
+type recordingNotifier chan Notification
+
+func (n recordingNotifier) Notify(ctx context.Context, note Notification) error {
+	n <- note
+	return nil
+}
+
+func withRecordingNotifier(t *testing.T) recordingNotifier {
+	n := make(recordingNotifier, 10)
+	InitNotifier(n)
+	t.Cleanup(func() { InitNotifier(logNotifier{}) })
+	return n
+}
+
+func (n recordingNotifier) expect(t *testing.T, user string) Notification {
+	t.Helper()
+	select {
+	case note := <-n:
+		if user != "" && note.User != user {
+			t.Errorf("expected a notification for %s, got %+v", user, note)
+		}
+		return note
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s was not notified", user)
+	}
+	return Notification{}
+}
+
+func (n recordingNotifier) expectNone(t *testing.T) {
+	t.Helper()
+	backgroundWork.Wait()
+	select {
+	case note := <-n:
+		t.Errorf("unexpected notification %+v", note)
+	default:
+	}
+}
+
+// notifiedAt returns when an alert last went off, once the notifications in
+// progress are done
+func notifiedAt(t *testing.T, alert *PriceAlert) *time.Time {
+	t.Helper()
+	backgroundWork.Wait()
+	saved, err := priceStore.GetPriceAlert(alert.Owner, alert.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return saved.NotifiedAt
+}
+
+func setPrice(t *testing.T, album *Album, price string) {
+	t.Helper()
+	album.Price = price
+	if err := updateAlbum(context.Background(), album); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPriceHistory(t *testing.T) {
+	dark := &Album{Title: "The Dark Side of the Moon", Price: "25"}
+	catalogAlbums(t, dark)
+	setPrice(t, dark, "22.50")
+	dark.Genre = "Rock"
+	setPrice(t, dark, "22.50")
+	setPrice(t, dark, "")
+
+	response := callAPI("GET", fmt.Sprintf("/api/v1/albums/%d/prices", dark.ID), "", "")
+	history := priceHistory{}
+	if err := json.NewDecoder(response.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	prices := []string{}
+	for i, change := range history.Prices {
+		prices = append(prices, change.Price)
+		if i > 0 && change.ChangedAt.Before(history.Prices[i-1].ChangedAt) {
+			t.Errorf("expected the oldest prices first, got %v", history.Prices)
+		}
+	}
+	if actual := strings.Join(prices, ","); actual != "25,22.50," || history.Price != "" {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	response = callAPI("GET", fmt.Sprintf("/album/%d/prices", dark.ID), "", "")
+	if response.Code != http.StatusOK || response.Header().Get("Deprecation") == "" {
+		t.Errorf("expected the deprecated alias to work, got %d", response.Code)
+	}
+	if response := callAPI("GET", "/api/v1/albums/999999999/prices", "", ""); response.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown album, got %d", response.Code)
+	}
+
+	// The store tells which price the update replaced
+	dark.Price = "20"
+	if previous, err := store.UpdateAlbum(dark); err != nil || previous != "" {
+		t.Errorf("expected no previous price, got %q (%v)", previous, err)
+	}
+	if previous, err := store.UpdateAlbum(dark); err != nil || previous != "20" {
+		t.Errorf("expected 20 as the previous price, got %q (%v)", previous, err)
+	}
+	if _, err := store.UpdateAlbum(&Album{ID: 999999999, Title: "Nothing"}); !errors.Is(err, ErrAlbumNotFound) {
+		t.Errorf("expected ErrAlbumNotFound for an unknown album, got %v", err)
+	}
+}
+
+func TestPriceAlerts(t *testing.T) {
+	withListUsers(t)
+	notes := withRecordingNotifier(t)
+	dark := &Album{Title: "The Dark Side of the Moon", Price: "25"}
+	catalogAlbums(t, dark)
+
+	subscribe := func(key, target string) *PriceAlert {
+		response := callAPI("POST", "/api/v1/me/price-alerts", key, fmt.Sprintf(`{"albumId": %d, "targetPrice": %q}`, dark.ID, target))
+		if response.Code != http.StatusCreated {
+			t.Fatalf("creating the alert failed with %d: %s", response.Code, response.Body)
+		}
+		alert := &PriceAlert{}
+		if err := json.NewDecoder(response.Body).Decode(alert); err != nil {
+			t.Fatal(err)
+		}
+		return alert
+	}
+	alice := subscribe("alice-key-0123456", "20")
+	bob := subscribe("bob-key-0123456789", "15")
+
+	if response := callAPI("POST", "/api/v1/me/price-alerts", "alice-key-0123456", fmt.Sprintf(`{"albumId": %d, "targetPrice": "18"}`, dark.ID)); response.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a second alert on the album, got %d", response.Code)
+	}
+	if response := callAPI("GET", priceAlertURLv1(alice.ID), "bob-key-0123456789", ""); response.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for the alert of another user, got %d", response.Code)
+	}
+
+	setPrice(t, dark, "19.99")
+	note := notes.expect(t, "alice")
+	if !strings.Contains(note.Text, "dropped from 25 to 19.99") || note.Link != fmt.Sprintf("/albums/%d", dark.ID) {
+		t.Errorf("unexpected notification %+v", note)
+	}
+	notes.expectNone(t)
+
+	// The alert is marked once the notifier is done with it
+	first := notifiedAt(t, alice)
+	if first == nil || notifiedAt(t, bob) != nil {
+		t.Fatalf("expected only the alert of alice to be marked as notified")
+	}
+
+	// Only crossing the target counts
+	setPrice(t, dark, "18")
+	notes.expectNone(t)
+	setPrice(t, dark, "30")
+	notes.expectNone(t)
+	if marked := notifiedAt(t, alice); marked == nil || !marked.Equal(*first) || notifiedAt(t, bob) != nil {
+		t.Errorf("expected the alerts to stay as they were, got %v", marked)
+	}
+	setPrice(t, dark, "15")
+	notified := map[string]bool{notes.expect(t, "").User: true, notes.expect(t, "").User: true}
+	if !notified["alice"] || !notified["bob"] {
+		t.Errorf("expected both users to be notified, got %v", notified)
+	}
+	if marked := notifiedAt(t, alice); marked == nil || !marked.After(*first) || notifiedAt(t, bob) == nil {
+		t.Errorf("expected both alerts to be marked as notified again")
+	}
+	if response := callAPI("DELETE", priceAlertURLv1(alice.ID), "alice-key-0123456", ""); response.Code != http.StatusNoContent {
+		t.Errorf("deleting the alert failed with %d", response.Code)
+	}
+}
+
+func TestPriceAlertValidation(t *testing.T) {
+	req := priceAlertRequest{TargetPrice: "cheap"}
+	if errs := req.Validate(); len(errs) != 2 || errs[0].Field != "albumId" || errs[1].Code != "invalid_format" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	req = priceAlertRequest{AlbumID: 1, TargetPrice: " 0.00 "}
+	if errs := req.Validate(); len(errs) != 1 || errs[0].Code != "out_of_range" {
+		t.Errorf("expected a target of 0 to be refused, got %v", errs)
+	}
+}
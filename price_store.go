@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// PriceHistory returns the prices an album had, oldest first. Prices set
+// before the history was kept start when the history did
+func (store *dbStore) PriceHistory(albumID int64) ([]PriceChange, error) {
+	rows, err := store.query("SELECT price, changed_at FROM album_prices WHERE album_id = $1 ORDER BY id", albumID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := []PriceChange{}
+	for rows.Next() {
+		change := PriceChange{}
+		if err := rows.Scan(&change.Price, &change.ChangedAt); err != nil {
+			return nil, err
+		}
+		prices = append(prices, change)
+	}
+	return prices, rows.Err()
+}
+
+// CreatePriceAlert records an alert. It returns ErrAlbumNotFound if there is
+// no such album, and ErrPriceAlertExists if the user already has an alert
+// for it
+func (store *dbStore) CreatePriceAlert(alert *PriceAlert) error {
+	album, err := store.GetAlbum(alert.AlbumID)
+	if err != nil {
+		return err
+	}
+	var exists bool
+	if err := store.queryRow("SELECT COUNT(*) > 0 FROM price_alerts WHERE owner = $1 AND album_id = $2",
+		[]interface{}{alert.Owner, alert.AlbumID}, &exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrPriceAlertExists
+	}
+
+	alert.Album = album
+	alert.CreatedAt = time.Now().UTC()
+	res, err := store.exec("INSERT INTO price_alerts(owner, album_id, target_price, created_at) VALUES ($1,$2,$3,$4)",
+		alert.Owner, alert.AlbumID, alert.TargetPrice, alert.CreatedAt)
+	if err != nil {
+		return err
+	}
+	alert.ID, err = res.LastInsertId()
+	return err
+}
+
+// GetPriceAlert returns an alert of `owner`. The alerts of other users are
+// not found
+func (store *dbStore) GetPriceAlert(owner string, id int64) (*PriceAlert, error) {
+	alerts, err := store.queryPriceAlerts("WHERE p.owner = $1 AND p.id = $2", owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(alerts) == 0 {
+		return nil, ErrPriceAlertNotFound
+	}
+	return alerts[0], nil
+}
+
+// ListPriceAlerts returns the alerts of `owner`, by artist and title
+func (store *dbStore) ListPriceAlerts(owner string) ([]*PriceAlert, error) {
+	return store.queryPriceAlerts("WHERE p.owner = $1", owner)
+}
+
+// AlbumPriceAlerts returns the alerts of every user for an album
+func (store *dbStore) AlbumPriceAlerts(albumID int64) ([]*PriceAlert, error) {
+	return store.queryPriceAlerts("WHERE p.album_id = $1", albumID)
+}
+
+func (store *dbStore) queryPriceAlerts(where string, args ...interface{}) ([]*PriceAlert, error) {
+	rows, err := store.query(`SELECT p.id, p.owner, p.album_id, p.target_price, p.notified_at, p.created_at,
+		a.title, a.artist, COALESCE(a.price, ''), COALESCE(a.year, ''), COALESCE(a.genre, '')
+		FROM price_alerts p JOIN albums a ON a.idAlbum = p.album_id `+where+`
+		ORDER BY lower(a.artist), lower(a.title), p.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := []*PriceAlert{}
+	for rows.Next() {
+		alert := &PriceAlert{Album: &Album{}}
+		var notifiedAt sql.NullTime
+		if err := rows.Scan(&alert.ID, &alert.Owner, &alert.AlbumID, &alert.TargetPrice, &notifiedAt, &alert.CreatedAt,
+			&alert.Album.Title, &alert.Album.Artist, &alert.Album.Price, &alert.Album.Year, &alert.Album.Genre); err != nil {
+			return nil, err
+		}
+		if notifiedAt.Valid {
+			alert.NotifiedAt = &notifiedAt.Time
+		}
+		alert.Album.ID = alert.AlbumID
+		alerts = append(alerts, alert)
+	}
+	return alerts, rows.Err()
+}
+
+// MarkPriceAlertNotified records that the alert just went off
+func (store *dbStore) MarkPriceAlertNotified(alert *PriceAlert) error {
+	now := time.Now().UTC()
+	res, err := store.exec("UPDATE price_alerts SET notified_at = $1 WHERE id = $2", now, alert.ID)
+	if err != nil {
+		return err
+	}
+	if err := expectRow(res, ErrPriceAlertNotFound); err != nil {
+		return err
+	}
+	alert.NotifiedAt = &now
+	return nil
+}
+
+func (store *dbStore) DeletePriceAlert(owner string, id int64) error {
+	res, err := store.exec("DELETE FROM price_alerts WHERE owner = $1 AND id = $2", owner, id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res, ErrPriceAlertNotFound)
+}
+
+// createPriceTables creates the price history and the alerts. Albums that
+// already have a price start their history with it
+func createPriceTables(db *sql.DB) {
+	createPricesTableSQL := `CREATE TABLE IF NOT EXISTS album_prices (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"album_id" integer NOT NULL REFERENCES albums(idAlbum),
+		"price" TEXT NOT NULL,
+		"changed_at" DATETIME NOT NULL
+	  );`
+	createAlertsTableSQL := `CREATE TABLE IF NOT EXISTS price_alerts (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"owner" TEXT NOT NULL,
+		"album_id" integer NOT NULL REFERENCES albums(idAlbum),
+		"target_price" TEXT NOT NULL,
+		"notified_at" DATETIME,
+		"created_at" DATETIME NOT NULL,
+		UNIQUE (owner, album_id)
+	  );`
+	createIndexesSQL := []string{
+		`CREATE INDEX IF NOT EXISTS album_prices_album ON album_prices(album_id)`,
+		`CREATE INDEX IF NOT EXISTS price_alerts_album ON price_alerts(album_id)`,
+	}
+	startHistorySQL := `INSERT INTO album_prices(album_id, price, changed_at)
+		SELECT idAlbum, price, CURRENT_TIMESTAMP FROM albums
+		WHERE COALESCE(price, '') != '' AND idAlbum NOT IN (SELECT album_id FROM album_prices)`
+
+	for _, statement := range append(append([]string{createPricesTableSQL, createAlertsTableSQL}, createIndexesSQL...), startHistorySQL) {
+		if _, err := db.Exec(statement); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+}
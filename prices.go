@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// A PriceChange is a price an album had from `ChangedAt` on. The price is
+// empty when the album stopped having one
+type PriceChange struct {
+	Price     string    `json:"price"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+// A PriceAlert asks for a notification when the price of an album drops to
+// the target price or below
+type PriceAlert struct {
+	ID          int64  `json:"id"`
+	Owner       string `json:"owner"`
+	AlbumID     int64  `json:"albumId"`
+	Album       *Album `json:"album"`
+	TargetPrice string `json:"targetPrice"`
+	// NotifiedAt is the last time the alert went off, if it did
+	NotifiedAt *time.Time `json:"notifiedAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// The price store keeps the past prices of the albums, and the alerts of the
+// users. The album store records the price changes, since every change of an
+// album goes through it
+type PriceStore interface {
+	PriceHistory(albumID int64) ([]PriceChange, error)
+	CreatePriceAlert(alert *PriceAlert) error
+	GetPriceAlert(owner string, id int64) (*PriceAlert, error)
+	ListPriceAlerts(owner string) ([]*PriceAlert, error)
+	AlbumPriceAlerts(albumID int64) ([]*PriceAlert, error)
+	MarkPriceAlertNotified(alert *PriceAlert) error
+	DeletePriceAlert(owner string, id int64) error
+}
+
+var (
+	// ErrPriceAlertNotFound is returned when the user has no alert with the
+	// given ID
+	ErrPriceAlertNotFound = errors.New("price alert not found")
+	// ErrPriceAlertExists is returned when the user already has an alert for
+	// the album
+	ErrPriceAlertExists = errors.New("price alert already exists")
+)
+
+var priceStore PriceStore
+
+func InitPrices(s PriceStore) {
+	priceStore = s
+}
+
+// priceDropped tells whether a price change takes the price of an album
+// from above the target to the target or below. Albums that get a price
+// again count as dropping from no price at all. Further drops below the
+// target don't count, so that users aren't notified over and over
+func priceDropped(previous, current, target string) bool {
+	price, ok := priceCents(current)
+	targetCents, _ := priceCents(target)
+	if !ok || price > targetCents {
+		return false
+	}
+	old, hadPrice := priceCents(previous)
+	return !hadPrice || old > targetCents
+}
+
+// notifyPriceDrop notifies the users whose alerts the new price of an album
+// sets off. Notifying takes a while, so it is done in the background, which
+// the shutdown waits for, and errors are only logged
+func notifyPriceDrop(album *Album, previous string) {
+	if album.Price == previous {
+		return
+	}
+	copied := *album
+	alertStore, n := priceStore, notifier
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		alerts, err := alertStore.AlbumPriceAlerts(copied.ID)
+		if err != nil {
+			logger.Error("loading the price alerts failed", "album", copied.ID, "error", err)
+			return
+		}
+		for _, alert := range alerts {
+			if !priceDropped(previous, copied.Price, alert.TargetPrice) {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			err := n.Notify(ctx, priceDropNotification(alert, &copied, previous))
+			cancel()
+			if err == nil {
+				err = alertStore.MarkPriceAlertNotified(alert)
+			}
+			if err != nil {
+				logger.Error("notifying a price drop failed", "alert", alert.ID, "user", alert.Owner, "error", err)
+			}
+		}
+	}()
+}
+
+func priceDropNotification(alert *PriceAlert, album *Album, previous string) Notification {
+	text := fmt.Sprintf("%s by %s is now %s, at or below your target of %s.", album.Title, album.Artist, album.Price, alert.TargetPrice)
+	if previous != "" {
+		text = fmt.Sprintf("%s by %s dropped from %s to %s, at or below your target of %s.", album.Title, album.Artist, previous, album.Price, alert.TargetPrice)
+	}
+	return Notification{
+		User:    alert.Owner,
+		Subject: "Price drop: " + album.Title,
+		Text:    text,
+		Link:    "/albums/" + strconv.FormatInt(album.ID, 10),
+	}
+}
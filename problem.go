@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// A problem is the body of every error response, following RFC 7807
+// ("Problem Details for HTTP APIs"). Clients can rely on `status` and `title`
+// always being set, and on `errors` listing the offending fields when the
+// request did not pass validation
+type problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []fieldError `json:"errors,omitempty"`
+}
+
+// A fieldError explains why a single field of a request was rejected
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e fieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// writeProblem sends an `application/problem+json` response. We don't have
+// documentation pages for our error types, so `type` is left as "about:blank"
+// and the title is the standard text for the status code, as the RFC suggests
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string, errs ...fieldError) {
+	p := problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+		Errors:   errs,
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		// This can't really happen, since the problem only holds strings
+		loggerFrom(r.Context()).Error("encoding a problem failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// writeServerError logs the actual cause of an internal error and sends a
+// generic problem, so that database details never leak to the client
+func writeServerError(w http.ResponseWriter, r *http.Request, err error) {
+	loggerFrom(r.Context()).Error("request failed", "error", err)
+	writeProblem(w, r, http.StatusInternalServerError, "The server could not complete the request.")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A RateLimit describes a token bucket: clients may make `Burst` requests at
+// once, and the bucket refills at `Rate` requests per second
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Reads (GET and HEAD) and writes (everything else) get their own buckets, so
+// that a client hammering `POST /album` can still browse the catalog
+type RateLimitConfig struct {
+	Read  RateLimit
+	Write RateLimit
+}
+
+// The limits used by `newRouter`. They can be changed with `InitRateLimits`
+// before the router is created
+var rateLimits = RateLimitConfig{
+	Read:  RateLimit{Rate: 20, Burst: 40},
+	Write: RateLimit{Rate: 2, Burst: 10},
+}
+
+func InitRateLimits(cfg RateLimitConfig) {
+	rateLimits = cfg
+}
+
+// API keys that are allowed to identify a client, mapped to the name of the
+// user they belong to. Requests with an unknown key are treated as anonymous,
+// otherwise a client could dodge its limit by sending a new key every time
+var apiKeys = map[string]string{}
+
+func InitAPIKeys(keys map[string]string) {
+	apiKeys = keys
+}
+
+// apiUser returns the user owning the API key sent with the request, if any
+func apiUser(r *http.Request) (string, bool) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return "", false
+	}
+	user, ok := apiKeys[key]
+	return user, ok
+}
+
+// clientKey identifies who a request is counted against: the user behind a
+// known API key, or else the client IP address
+func clientKey(r *http.Request) string {
+	if user, ok := apiUser(r); ok {
+		return "user:" + user
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// The rateLimiter keeps one bucket per client and per class of route. All
+// buckets are guarded by a single mutex, since each operation on them is tiny
+type rateLimiter struct {
+	mu        sync.Mutex
+	cfg       RateLimitConfig
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		cfg:       cfg,
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// take removes a token from the bucket of `key`. It returns whether the
+// request is allowed, the number of tokens left, and how long the client has
+// to wait for the next token
+func (l *rateLimiter) take(key string, limit RateLimit) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	// Refill the bucket for the time that passed since the last request
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+		return false, 0, wait
+	}
+	b.tokens--
+	wait := time.Duration((float64(limit.Burst) - b.tokens) / limit.Rate * float64(time.Second))
+	return true, int(b.tokens), wait
+}
+
+// sweep forgets the buckets that have refilled completely. They are no
+// different from a new bucket, and keeping them would make the map grow with
+// every client that ever made a request
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > l.refillTime() {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// refillTime is the longest time any bucket needs to go from empty to full
+func (l *rateLimiter) refillTime() time.Duration {
+	longest := time.Duration(0)
+	for _, limit := range []RateLimit{l.cfg.Read, l.cfg.Write} {
+		if limit.Rate <= 0 {
+			continue
+		}
+		if d := time.Duration(float64(limit.Burst) / limit.Rate * float64(time.Second)); d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+func (l *rateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, class := l.cfg.Write, "write"
+		// CORS preflights come before every write from a browser, they
+		// can't count against the write limit
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			limit, class = l.cfg.Read, "read"
+		}
+		// A zero rate turns the limit off for this class of routes
+		if limit.Rate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, remaining, wait := l.take(class+"|"+clientKey(r), limit)
+
+		// The headers follow the IETF "RateLimit header fields" draft
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(wait)))
+
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+			writeProblem(w, r, http.StatusTooManyRequests, "Too many requests, try again in "+strconv.Itoa(ceilSeconds(wait))+" seconds.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRejectsAfterBurst(t *testing.T) {
+	limiter := newRateLimiter(RateLimitConfig{
+		Read:  RateLimit{Rate: 1, Burst: 2},
+		Write: RateLimit{Rate: 1, Burst: 1},
+	})
+	// Freeze the clock so that the buckets never refill during the test
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	hf := limiter.Middleware(http.HandlerFunc(handler))
+
+	// The first two reads fit in the burst, the third one does not
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/hello", nil)
+		recorder := httptest.NewRecorder()
+		hf.ServeHTTP(recorder, req)
+
+		if recorder.Code != expected {
+			t.Errorf("request %d: got status %d want %d", i, recorder.Code, expected)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/hello", nil)
+	recorder := httptest.NewRecorder()
+	hf.ServeHTTP(recorder, req)
+	if retry := recorder.Header().Get("Retry-After"); retry != "1" {
+		t.Errorf("Retry-After should be 1, got %q", retry)
+	}
+	if limit := recorder.Header().Get("RateLimit-Limit"); limit != "2" {
+		t.Errorf("RateLimit-Limit should be 2, got %q", limit)
+	}
+
+	// Writes have their own bucket, so they are not affected by the reads
+	req = httptest.NewRequest("POST", "/album", nil)
+	recorder = httptest.NewRecorder()
+	hf.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("write should be allowed, got status %d", recorder.Code)
+	}
+
+	// Once a second has passed, the read bucket has a token again
+	now = now.Add(time.Second)
+	req = httptest.NewRequest("GET", "/hello", nil)
+	recorder = httptest.NewRecorder()
+	hf.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("read should be allowed after refill, got status %d", recorder.Code)
+	}
+}
+
+func TestRateLimiterKeysByAPIKey(t *testing.T) {
+	InitAPIKeys(map[string]string{"secret": "idil"})
+	defer InitAPIKeys(map[string]string{})
+
+	limiter := newRateLimiter(RateLimitConfig{Read: RateLimit{Rate: 1, Burst: 1}})
+	hf := limiter.Middleware(http.HandlerFunc(handler))
+
+	// Two different clients behind the same key share a bucket
+	for i, addr := range []string{"10.0.0.1:1234", "10.0.0.2:1234"} {
+		req := httptest.NewRequest("GET", "/hello", nil)
+		req.RemoteAddr = addr
+		req.Header.Set("X-API-Key", "secret")
+		recorder := httptest.NewRecorder()
+		hf.ServeHTTP(recorder, req)
+
+		if i == 1 && recorder.Code != http.StatusTooManyRequests {
+			t.Errorf("second request with the same key should be limited, got %d", recorder.Code)
+		}
+	}
+
+	// An unknown key falls back to the client IP, which still has a token
+	req := httptest.NewRequest("GET", "/hello", nil)
+	req.RemoteAddr = "10.0.0.3:1234"
+	req.Header.Set("X-API-Key", "made-up")
+	recorder := httptest.NewRecorder()
+	hf.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("unknown key should be limited by IP, got %d", recorder.Code)
+	}
+}
+
+func TestRateLimiterConcurrentRequests(t *testing.T) {
+	limiter := newRateLimiter(RateLimitConfig{Write: RateLimit{Rate: 0.001, Burst: 50}})
+	hf := limiter.Middleware(http.HandlerFunc(handler))
+
+	var mu sync.Mutex
+	allowed := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recorder := httptest.NewRecorder()
+			hf.ServeHTTP(recorder, httptest.NewRequest("POST", "/album", nil))
+			if recorder.Code == http.StatusOK {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Exactly the burst must get through, no matter how the requests interleave
+	if allowed != 50 {
+		t.Errorf("expected 50 requests to be allowed, got %d", allowed)
+	}
+}
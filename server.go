@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The limits of the HTTP server. Slow clients can't hold connections open
+// forever, and headers can't be used to exhaust the memory
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 15 * time.Second
+	// Event streams push the deadline forward before every write, see
+	// `albumEventsHandler`
+	writeTimeout   = 30 * time.Second
+	idleTimeout    = 120 * time.Second
+	maxHeaderBytes = 64 << 10
+)
+
+const (
+	// Once asked to stop, the server keeps serving for this long while
+	// reporting that it isn't ready, so that the load balancer stops
+	// sending new requests before the listener closes
+	drainDelay = 5 * time.Second
+	// Requests still running after this are cut off
+	shutdownTimeout = 20 * time.Second
+)
+
+// shuttingDown is closed when the server starts shutting down. The server
+// waits for every request, so handlers that stream their response stop
+// when it is closed
+var (
+	shuttingDown = make(chan struct{})
+	shutdownOnce sync.Once
+)
+
+// backgroundWork tracks the work requests leave running once answered, such
+// as notifications. The shutdown waits for it like for the requests
+var backgroundWork sync.WaitGroup
+
+func beginShutdown() {
+	shutdownOnce.Do(func() { close(shuttingDown) })
+}
+
+// isShuttingDown reports whether the server started shutting down
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+}
+
+// serve runs the servers until one of them fails or the process gets
+// SIGINT or SIGTERM. In the latter case, the requests in progress are given
+// some time to finish, and the error is nil. Servers with a TLS
+// configuration serve HTTPS with its certificates
+func serve(servers ...*http.Server) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	failed := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if srv.TLSConfig != nil {
+				failed <- srv.ListenAndServeTLS("", "")
+			} else {
+				failed <- srv.ListenAndServe()
+			}
+		}(srv)
+	}
+
+	select {
+	case err := <-failed:
+		// Don't leave the other servers running
+		for _, srv := range servers {
+			srv.Close()
+		}
+		return err
+	case sig := <-stop:
+		logger.Info("shutting down", "signal", sig.String(), "drain", drainDelay.String())
+	}
+	return shutdown(drainDelay, shutdownTimeout, servers...)
+}
+
+// shutdown stops the servers gracefully: it fails the readiness checks for
+// `drain`, then stops accepting connections and waits for the requests in
+// progress and their background work, for at most `timeout`
+func shutdown(drain, timeout time.Duration, servers ...*http.Server) error {
+	beginShutdown()
+	time.Sleep(drain)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			err := srv.Shutdown(ctx)
+			if errors.Is(err, context.DeadlineExceeded) {
+				logger.Warn("requests were cut off", "addr", srv.Addr, "timeout", timeout.String())
+				srv.Close()
+			}
+			errs <- err
+		}(srv)
+	}
+	var err error
+	for range servers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		backgroundWork.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Warn("background work was cut off", "timeout", timeout.String())
+	}
+	return err
+}
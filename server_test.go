@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	// Shutting down is for good, the next tests need a server that runs
+	defer func() {
+		shuttingDown = make(chan struct{})
+		shutdownOnce = sync.Once{}
+	}()
+
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	mux.HandleFunc("/events", albumEventsHandler)
+
+	srv := newServer("", mux)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(listener)
+	base := "http://" + listener.Addr().String()
+
+	// An event stream is open, and a request is in progress
+	stream, err := http.Get(base + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	// The first line is the retry interval, so the stream is being served
+	if _, err := bufio.NewReader(stream.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+	<-started
+
+	// So should the work a request left running
+	background := make(chan struct{})
+	backgroundWork.Add(1)
+	go func() {
+		defer backgroundWork.Done()
+		time.Sleep(100 * time.Millisecond)
+		close(background)
+	}()
+
+	if err := shutdown(0, 5*time.Second, srv); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if body := <-slow; body != "done" {
+		t.Errorf("the request in progress should have finished, got %q", body)
+	}
+	select {
+	case <-background:
+	default:
+		t.Errorf("the shutdown should wait for the background work")
+	}
+	if _, err := http.Get(base + "/slow"); err == nil {
+		t.Errorf("the server should not accept new requests")
+	}
+	if err := notShuttingDown(context.Background()); err == nil {
+		t.Errorf("readiness should fail once shutting down")
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	srv := newServer(":8080", http.NotFoundHandler())
+	if srv.ReadHeaderTimeout == 0 || srv.ReadTimeout == 0 || srv.WriteTimeout == 0 || srv.IdleTimeout == 0 || srv.MaxHeaderBytes == 0 {
+		t.Errorf("every timeout and limit should be set, got %+v", srv)
+	}
+}
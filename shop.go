@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The shop sells the albums that have a price and are in stock. Visitors
+// fill a cart, which belongs to their session, and check it out as the user
+// of their API key
+
+// A CartItem is an album in a cart, with the stock left for it
+type CartItem struct {
+	AlbumID  int64  `json:"albumId"`
+	Album    *Album `json:"album"`
+	Quantity int    `json:"quantity"`
+	InStock  int    `json:"inStock"`
+}
+
+// An Order is a checked out cart. Its items keep the album as it was sold,
+// whatever happens to the album afterwards
+type Order struct {
+	ID     int64       `json:"id"`
+	Owner  string      `json:"owner"`
+	Status string      `json:"status"`
+	Items  []OrderItem `json:"items"`
+	// Total is in cents, and formatted as a price in JSON
+	Total            int64     `json:"-"`
+	PaymentReference string    `json:"paymentReference,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+}
+
+type OrderItem struct {
+	AlbumID   int64  `json:"albumId"`
+	Title     string `json:"title"`
+	Artist    string `json:"artist"`
+	UnitPrice int64  `json:"-"`
+	Quantity  int    `json:"quantity"`
+}
+
+// The statuses of an order. Orders are pending while they are paid, and
+// refunding while paid orders are cancelled. Their albums are reserved until
+// they are cancelled
+const (
+	orderPending   = "pending"
+	orderPaid      = "paid"
+	orderRefunding = "refunding"
+	orderShipped   = "shipped"
+	orderDelivered = "delivered"
+	orderCancelled = "cancelled"
+)
+
+// orderTransitions are the statuses an order can be moved to from each
+// status. Refunding is only gone through by `changeOrderStatus`
+var orderTransitions = map[string][]string{
+	orderPending: {orderPaid, orderCancelled},
+	orderPaid:    {orderShipped, orderCancelled},
+	orderShipped: {orderDelivered},
+}
+
+func canTransition(from, to string) bool {
+	for _, status := range orderTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// The shop store keeps the stock of the albums, the carts and the orders
+type ShopStore interface {
+	GetStock(albumID int64) (int, error)
+	SetStock(albumID int64, quantity int) error
+	GetCart(session string) ([]CartItem, error)
+	SetCartItem(session string, albumID int64, quantity int) error
+	ClearCart(session string) error
+	CreateOrder(session string, order *Order) error
+	GetOrder(id int64) (*Order, error)
+	ListOrders(owner string) ([]*Order, error)
+	UpdateOrderStatus(order *Order, from, to string) error
+}
+
+var (
+	// ErrOrderNotFound is returned when no order has the given ID
+	ErrOrderNotFound = errors.New("order not found")
+	// ErrOrderStatusChanged is returned when the status of an order changed
+	// since it was read, so that two changes can't both succeed
+	ErrOrderStatusChanged = errors.New("order status changed")
+	// ErrInvalidTransition is returned when an order can't go to a status
+	// from its current one
+	ErrInvalidTransition = errors.New("invalid order status transition")
+	// ErrEmptyCart is returned when checking out a cart without albums
+	ErrEmptyCart = errors.New("empty cart")
+	// ErrAlbumNotForSale is returned for albums without a price
+	ErrAlbumNotForSale = errors.New("album not for sale")
+)
+
+// An OutOfStockError tells which albums of an order are missing, and how
+// many of them are left
+type OutOfStockError struct {
+	Items []CartItem
+}
+
+func (e *OutOfStockError) Error() string {
+	missing := []string{}
+	for _, item := range e.Items {
+		missing = append(missing, fmt.Sprintf("%d of album %d, %d left", item.Quantity, item.AlbumID, item.InStock))
+	}
+	return "out of stock: " + strings.Join(missing, ", ")
+}
+
+var shopStore ShopStore
+
+func InitShop(s ShopStore) {
+	shopStore = s
+}
+
+// staffUsers are the users of API keys who manage the stock and the orders
+var staffUsers = map[string]bool{}
+
+func InitStaff(users []string) {
+	staffUsers = map[string]bool{}
+	for _, user := range users {
+		staffUsers[user] = true
+	}
+}
+
+// orderTotal adds up the items of an order, in cents
+func orderTotal(items []OrderItem) int64 {
+	var total int64
+	for _, item := range items {
+		total += item.UnitPrice * int64(item.Quantity)
+	}
+	return total
+}
+
+// checkout turns the cart of a session into an order of `owner`, and has it
+// paid with `method`. The albums are reserved before the payment, so that
+// nobody else buys them meanwhile, and put back in stock if the payment is
+// declined. Declined orders are returned cancelled, with ErrPaymentDeclined.
+// Orders cancelled while they are paid are refunded, and returned cancelled
+// with ErrOrderStatusChanged
+func checkout(ctx context.Context, session, owner, method string) (*Order, error) {
+	cart, err := shopStore.GetCart(session)
+	if err != nil {
+		return nil, err
+	}
+	if len(cart) == 0 {
+		return nil, ErrEmptyCart
+	}
+
+	order := &Order{Owner: owner, Status: orderPending}
+	for _, item := range cart {
+		price, ok := priceCents(item.Album.Price)
+		if !ok {
+			return nil, fmt.Errorf("album %d has no price: %w", item.AlbumID, ErrAlbumNotForSale)
+		}
+		order.Items = append(order.Items, OrderItem{
+			AlbumID:   item.AlbumID,
+			Title:     item.Album.Title,
+			Artist:    item.Album.Artist,
+			UnitPrice: price,
+			Quantity:  item.Quantity,
+		})
+	}
+	order.Total = orderTotal(order.Items)
+	if err := shopStore.CreateOrder(session, order); err != nil {
+		return nil, err
+	}
+
+	reference, err := payments.Charge(ctx, order.ID, order.Total, method)
+	if err != nil {
+		if cancelErr := cancelPendingOrder(order); cancelErr != nil {
+			return nil, cancelErr
+		}
+		return order, err
+	}
+	order.PaymentReference = reference
+	if err := shopStore.UpdateOrderStatus(order, orderPending, orderPaid); err != nil {
+		// Whether the customer cancelled the order meanwhile or it can't be
+		// saved as paid, they don't get the albums, so they get their money back
+		if refundErr := payments.Refund(ctx, reference, order.Total); refundErr != nil {
+			return nil, fmt.Errorf("%v, and refunding %s failed: %w", err, reference, refundErr)
+		}
+		if cancelErr := cancelPendingOrder(order); cancelErr != nil {
+			return nil, cancelErr
+		}
+		return order, err
+	}
+	return order, nil
+}
+
+// cancelPendingOrder cancels an order checkout couldn't get paid. The
+// customer may have cancelled it already
+func cancelPendingOrder(order *Order) error {
+	err := shopStore.UpdateOrderStatus(order, orderPending, orderCancelled)
+	if errors.Is(err, ErrOrderStatusChanged) {
+		order.Status, err = orderCancelled, nil
+	}
+	return err
+}
+
+// changeOrderStatus moves an order to another status. Paid orders go through
+// refunding when cancelled, so that only the request which got them there
+// refunds them, and go back to paid if the refund fails. The order keeps its
+// status when the change fails
+func changeOrderStatus(ctx context.Context, order *Order, status string) error {
+	from := order.Status
+	if !canTransition(from, status) {
+		return fmt.Errorf("%w from %s to %s", ErrInvalidTransition, from, status)
+	}
+	if from != orderPaid || status != orderCancelled {
+		return shopStore.UpdateOrderStatus(order, from, status)
+	}
+
+	if err := shopStore.UpdateOrderStatus(order, orderPaid, orderRefunding); err != nil {
+		return err
+	}
+	if err := payments.Refund(ctx, order.PaymentReference, order.Total); err != nil {
+		if rollbackErr := shopStore.UpdateOrderStatus(order, orderRefunding, orderPaid); rollbackErr != nil {
+			return fmt.Errorf("%v, and the order stays %s: %w", err, orderRefunding, rollbackErr)
+		}
+		return err
+	}
+	return shopStore.UpdateOrderStatus(order, orderRefunding, orderCancelled)
+}
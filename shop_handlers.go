@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// cartCookie identifies the session a cart belongs to. It is set the first
+// time an album is put in the cart
+const cartCookie = "cart"
+
+// Carts are forgotten by the browser after this long without changes
+const cartMaxAge = 30 * 24 * time.Hour
+
+// Nobody buys more copies of an album at once
+const maxCartQuantity = 99
+
+// registerShopRoutes adds the routes of the shop to `r`. Carts need no API
+// key, but orders belong to the user of one, and only the staff manages the
+// stock and ships the orders
+func registerShopRoutes(r *mux.Router) {
+	r.HandleFunc("/albums/{id:[0-9]+}/stock", getStockHandler).Methods("GET")
+	r.Handle("/albums/{id:[0-9]+}/stock", requireStaff(setStockHandler)).Methods("PUT")
+	r.HandleFunc("/cart", getCartHandler).Methods("GET")
+	r.HandleFunc("/cart", clearCartHandler).Methods("DELETE")
+	r.HandleFunc("/cart/items/{album:[0-9]+}", setCartItemHandler).Methods("PUT")
+	r.HandleFunc("/cart/items/{album:[0-9]+}", removeCartItemHandler).Methods("DELETE")
+	r.Handle("/orders", requireAPIKey(checkoutHandler)).Methods("POST")
+	r.Handle("/orders", requireAPIKey(listOrdersHandler)).Methods("GET")
+	r.Handle("/orders/{id:[0-9]+}", requireAPIKey(getOrderHandler)).Methods("GET")
+	r.Handle("/orders/{id:[0-9]+}/status", requireAPIKey(orderStatusHandler)).Methods("PUT")
+}
+
+// requireStaff refuses requests that don't carry the API key of a member of
+// the staff
+func requireStaff(next http.HandlerFunc) http.Handler {
+	return requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
+		if user, _ := apiUser(r); !staffUsers[user] {
+			writeProblem(w, r, http.StatusForbidden, "Only the staff can do this.")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// orderURLv1 is where version 1 of the API serves the order with this ID
+func orderURLv1(id int64) string {
+	return apiV1Prefix + "/orders/" + strconv.FormatInt(id, 10)
+}
+
+// MarshalJSON formats the amounts of the order as prices
+func (order Order) MarshalJSON() ([]byte, error) {
+	type plain Order
+	return json.Marshal(struct {
+		plain
+		Total string `json:"total"`
+	}{plain(order), formatCents(order.Total)})
+}
+
+func (item OrderItem) MarshalJSON() ([]byte, error) {
+	type plain OrderItem
+	return json.Marshal(struct {
+		plain
+		UnitPrice string `json:"unitPrice"`
+	}{plain(item), formatCents(item.UnitPrice)})
+}
+
+// cartSession returns the session of the cart cookie. A new session is
+// started if there is none and `start` is set, otherwise it returns false
+func cartSession(w http.ResponseWriter, r *http.Request, start bool) (string, bool) {
+	if cookie, err := r.Cookie(cartCookie); err == nil {
+		if _, err := hex.DecodeString(cookie.Value); err == nil && len(cookie.Value) == 32 {
+			return cookie.Value, true
+		}
+	}
+	if !start {
+		return "", false
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", false
+	}
+	session := hex.EncodeToString(token)
+	http.SetCookie(w, &http.Cookie{
+		Name:     cartCookie,
+		Value:    session,
+		Path:     "/",
+		MaxAge:   int(cartMaxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return session, true
+}
+
+// cart is the response of `GET /cart`
+type cart struct {
+	Items []CartItem `json:"items"`
+	Total string     `json:"total"`
+}
+
+func writeCart(w http.ResponseWriter, r *http.Request, session string) {
+	items := []CartItem{}
+	if session != "" {
+		var err error
+		if items, err = shopStore.GetCart(session); err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+	var total int64
+	for _, item := range items {
+		price, _ := priceCents(item.Album.Price)
+		total += price * int64(item.Quantity)
+	}
+	writeJSON(w, r, http.StatusOK, cart{Items: items, Total: formatCents(total)})
+}
+
+func getCartHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := cartSession(w, r, false)
+	writeCart(w, r, session)
+}
+
+func clearCartHandler(w http.ResponseWriter, r *http.Request) {
+	if session, ok := cartSession(w, r, false); ok {
+		if err := shopStore.ClearCart(session); err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cartItemRequest is the body of a request putting an album in the cart
+type cartItemRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+// setCartItemHandler sets how many copies of an album are in the cart. The
+// stock is only checked when checking out, since it may change meanwhile
+func setCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	req := cartItemRequest{}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if req.Quantity < 0 || req.Quantity > maxCartQuantity {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The item has invalid fields.",
+			fieldError{"quantity", "out_of_range", "must be between 0 and " + strconv.Itoa(maxCartQuantity)})
+		return
+	}
+
+	albumID, _ := strconv.ParseInt(mux.Vars(r)["album"], 10, 64)
+	album, err := storeFor(r.Context()).GetAlbum(albumID)
+	if errors.Is(err, ErrAlbumNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "There is no album with this ID.")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if _, ok := priceCents(album.Price); !ok {
+		writeProblem(w, r, http.StatusConflict, "This album has no price, it can't be bought.")
+		return
+	}
+
+	session, ok := cartSession(w, r, true)
+	if !ok {
+		writeServerError(w, r, errors.New("no cart session could be started"))
+		return
+	}
+	if err := shopStore.SetCartItem(session, albumID, req.Quantity); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeCart(w, r, session)
+}
+
+func removeCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := cartSession(w, r, false)
+	if ok {
+		albumID, _ := strconv.ParseInt(mux.Vars(r)["album"], 10, 64)
+		if err := shopStore.SetCartItem(session, albumID, 0); err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+	writeCart(w, r, session)
+}
+
+// stock is the body of the stock routes
+type stock struct {
+	AlbumID  int64 `json:"albumId"`
+	Quantity int   `json:"quantity"`
+}
+
+func getStockHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := albumID(w, r)
+	if !ok {
+		return
+	}
+	quantity, err := shopStore.GetStock(id)
+	if errors.Is(err, ErrAlbumNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "There is no album with this ID.")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, stock{AlbumID: id, Quantity: quantity})
+}
+
+func setStockHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := albumID(w, r)
+	if !ok {
+		return
+	}
+	req := stock{}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if req.Quantity < 0 {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The stock has invalid fields.",
+			fieldError{"quantity", "out_of_range", "can't be negative"})
+		return
+	}
+
+	err := shopStore.SetStock(id, req.Quantity)
+	if errors.Is(err, ErrAlbumNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "There is no album with this ID.")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, stock{AlbumID: id, Quantity: req.Quantity})
+}
+
+// checkoutRequest is the body of a request checking out the cart
+type checkoutRequest struct {
+	PaymentMethod string `json:"paymentMethod"`
+}
+
+// checkoutHandler orders the albums of the cart of the session, for the user
+// of the API key, and has them paid
+func checkoutHandler(w http.ResponseWriter, r *http.Request) {
+	req := checkoutRequest{}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if req.PaymentMethod == "" {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The order has invalid fields.",
+			fieldError{"paymentMethod", "required", "is required"})
+		return
+	}
+
+	session, _ := cartSession(w, r, false)
+	user, _ := apiUser(r)
+	order, err := checkout(r.Context(), session, user, req.PaymentMethod)
+
+	var outOfStock *OutOfStockError
+	switch {
+	case errors.Is(err, ErrEmptyCart):
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The cart is empty.")
+	case errors.As(err, &outOfStock):
+		errs := []fieldError{}
+		for _, item := range outOfStock.Items {
+			errs = append(errs, fieldError{"items", "out_of_stock", fmt.Sprintf("album %d: %d wanted, %d left", item.AlbumID, item.Quantity, item.InStock)})
+		}
+		writeProblem(w, r, http.StatusConflict, "Some albums of the cart are out of stock.", errs...)
+	case errors.Is(err, ErrAlbumNotForSale):
+		writeProblem(w, r, http.StatusConflict, "Some albums of the cart can't be bought anymore: "+err.Error())
+	case errors.Is(err, ErrPaymentDeclined):
+		w.Header().Set("Location", orderURLv1(order.ID))
+		writeProblem(w, r, http.StatusPaymentRequired, "The payment was declined, the order is cancelled.")
+	case errors.Is(err, ErrOrderStatusChanged):
+		w.Header().Set("Location", orderURLv1(order.ID))
+		writeProblem(w, r, http.StatusConflict, "The order was cancelled during the payment, which is refunded.")
+	case err != nil:
+		writeServerError(w, r, err)
+	default:
+		w.Header().Set("Location", orderURLv1(order.ID))
+		writeJSON(w, r, http.StatusCreated, order)
+	}
+}
+
+// listOrdersHandler lists the orders of the user, newest first
+func listOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := apiUser(r)
+	orders, err := shopStore.ListOrders(user)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, orders)
+}
+
+func getOrderHandler(w http.ResponseWriter, r *http.Request) {
+	order, ok := findOrder(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, order)
+}
+
+// orderStatusRequest is the body of a request changing the status of an
+// order
+type orderStatusRequest struct {
+	Status string `json:"status"`
+}
+
+// orderStatusHandler moves an order to another status. Customers can only
+// cancel their orders, the staff ships them. Payments are never made this
+// way
+func orderStatusHandler(w http.ResponseWriter, r *http.Request) {
+	order, ok := findOrder(w, r)
+	if !ok {
+		return
+	}
+	req := orderStatusRequest{}
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	user, _ := apiUser(r)
+	if req.Status == orderPaid || (req.Status != orderCancelled && !staffUsers[user]) {
+		writeProblem(w, r, http.StatusForbidden, "Only the staff can move an order to "+req.Status+".")
+		return
+	}
+
+	err := changeOrderStatus(r.Context(), order, req.Status)
+	switch {
+	case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrOrderStatusChanged):
+		writeProblem(w, r, http.StatusConflict, "The order can't go from "+order.Status+" to "+req.Status+".")
+	case err != nil:
+		writeServerError(w, r, err)
+	default:
+		writeJSON(w, r, http.StatusOK, order)
+	}
+}
+
+// findOrder loads the order of the route, or answers with an error. The
+// orders of other users don't exist as far as customers know, the staff sees
+// them all
+func findOrder(w http.ResponseWriter, r *http.Request) (*Order, bool) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	order, err := shopStore.GetOrder(id)
+	user, _ := apiUser(r)
+	if errors.Is(err, ErrOrderNotFound) || (err == nil && order.Owner != user && !staffUsers[user]) {
+		writeProblem(w, r, http.StatusNotFound, "There is no order with this ID.")
+		return nil, false
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return nil, false
+	}
+	return order, true
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// callShop sends a JSON request to the router within the cart session of
+// `cookie`, if any
+func callShop(method, path, key, cookie, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: cartCookie, Value: cookie})
+	}
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, req)
+	return recorder
+}
+
+// withShopStaff makes bob a member of the staff
+func withShopStaff(t *testing.T) {
+	withListUsers(t)
+	InitStaff([]string{"bob"})
+	t.Cleanup(func() { InitStaff(nil) })
+}
+
+func stockAlbum(t *testing.T, album *Album, quantity int) {
+	if err := shopStore.SetStock(album.ID, quantity); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func decodeOrder(t *testing.T, response *httptest.ResponseRecorder) *Order {
+	order := &Order{}
+	if err := json.NewDecoder(response.Body).Decode(order); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func TestCheckout(t *testing.T) {
+	withShopStaff(t)
+	dark, wish, free := &Album{Title: "The Dark Side of the Moon", Price: "20.75"}, &Album{Title: "Wish You Were Here", Price: "15"}, &Album{Title: "Animals"}
+	catalogAlbums(t, dark, wish, free)
+	stockAlbum(t, dark, 3)
+	stockAlbum(t, wish, 1)
+
+	response := callShop("PUT", fmt.Sprintf("/api/v1/cart/items/%d", dark.ID), "", "", `{"quantity": 2}`)
+	if response.Code != http.StatusOK {
+		t.Fatalf("adding to the cart failed with %d: %s", response.Code, response.Body)
+	}
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != cartCookie || !cookies[0].HttpOnly {
+		t.Fatalf("expected a cart cookie, got %v", cookies)
+	}
+	session := cookies[0].Value
+
+	callShop("PUT", fmt.Sprintf("/api/v1/cart/items/%d", wish.ID), "", session, `{"quantity": 1}`)
+	if response := callShop("PUT", fmt.Sprintf("/api/v1/cart/items/%d", free.ID), "", session, `{"quantity": 1}`); response.Code != http.StatusConflict {
+		t.Errorf("expected 409 for an album without a price, got %d", response.Code)
+	}
+	if response := callShop("PUT", fmt.Sprintf("/api/v1/cart/items/%d", wish.ID), "", session, `{"quantity": 100}`); response.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for too many copies, got %d", response.Code)
+	}
+	response = callShop("GET", "/api/v1/cart", "", session, "")
+	if body := response.Body.String(); !strings.Contains(body, `"total":"56.50"`) || !strings.Contains(body, `"inStock":3`) {
+		t.Errorf("unexpected cart %s", body)
+	}
+
+	if response := callShop("POST", "/api/v1/orders", "", session, `{"paymentMethod": "card"}`); response.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without an API key, got %d", response.Code)
+	}
+	response = callShop("POST", "/api/v1/orders", "alice-key-0123456", session, `{"paymentMethod": "card"}`)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("checking out failed with %d: %s", response.Code, response.Body)
+	}
+	if body := response.Body.String(); !strings.Contains(body, `"total":"56.50"`) || !strings.Contains(body, `"unitPrice":"20.75"`) {
+		t.Errorf("unexpected amounts in %s", body)
+	}
+	order := decodeOrder(t, response)
+	if order.Status != orderPaid || len(order.Items) != 2 || order.PaymentReference == "" ||
+		response.Header().Get("Location") != orderURLv1(order.ID) {
+		t.Errorf("unexpected order %+v", order)
+	}
+	if quantity, _ := shopStore.GetStock(dark.ID); quantity != 1 {
+		t.Errorf("expected 1 copy left, got %d", quantity)
+	}
+	if response := callShop("GET", "/api/v1/cart", "", session, ""); !strings.Contains(response.Body.String(), `"items":[]`) {
+		t.Errorf("expected the cart to be emptied, got %s", response.Body)
+	}
+	if response := callShop("POST", "/api/v1/orders", "alice-key-0123456", session, `{"paymentMethod": "card"}`); response.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for an empty cart, got %d", response.Code)
+	}
+
+	// Only the stock left can be ordered
+	callShop("PUT", fmt.Sprintf("/api/v1/cart/items/%d", dark.ID), "", session, `{"quantity": 2}`)
+	response = callShop("POST", "/api/v1/orders", "alice-key-0123456", session, `{"paymentMethod": "card"}`)
+	if response.Code != http.StatusConflict || !strings.Contains(response.Body.String(), `"out_of_stock"`) {
+		t.Errorf("expected 409 out of stock, got %d: %s", response.Code, response.Body)
+	}
+	if quantity, _ := shopStore.GetStock(dark.ID); quantity != 1 {
+		t.Errorf("expected the stock to be left alone, got %d", quantity)
+	}
+
+	// The orders of a user are private, except to the staff
+	path := orderURLv1(order.ID)
+	for key, expected := range map[string]int{"alice-key-0123456": http.StatusOK, "bob-key-0123456789": http.StatusOK} {
+		if response := callShop("GET", path, key, "", ""); response.Code != expected {
+			t.Errorf("%s: expected %d, got %d", key, expected, response.Code)
+		}
+	}
+	InitStaff(nil)
+	if response := callShop("GET", path, "bob-key-0123456789", "", ""); response.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for the order of another user, got %d", response.Code)
+	}
+	response = callShop("GET", "/api/v1/orders", "alice-key-0123456", "", "")
+	orders := []*Order{}
+	if err := json.NewDecoder(response.Body).Decode(&orders); err != nil || len(orders) == 0 || orders[0].ID != order.ID {
+		t.Errorf("expected the order first in the history, got %v (%v)", orders, err)
+	}
+}
+
+func TestConcurrentCheckoutsDontOversell(t *testing.T) {
+	dark := &Album{Title: "The Dark Side of the Moon", Price: "20"}
+	catalogAlbums(t, dark)
+	stockAlbum(t, dark, 5)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	paid, outOfStock := 0, 0
+	for i := 0; i < 10; i++ {
+		session := fmt.Sprintf("%032x", i+1)
+		if err := shopStore.SetCartItem(session, dark.ID, 1); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := checkout(context.Background(), session, "alice", "card")
+			var missing *OutOfStockError
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				paid++
+			case errors.As(err, &missing):
+				outOfStock++
+				shopStore.ClearCart(session)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if paid != 5 || outOfStock != 5 {
+		t.Errorf("expected 5 paid and 5 out of stock orders, got %d and %d", paid, outOfStock)
+	}
+	if quantity, _ := shopStore.GetStock(dark.ID); quantity != 0 {
+		t.Errorf("expected no copy left, got %d", quantity)
+	}
+}
+
+func TestOrderStatus(t *testing.T) {
+	withShopStaff(t)
+	dark := &Album{Title: "The Dark Side of the Moon", Price: "20"}
+	catalogAlbums(t, dark)
+	stockAlbum(t, dark, 4)
+
+	order := func(method string) (*Order, *httptest.ResponseRecorder) {
+		response := callShop("PUT", fmt.Sprintf("/api/v1/cart/items/%d", dark.ID), "", "", `{"quantity": 2}`)
+		session := response.Result().Cookies()[0].Value
+		response = callShop("POST", "/api/v1/orders", "alice-key-0123456", session, `{"paymentMethod": "`+method+`"}`)
+		if response.Code != http.StatusCreated {
+			return nil, response
+		}
+		return decodeOrder(t, response), response
+	}
+
+	// Declined payments cancel the order and put the albums back
+	_, response := order("declined-card")
+	if response.Code != http.StatusPaymentRequired || response.Header().Get("Location") == "" {
+		t.Errorf("expected 402 with the location of the order, got %d", response.Code)
+	}
+	if quantity, _ := shopStore.GetStock(dark.ID); quantity != 4 {
+		t.Errorf("expected the stock to be restored, got %d", quantity)
+	}
+
+	paid, _ := order("card")
+	path := orderURLv1(paid.ID) + "/status"
+	for key, status := range map[string]string{"alice-key-0123456": orderShipped, "bob-key-0123456789": orderPaid} {
+		if response := callShop("PUT", path, key, "", `{"status": "`+status+`"}`); response.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403 for %s, got %d", key, status, response.Code)
+		}
+	}
+	if response := callShop("PUT", path, "bob-key-0123456789", "", `{"status": "delivered"}`); response.Code != http.StatusConflict {
+		t.Errorf("expected 409 for delivering an order before shipping it, got %d", response.Code)
+	}
+
+	// Cancelling a paid order refunds it
+	response = callShop("PUT", path, "alice-key-0123456", "", `{"status": "cancelled"}`)
+	if response.Code != http.StatusOK {
+		t.Fatalf("cancelling failed with %d: %s", response.Code, response.Body)
+	}
+	if balance := payments.(*fakePayments).Balance(paid.PaymentReference); balance != 0 {
+		t.Errorf("expected the payment to be refunded, %d cents are left", balance)
+	}
+	if quantity, _ := shopStore.GetStock(dark.ID); quantity != 4 {
+		t.Errorf("expected the stock to be restored, got %d", quantity)
+	}
+	if response := callShop("PUT", path, "alice-key-0123456", "", `{"status": "cancelled"}`); response.Code != http.StatusConflict {
+		t.Errorf("expected 409 for cancelling twice, got %d", response.Code)
+	}
+
+	shipped, _ := order("card")
+	path = orderURLv1(shipped.ID) + "/status"
+	for _, status := range []string{orderShipped, orderDelivered} {
+		if response := callShop("PUT", path, "bob-key-0123456789", "", `{"status": "`+status+`"}`); response.Code != http.StatusOK {
+			t.Errorf("expected the staff to move the order to %s, got %d", status, response.Code)
+		}
+	}
+	if response := callShop("PUT", path, "alice-key-0123456", "", `{"status": "cancelled"}`); response.Code != http.StatusConflict {
+		t.Errorf("expected 409 for cancelling a delivered order, got %d", response.Code)
+	}
+}
+
+func TestStock(t *testing.T) {
+	withShopStaff(t)
+	dark := &Album{Title: "The Dark Side of the Moon", Price: "20"}
+	catalogAlbums(t, dark)
+	path := fmt.Sprintf("/api/v1/albums/%d/stock", dark.ID)
+
+	if response := callShop("GET", path, "", "", ""); !strings.Contains(response.Body.String(), `"quantity":0`) {
+		t.Errorf("expected no stock, got %s", response.Body)
+	}
+	for key, expected := range map[string]int{"": http.StatusUnauthorized, "alice-key-0123456": http.StatusForbidden, "bob-key-0123456789": http.StatusOK} {
+		if response := callShop("PUT", path, key, "", `{"quantity": 7}`); response.Code != expected {
+			t.Errorf("%q: expected %d, got %d", key, expected, response.Code)
+		}
+	}
+	if response := callShop("PUT", path, "bob-key-0123456789", "", `{"quantity": -1}`); response.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a negative stock, got %d", response.Code)
+	}
+	if response := callShop("GET", path, "", "", ""); !strings.Contains(response.Body.String(), `"quantity":7`) {
+		t.Errorf("expected 7 copies, got %s", response.Body)
+	}
+}
+
+// slowPayments holds the charges until the test lets them through, if it
+// has channels for it, and refuses the refunds when told to
+type slowPayments struct {
+	*fakePayments
+	charging, resume chan struct{}
+	refuseRefunds    bool
+}
+
+func withSlowPayments(t *testing.T, p *slowPayments) *slowPayments {
+	p.fakePayments = &fakePayments{}
+	InitPayments(p)
+	t.Cleanup(func() { InitPayments(&fakePayments{}) })
+	return p
+}
+
+func (p *slowPayments) Charge(ctx context.Context, orderID, amount int64, method string) (string, error) {
+	if p.charging != nil {
+		p.charging <- struct{}{}
+		<-p.resume
+	}
+	return p.fakePayments.Charge(ctx, orderID, amount, method)
+}
+
+func (p *slowPayments) Refund(ctx context.Context, reference string, amount int64) error {
+	if p.refuseRefunds {
+		return errors.New("the provider is down")
+	}
+	return p.fakePayments.Refund(ctx, reference, amount)
+}
+
+func TestCancellingDuringThePayment(t *testing.T) {
+	withListUsers(t)
+	p := withSlowPayments(t, &slowPayments{charging: make(chan struct{}), resume: make(chan struct{})})
+	dark := &Album{Title: "The Dark Side of the Moon", Price: "20"}
+	catalogAlbums(t, dark)
+	stockAlbum(t, dark, 3)
+
+	response := callShop("PUT", fmt.Sprintf("/api/v1/cart/items/%d", dark.ID), "", "", `{"quantity": 2}`)
+	session := response.Result().Cookies()[0].Value
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- callShop("POST", "/api/v1/orders", "alice-key-0123456", session, `{"paymentMethod": "card"}`)
+	}()
+	<-p.charging
+
+	orders, err := shopStore.ListOrders("alice")
+	if err != nil || len(orders) == 0 || orders[0].Status != orderPending {
+		t.Fatalf("expected a pending order, got %v (%v)", orders, err)
+	}
+	pending := orders[0]
+	if response := callShop("PUT", orderURLv1(pending.ID)+"/status", "alice-key-0123456", "", `{"status": "cancelled"}`); response.Code != http.StatusOK {
+		t.Fatalf("cancelling failed with %d: %s", response.Code, response.Body)
+	}
+	close(p.resume)
+
+	response = <-done
+	if response.Code != http.StatusConflict || response.Header().Get("Location") != orderURLv1(pending.ID) {
+		t.Errorf("expected 409 with the location of the order, got %d: %s", response.Code, response.Body)
+	}
+	order, err := shopStore.GetOrder(pending.ID)
+	if err != nil || order.Status != orderCancelled {
+		t.Fatalf("expected the order to stay cancelled, got %+v (%v)", order, err)
+	}
+	if balance := p.Balance(fmt.Sprintf("fake_1_order_%d", pending.ID)); balance != 0 {
+		t.Errorf("expected the payment to be refunded, %d cents are left", balance)
+	}
+	if quantity, _ := shopStore.GetStock(dark.ID); quantity != 3 {
+		t.Errorf("expected the stock to be restored once, got %d", quantity)
+	}
+}
+
+func TestFailedRefundsKeepTheOrderPaid(t *testing.T) {
+	withListUsers(t)
+	p := withSlowPayments(t, &slowPayments{})
+	dark := &Album{Title: "The Dark Side of the Moon", Price: "20"}
+	catalogAlbums(t, dark)
+	stockAlbum(t, dark, 3)
+
+	response := callShop("PUT", fmt.Sprintf("/api/v1/cart/items/%d", dark.ID), "", "", `{"quantity": 2}`)
+	session := response.Result().Cookies()[0].Value
+	response = callShop("POST", "/api/v1/orders", "alice-key-0123456", session, `{"paymentMethod": "card"}`)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("checking out failed with %d: %s", response.Code, response.Body)
+	}
+	paid := decodeOrder(t, response)
+
+	p.refuseRefunds = true
+	path := orderURLv1(paid.ID) + "/status"
+	if response := callShop("PUT", path, "alice-key-0123456", "", `{"status": "cancelled"}`); response.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 when the refund fails, got %d", response.Code)
+	}
+	if order, err := shopStore.GetOrder(paid.ID); err != nil || order.Status != orderPaid {
+		t.Errorf("expected the order to be paid again, got %+v (%v)", order, err)
+	}
+	if quantity, _ := shopStore.GetStock(dark.ID); quantity != 1 {
+		t.Errorf("expected the albums to stay reserved, got %d", quantity)
+	}
+
+	p.refuseRefunds = false
+	response = callShop("PUT", path, "alice-key-0123456", "", `{"status": "cancelled"}`)
+	if response.Code != http.StatusOK || decodeOrder(t, response).Status != orderCancelled {
+		t.Errorf("expected the order to be cancelled once the refund works, got %d", response.Code)
+	}
+	if response := callShop("PUT", path, "alice-key-0123456", "", `{"status": "cancelled"}`); !strings.Contains(response.Body.String(), "from cancelled to cancelled") {
+		t.Errorf("expected the conflict to name the status of the order, got %s", response.Body)
+	}
+}
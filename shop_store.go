@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// GetStock returns how many copies of an album are for sale. Albums that
+// were never stocked have none. It returns ErrAlbumNotFound if there is no
+// such album
+func (store *dbStore) GetStock(albumID int64) (int, error) {
+	var quantity int
+	err := store.queryRow("SELECT COALESCE(s.quantity, 0) FROM albums a LEFT JOIN album_stock s ON s.album_id = a.idAlbum WHERE a.idAlbum = $1",
+		[]interface{}{albumID}, &quantity)
+	if err == sql.ErrNoRows {
+		return 0, ErrAlbumNotFound
+	}
+	return quantity, err
+}
+
+func (store *dbStore) SetStock(albumID int64, quantity int) error {
+	if _, err := store.GetAlbum(albumID); err != nil {
+		return err
+	}
+	_, err := store.exec(`INSERT INTO album_stock(album_id, quantity) VALUES ($1, $2)
+		ON CONFLICT(album_id) DO UPDATE SET quantity = excluded.quantity`, albumID, quantity)
+	return err
+}
+
+// GetCart returns the albums in the cart of a session, in the order they
+// were added
+func (store *dbStore) GetCart(session string) ([]CartItem, error) {
+	rows, err := store.query(`SELECT c.album_id, c.quantity, COALESCE(s.quantity, 0), a.title, a.artist,
+		COALESCE(a.price, ''), COALESCE(a.year, ''), COALESCE(a.genre, '')
+		FROM cart_items c JOIN albums a ON a.idAlbum = c.album_id
+		LEFT JOIN album_stock s ON s.album_id = c.album_id
+		WHERE c.session = $1 ORDER BY c.added_at, c.album_id`, session)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []CartItem{}
+	for rows.Next() {
+		item := CartItem{Album: &Album{}}
+		if err := rows.Scan(&item.AlbumID, &item.Quantity, &item.InStock, &item.Album.Title, &item.Album.Artist,
+			&item.Album.Price, &item.Album.Year, &item.Album.Genre); err != nil {
+			return nil, err
+		}
+		item.Album.ID = item.AlbumID
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// SetCartItem sets how many copies of an album the cart of a session has,
+// and removes the album from the cart for 0
+func (store *dbStore) SetCartItem(session string, albumID int64, quantity int) error {
+	if quantity == 0 {
+		_, err := store.exec("DELETE FROM cart_items WHERE session = $1 AND album_id = $2", session, albumID)
+		return err
+	}
+	_, err := store.exec(`INSERT INTO cart_items(session, album_id, quantity, added_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT(session, album_id) DO UPDATE SET quantity = excluded.quantity`, session, albumID, quantity, time.Now().UTC())
+	return err
+}
+
+func (store *dbStore) ClearCart(session string) error {
+	_, err := store.exec("DELETE FROM cart_items WHERE session = $1", session)
+	return err
+}
+
+// CreateOrder records a pending order, takes its albums out of the stock and
+// empties the cart of the session, all at once. Each album is only taken if
+// enough of it is left, so concurrent orders can't sell more than the stock:
+// the order fails with an OutOfStockError instead, and nothing changes
+func (store *dbStore) CreateOrder(session string, order *Order) error {
+	start := time.Now()
+	const reserve = "UPDATE album_stock SET quantity = quantity - $1 WHERE album_id = $2 AND quantity >= $1"
+	err := func() error {
+		tx, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		// Writing first locks the database for the transaction right away,
+		// SQLite can't upgrade a read lock while another writer waits
+		missing := &OutOfStockError{}
+		for _, item := range order.Items {
+			res, err := tx.Exec(reserve, item.Quantity, item.AlbumID)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				missing.Items = append(missing.Items, CartItem{AlbumID: item.AlbumID, Quantity: item.Quantity})
+			}
+		}
+		if len(missing.Items) > 0 {
+			for i := range missing.Items {
+				if err := tx.QueryRow("SELECT COALESCE((SELECT quantity FROM album_stock WHERE album_id = $1), 0)",
+					missing.Items[i].AlbumID).Scan(&missing.Items[i].InStock); err != nil {
+					return err
+				}
+			}
+			return missing
+		}
+
+		order.CreatedAt = time.Now().UTC()
+		order.UpdatedAt = order.CreatedAt
+		res, err := tx.Exec("INSERT INTO orders(owner, status, total_cents, payment_reference, created_at, updated_at) VALUES ($1,$2,$3,$4,$5,$6)",
+			order.Owner, order.Status, order.Total, order.PaymentReference, order.CreatedAt, order.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		if order.ID, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		for _, item := range order.Items {
+			if _, err := tx.Exec("INSERT INTO order_items(order_id, album_id, title, artist, unit_price_cents, quantity) VALUES ($1,$2,$3,$4,$5,$6)",
+				order.ID, item.AlbumID, item.Title, item.Artist, item.UnitPrice, item.Quantity); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM cart_items WHERE session = $1", session); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if _, outOfStock := err.(*OutOfStockError); outOfStock {
+		store.logQuery(reserve, start, nil)
+	} else {
+		store.logQuery(reserve, start, err)
+	}
+	return err
+}
+
+func (store *dbStore) GetOrder(id int64) (*Order, error) {
+	orders, err := store.queryOrders("WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return nil, ErrOrderNotFound
+	}
+	return orders[0], nil
+}
+
+// ListOrders returns the orders of a user, newest first
+func (store *dbStore) ListOrders(owner string) ([]*Order, error) {
+	return store.queryOrders("WHERE owner = $1", owner)
+}
+
+func (store *dbStore) queryOrders(where string, args ...interface{}) ([]*Order, error) {
+	rows, err := store.query("SELECT id, owner, status, total_cents, payment_reference, created_at, updated_at FROM orders "+where+" ORDER BY id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []*Order{}
+	for rows.Next() {
+		order := &Order{}
+		if err := rows.Scan(&order.ID, &order.Owner, &order.Status, &order.Total, &order.PaymentReference, &order.CreatedAt, &order.UpdatedAt); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Closed before the items are read, as in queryLists
+	rows.Close()
+	for _, order := range orders {
+		if order.Items, err = store.queryOrderItems(order.ID); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+func (store *dbStore) queryOrderItems(orderID int64) ([]OrderItem, error) {
+	rows, err := store.query("SELECT album_id, title, artist, unit_price_cents, quantity FROM order_items WHERE order_id = $1 ORDER BY rowid", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []OrderItem{}
+	for rows.Next() {
+		item := OrderItem{}
+		if err := rows.Scan(&item.AlbumID, &item.Title, &item.Artist, &item.UnitPrice, &item.Quantity); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// UpdateOrderStatus moves an order from `from` to `to`, and saves its payment
+// reference. It returns ErrOrderStatusChanged if the order isn't `from`
+// anymore. Cancelled orders put their albums back in stock. The order only
+// changes once saved
+func (store *dbStore) UpdateOrderStatus(order *Order, from, to string) error {
+	start := time.Now()
+	const update = "UPDATE orders SET status = $1, payment_reference = $2, updated_at = $3 WHERE id = $4 AND status = $5"
+	err := func() error {
+		tx, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		now := time.Now().UTC()
+		res, err := tx.Exec(update, to, order.PaymentReference, now, order.ID, from)
+		if err != nil {
+			return err
+		}
+		if err := expectRow(res, ErrOrderStatusChanged); err != nil {
+			return err
+		}
+		if to == orderCancelled {
+			for _, item := range order.Items {
+				if _, err := tx.Exec(`INSERT INTO album_stock(album_id, quantity) VALUES ($1, $2)
+					ON CONFLICT(album_id) DO UPDATE SET quantity = quantity + excluded.quantity`, item.AlbumID, item.Quantity); err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		order.Status, order.UpdatedAt = to, now
+		return nil
+	}()
+	store.logQuery(update, start, err)
+	return err
+}
+
+func createShopTables(db *sql.DB) {
+	createStockTableSQL := `CREATE TABLE IF NOT EXISTS album_stock (
+		"album_id" integer NOT NULL PRIMARY KEY REFERENCES albums(idAlbum),
+		"quantity" integer NOT NULL CHECK (quantity >= 0)
+	  );`
+	createCartTableSQL := `CREATE TABLE IF NOT EXISTS cart_items (
+		"session" TEXT NOT NULL,
+		"album_id" integer NOT NULL REFERENCES albums(idAlbum),
+		"quantity" integer NOT NULL,
+		"added_at" DATETIME NOT NULL,
+		PRIMARY KEY (session, album_id)
+	  );`
+	createOrdersTableSQL := `CREATE TABLE IF NOT EXISTS orders (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"owner" TEXT NOT NULL,
+		"status" TEXT NOT NULL,
+		"total_cents" integer NOT NULL,
+		"payment_reference" TEXT NOT NULL,
+		"created_at" DATETIME NOT NULL,
+		"updated_at" DATETIME NOT NULL
+	  );`
+	createOrderItemsTableSQL := `CREATE TABLE IF NOT EXISTS order_items (
+		"order_id" integer NOT NULL REFERENCES orders(id),
+		"album_id" integer NOT NULL,
+		"title" TEXT NOT NULL,
+		"artist" TEXT NOT NULL,
+		"unit_price_cents" integer NOT NULL,
+		"quantity" integer NOT NULL
+	  );`
+	createIndexesSQL := []string{
+		`CREATE INDEX IF NOT EXISTS orders_owner ON orders(owner)`,
+		`CREATE INDEX IF NOT EXISTS order_items_order ON order_items(order_id)`,
+	}
+
+	for _, statement := range append([]string{createStockTableSQL, createCartTableSQL, createOrdersTableSQL, createOrderItemsTableSQL}, createIndexesSQL...) {
+		if _, err := db.Exec(statement); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+}
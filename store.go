@@ -2,23 +2,152 @@ package main
 
 // The sql go library is needed to interact with the database
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Our store will have two methods, to add a new bird,
-// and to get all existing birds
+// Our store has methods to add a new album, to get a single album,
+// to get all existing albums or only some of them, and to get the
+// artists and genres of the catalog
 // Each method returns an error, in case something goes wrong
 type Store interface {
 	CreateAlbum(album *Album) error
+	UpdateAlbum(album *Album) (previousPrice string, err error)
+	DeleteAlbum(id int64) error
+	GetAlbum(id int64) (*Album, error)
 	GetAlbums() ([]*Album, error)
+	ListAlbums(query AlbumQuery) ([]*Album, int, error)
+	ListArtists() ([]NamedCount, error)
+	ListGenres() ([]NamedCount, error)
 }
 
+// An AlbumQuery selects a page of albums. Empty filters match every album,
+// and a zero `Limit` means no limit
+type AlbumQuery struct {
+	Title  string // albums whose title contains this, ignoring case
+	Artist string
+	Genre  string
+	Year   string
+	// Sort is one of `albumSorts`, prefixed with "-" for the descending
+	// order. Albums are sorted by ID by default
+	Sort   string
+	Limit  int
+	Offset int
+}
+
+// albumSorts are the orders albums can be listed in, with the expression
+// they sort on. Prices are text, they are sorted as numbers
+var albumSorts = map[string]string{
+	"id":     "idAlbum",
+	"title":  "lower(title)",
+	"artist": "lower(artist)",
+	"year":   "year",
+	"price":  "CAST(price AS REAL)",
+}
+
+// validAlbumSort tells whether `sort` is a valid `AlbumQuery.Sort`
+func validAlbumSort(sort string) bool {
+	_, ok := albumSorts[strings.TrimPrefix(sort, "-")]
+	return sort == "" || ok
+}
+
+// orderBy turns a sort into an ORDER BY clause. The ID breaks the ties, so
+// that paging is stable
+func orderBy(sort string) (string, error) {
+	if sort == "" {
+		return " ORDER BY idAlbum", nil
+	}
+	direction := ""
+	if strings.HasPrefix(sort, "-") {
+		sort, direction = sort[1:], " DESC"
+	}
+	expression, ok := albumSorts[sort]
+	if !ok {
+		return "", fmt.Errorf("unknown sort %q", sort)
+	}
+	return " ORDER BY " + expression + direction + ", idAlbum" + direction, nil
+}
+
+// A NamedCount is an artist or a genre, with the number of its albums
+type NamedCount struct {
+	Name   string
+	Albums int
+}
+
+var (
+	// ErrAlbumNotFound is returned by the store when no album has the given ID
+	ErrAlbumNotFound = errors.New("album not found")
+	// ErrAlbumInCollections is returned when deleting an album users have
+	// copies of in their collections
+	ErrAlbumInCollections = errors.New("album is in collections")
+)
+
 // The `dbStore` struct will implement the `Store` interface
 // It also takes the sql DB connection object, which represents
 // the database connection.
+// The logger is the one of the request being served, see `storeFor`
 type dbStore struct {
-	db *sql.DB
+	db  *sql.DB
+	log *Logger
+}
+
+// Queries slower than this are logged as warnings
+const slowQuery = 100 * time.Millisecond
+
+// WithLogger returns a copy of the store that logs its queries with `l`
+func (store *dbStore) WithLogger(l *Logger) Store {
+	return &dbStore{db: store.db, log: l}
+}
+
+func (store *dbStore) logger() *Logger {
+	if store.log == nil {
+		return logger
+	}
+	return store.log
+}
+
+// logQuery logs every query at the debug level, and slow or failed ones
+// at a level that is seen in production
+func (store *dbStore) logQuery(query string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	l := store.logger().With("query", strings.Join(strings.Fields(query), " "), "duration_ms", float64(elapsed.Microseconds())/1000)
+	switch {
+	case err != nil && err != sql.ErrNoRows:
+		l.Error("query failed", "error", err)
+	case elapsed > slowQuery:
+		l.Warn("slow query")
+	default:
+		l.Debug("query")
+	}
+}
+
+func (store *dbStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := store.db.Exec(query, args...)
+	store.logQuery(query, start, err)
+	return res, err
+}
+
+func (store *dbStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := store.db.Query(query, args...)
+	store.logQuery(query, start, err)
+	return rows, err
+}
+
+// queryRow scans the row right away, since the error of `QueryRow` only
+// shows up when scanning
+func (store *dbStore) queryRow(query string, args []interface{}, dest ...interface{}) error {
+	start := time.Now()
+	err := store.db.QueryRow(query, args...).Scan(dest...)
+	store.logQuery(query, start, err)
+	return err
 }
 
 func (store *dbStore) CreateAlbum(album *Album) error {
@@ -26,22 +155,171 @@ func (store *dbStore) CreateAlbum(album *Album) error {
 	// THe first underscore means that we don't care about what's returned from
 	// this insert query. We just want to know if it was inserted correctly,
 	// and the error will be populated if it wasn't
-	_, err := store.db.Exec("INSERT INTO albums(title, artist, price) VALUES ($1,$2,$3)", album.Title, album.Artist, album.Price)
+	start := time.Now()
+	const insert = "INSERT INTO albums(title, artist, price, year, genre) VALUES ($1,$2,$3,$4,$5)"
+	err := func() error {
+		tx, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		res, err := tx.Exec(insert, album.Title, album.Artist, album.Price, album.Year, album.Genre)
+		if err != nil {
+			return err
+		}
+		// The caller gets the ID the database picked for the new album
+		if album.ID, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		if album.Price != "" {
+			if _, err := tx.Exec("INSERT INTO album_prices(album_id, price, changed_at) VALUES ($1, $2, $3)",
+				album.ID, album.Price, time.Now().UTC()); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	store.logQuery(insert, start, err)
+	return err
+}
+
+// UpdateAlbum saves the album, and records its new price in the price
+// history if it changed. It returns the price the album had until then, so
+// that price changes are told from the price that was actually replaced
+func (store *dbStore) UpdateAlbum(album *Album) (string, error) {
+	start := time.Now()
+	const update = "UPDATE albums SET title = $1, artist = $2, price = $3, year = $4, genre = $5 WHERE idAlbum = $6"
+	var previous string
+	err := func() error {
+		tx, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		// The history is written before the album, while the old price is
+		// still there to compare with. Writing first also locks the database
+		// right away, see CreateOrder
+		if _, err := tx.Exec(`INSERT INTO album_prices(album_id, price, changed_at)
+			SELECT idAlbum, $1, $2 FROM albums WHERE idAlbum = $3 AND COALESCE(price, '') != $1`,
+			album.Price, time.Now().UTC(), album.ID); err != nil {
+			return err
+		}
+		err = tx.QueryRow("SELECT COALESCE(price, '') FROM albums WHERE idAlbum = $1", album.ID).Scan(&previous)
+		if err == sql.ErrNoRows {
+			return ErrAlbumNotFound
+		}
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(update, album.Title, album.Artist, album.Price, album.Year, album.Genre, album.ID)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if errors.Is(err, ErrAlbumNotFound) {
+		store.logQuery(update, start, nil)
+	} else {
+		store.logQuery(update, start, err)
+	}
+	return previous, err
+}
+
+// DeleteAlbum removes the album, and everything that refers to it, at once
+func (store *dbStore) DeleteAlbum(id int64) error {
+	start := time.Now()
+	const remove = "DELETE FROM albums WHERE idAlbum = $1"
+	err := func() error {
+		tx, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		// The album leaves the lists it was in. It can't be sold anymore
+		// either, but the orders keep their copy of it. Writing first locks
+		// the database right away, see CreateOrder
+		for _, query := range []string{
+			"DELETE FROM album_list_items WHERE album_id = $1",
+			"DELETE FROM album_stock WHERE album_id = $1",
+			"DELETE FROM cart_items WHERE album_id = $1",
+			"DELETE FROM album_prices WHERE album_id = $1",
+			"DELETE FROM price_alerts WHERE album_id = $1",
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				return err
+			}
+		}
+
+		// The copies in the collections of the users are their records, and
+		// can't be shown without the album, so such albums stay
+		var collected bool
+		if err := tx.QueryRow("SELECT COUNT(*) > 0 FROM collection_items WHERE album_id = $1", id).Scan(&collected); err != nil {
+			return err
+		}
+		if collected {
+			return ErrAlbumInCollections
+		}
+
+		res, err := tx.Exec(remove, id)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if errors.Is(err, ErrAlbumNotFound) || errors.Is(err, ErrAlbumInCollections) {
+		store.logQuery(remove, start, nil)
+	} else {
+		store.logQuery(remove, start, err)
+	}
 	return err
 }
+
+// expectOneRow turns an update or delete that matched nothing into
+// ErrAlbumNotFound
+func expectOneRow(res sql.Result) error {
+	return expectRow(res, ErrAlbumNotFound)
+}
+
 func (store *dbStore) CreateTestAlbum(album *Album) error {
 	// 'Bird' is a simple struct which has "species" and "description" attributes
 	// THe first underscore means that we don't care about what's returned from
 	// this insert query. We just want to know if it was inserted correctly,
 	// and the error will be populated if it wasn't
-	_, err := store.db.Exec("INSERT INTO testalbum(title, artist, price) VALUES ($1,$2,$3)", album.Title, album.Artist, album.Price)
+	res, err := store.exec("INSERT INTO testalbum(title, artist, price, year, genre) VALUES ($1,$2,$3,$4,$5)", album.Title, album.Artist, album.Price, album.Year, album.Genre)
+	if err != nil {
+		return err
+	}
+	album.ID, err = res.LastInsertId()
 	return err
 }
 
+func (store *dbStore) GetAlbum(id int64) (*Album, error) {
+	album := &Album{}
+	err := store.queryRow("SELECT idAlbum, title, artist, COALESCE(price, ''), COALESCE(year, ''), COALESCE(genre, '') from albums WHERE idAlbum = $1",
+		[]interface{}{id}, &album.ID, &album.Title, &album.Artist, &album.Price, &album.Year, &album.Genre)
+	if err == sql.ErrNoRows {
+		return nil, ErrAlbumNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return album, nil
+}
+
 func (store *dbStore) GetAlbums() ([]*Album, error) {
 	// Query the database for all birds, and return the result to the
 	// `rows` object
-	rows, err := store.db.Query("SELECT title, artist, price from albums")
+	// The seeded albums have no price, so NULL columns are read as empty strings
+	rows, err := store.query("SELECT idAlbum, title, artist, COALESCE(price, ''), COALESCE(year, ''), COALESCE(genre, '') from albums")
 	// We return incase of an error, and defer the closing of the row structure
 	if err != nil {
 		return nil, err
@@ -56,7 +334,7 @@ func (store *dbStore) GetAlbums() ([]*Album, error) {
 		album := &Album{}
 		// Populate the `Species` and `Description` attributes of the bird,
 		// and return incase of an error
-		if err := rows.Scan(&album.Title, &album.Artist, &album.Price); err != nil {
+		if err := rows.Scan(&album.ID, &album.Title, &album.Artist, &album.Price, &album.Year, &album.Genre); err != nil {
 			return nil, err
 		}
 		// Finally, append the result to the returned array, and repeat for
@@ -69,7 +347,8 @@ func (store *dbStore) GetAlbums() ([]*Album, error) {
 func (store *dbStore) GetTestAlbums() ([]*Album, error) {
 	// Query the database for all birds, and return the result to the
 	// `rows` object
-	rows, err := store.db.Query("SELECT title, artist, price from testalbum")
+	// The seeded albums have no price, so NULL columns are read as empty strings
+	rows, err := store.query("SELECT idAlbum, title, artist, COALESCE(price, ''), COALESCE(year, ''), COALESCE(genre, '') from testalbum")
 	// We return incase of an error, and defer the closing of the row structure
 	if err != nil {
 		return nil, err
@@ -84,7 +363,7 @@ func (store *dbStore) GetTestAlbums() ([]*Album, error) {
 		album := &Album{}
 		// Populate the `Species` and `Description` attributes of the bird,
 		// and return incase of an error
-		if err := rows.Scan(&album.Title, &album.Artist, &album.Price); err != nil {
+		if err := rows.Scan(&album.ID, &album.Title, &album.Artist, &album.Price, &album.Year, &album.Genre); err != nil {
 			return nil, err
 		}
 		// Finally, append the result to the returned array, and repeat for
@@ -94,6 +373,89 @@ func (store *dbStore) GetTestAlbums() ([]*Album, error) {
 	return albums, nil
 }
 
+func (store *dbStore) ListAlbums(query AlbumQuery) ([]*Album, int, error) {
+	// Only the filters that are set end up in the WHERE clause
+	conditions := []string{"1 = 1"}
+	args := []interface{}{}
+	if query.Title != "" {
+		conditions = append(conditions, "instr(lower(title), lower(?)) > 0")
+		args = append(args, query.Title)
+	}
+	for _, filter := range []struct{ column, value string }{
+		{"artist", query.Artist},
+		{"genre", query.Genre},
+		{"year", query.Year},
+	} {
+		if filter.value != "" {
+			conditions = append(conditions, filter.column+" = ?")
+			args = append(args, filter.value)
+		}
+	}
+	where := " WHERE " + strings.Join(conditions, " AND ")
+
+	// The total is counted before paging, so callers know how many pages
+	// there are
+	var total int
+	if err := store.queryRow("SELECT COUNT(*) FROM albums"+where, args, &total); err != nil {
+		return nil, 0, err
+	}
+
+	order, err := orderBy(query.Sort)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// SQLite needs a LIMIT to accept an OFFSET, and -1 means no limit
+	limit := query.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := store.query("SELECT idAlbum, title, artist, COALESCE(price, ''), COALESCE(year, ''), COALESCE(genre, '') FROM albums"+
+		where+order+" LIMIT ? OFFSET ?", append(args, limit, query.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	albums := []*Album{}
+	for rows.Next() {
+		album := &Album{}
+		if err := rows.Scan(&album.ID, &album.Title, &album.Artist, &album.Price, &album.Year, &album.Genre); err != nil {
+			return nil, 0, err
+		}
+		albums = append(albums, album)
+	}
+	return albums, total, rows.Err()
+}
+
+func (store *dbStore) ListArtists() ([]NamedCount, error) {
+	return store.countBy("artist")
+}
+
+func (store *dbStore) ListGenres() ([]NamedCount, error) {
+	return store.countBy("genre")
+}
+
+// countBy lists the distinct values of a column with their number of albums.
+// `column` is never user input, so it is safe to build the query with it
+func (store *dbStore) countBy(column string) ([]NamedCount, error) {
+	rows, err := store.query("SELECT " + column + ", COUNT(*) FROM albums WHERE COALESCE(" + column + ", '') != '' GROUP BY " + column + " ORDER BY " + column)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []NamedCount{}
+	for rows.Next() {
+		count := NamedCount{}
+		if err := rows.Scan(&count.Name, &count.Albums); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
 // The store variable is a package level variable that will be available for
 // use throughout our application code
 var store Store
@@ -108,6 +470,34 @@ func InitStore(s Store) {
 	store = s
 }
 
+// storeFor returns the store to use while serving the request of `ctx`, so
+// that what the store logs carries the request ID. Stores that don't log
+// are used as they are
+func storeFor(ctx context.Context) Store {
+	if s, ok := store.(interface{ WithLogger(*Logger) Store }); ok {
+		return s.WithLogger(loggerFrom(ctx))
+	}
+	return store
+}
+
+// schemaVersion is the version of the tables this build works with. It has
+// to change whenever a table does, so that readiness checks notice a
+// database created by another build
+const schemaVersion = 5
+
+// setSchemaVersion records the version of the tables, once they are created.
+// SQLite keeps it in the header of the database file
+func setSchemaVersion(db *sql.DB) error {
+	_, err := db.Exec("PRAGMA user_version = " + strconv.Itoa(schemaVersion))
+	return err
+}
+
+func readSchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
 func createTestTable(db *sql.DB) {
 
 	dropTableSQL := `DROP TABLE IF EXISTS testalbum`
@@ -119,7 +509,8 @@ func createTestTable(db *sql.DB) {
 		"artist" TEXT,
 		"price" TEXT,
 		"class" TEXT,
-		"genre" TEXT
+		"genre" TEXT,
+		"year" TEXT
 	  );` // SQL Statement for Create Table
 
 	statement, err := db.Prepare(createAlbumsTableSQL) // Prepare SQL Statement
@@ -124,7 +124,7 @@ func (s *StoreSuite) TestGetBird() {
 	}
 
 	// Assert that the details of the bird is the same as the one we inserted
-	expectedAlbum := Album{"Halo", "Beyonce", "33.99"}
+	expectedAlbum := Album{ID: testalbum[0].ID, Title: "Halo", Artist: "Beyonce", Price: "33.99"}
 	if *testalbum[0] != expectedAlbum {
 		s.T().Errorf("incorrect details, expected %v, got %v", expectedAlbum, *testalbum[0])
 	}
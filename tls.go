@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// selfSignedValidity is how long generated certificates are valid for.
+// Delete the files to get a new one
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// loadTLSConfig loads the certificate of the configuration, generating a
+// self-signed one first if asked to and the files don't exist yet
+func loadTLSConfig(cfg *Config) (*tls.Config, error) {
+	if cfg.TLSSelfSigned && !fileExists(cfg.TLSCert) && !fileExists(cfg.TLSKey) {
+		if err := generateSelfSigned(cfg.TLSCert, cfg.TLSKey, time.Now()); err != nil {
+			return nil, fmt.Errorf("generating a self-signed certificate: %v", err)
+		}
+		logger.Warn("generated a self-signed certificate, only use it for development", "cert", cfg.TLSCert, "key", cfg.TLSKey)
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading the certificate: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// generateSelfSigned writes a certificate for localhost and the host name
+// of the machine, and its private key, as PEM files. The key is only
+// readable by its owner
+func generateSelfSigned(certFile, keyFile string, now time.Time) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Albumpedia development"}, CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0o600); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0o644)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// redirectToHTTPS sends every request to the same URL on the HTTPS server
+// listening on `httpsAddr`. GET and HEAD requests are redirected
+// permanently, the others keep their method and body
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "missing Host header", http.StatusBadRequest)
+			return
+		}
+		if port != "443" && port != "" {
+			host = net.JoinHostPort(host, port)
+		} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
+
+// hstsMiddleware tells browsers to only use HTTPS for `maxAge` seconds. The
+// header is ignored over plain HTTP, so it is only sent over HTTPS
+func hstsMiddleware(maxAge int) func(http.Handler) http.Handler {
+	value := "max-age=" + strconv.Itoa(maxAge)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil && maxAge > 0 {
+				w.Header().Set("Strict-Transport-Security", value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// newServers returns the servers of the configuration: the API over HTTP,
+// or over HTTPS with an optional server redirecting HTTP to it
+func newServers(cfg *Config, handler http.Handler) ([]*http.Server, error) {
+	if !cfg.UseTLS() {
+		return []*http.Server{newServer(cfg.Addr, handler)}, nil
+	}
+	tlsConfig, err := loadTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	srv := newServer(cfg.Addr, hstsMiddleware(cfg.HSTSMaxAge)(handler))
+	srv.TLSConfig = tlsConfig
+	servers := []*http.Server{srv}
+	if cfg.RedirectAddr != "" {
+		servers = append(servers, newServer(cfg.RedirectAddr, redirectToHTTPS(cfg.Addr)))
+	}
+	return servers, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelfSignedCertificateIsPersisted(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.TLSCert = filepath.Join(dir, "cert.pem")
+	cfg.TLSKey = filepath.Join(dir, "key.pem")
+	cfg.TLSSelfSigned = true
+
+	first, err := loadTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(cfg.TLSKey); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("the key should only be readable by its owner, got %v (%v)", info.Mode(), err)
+	}
+	leaf, err := x509.ParseCertificate(first.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+
+	// The second time, the same certificate is loaded
+	second, err := loadTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(second.Certificates[0].Certificate[0]) != string(first.Certificates[0].Certificate[0]) {
+		t.Error("the certificate should have been reused")
+	}
+}
+
+func TestServeHTTPS(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.TLSCert = filepath.Join(dir, "cert.pem")
+	cfg.TLSKey = filepath.Join(dir, "key.pem")
+	cfg.TLSSelfSigned = true
+	cfg.RedirectAddr = "127.0.0.1:0"
+
+	servers, err := newServers(cfg, newRouter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 {
+		t.Fatalf("expected an HTTPS and a redirecting server, got %d", len(servers))
+	}
+	srv := httptest.NewUnstartedServer(servers[0].Handler)
+	srv.TLS = servers[0].TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	response, err := client.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if hsts := response.Header.Get("Strict-Transport-Security"); hsts != "max-age=31536000" {
+		t.Errorf("unexpected Strict-Transport-Security header %q", hsts)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	cases := []struct {
+		httpsAddr, method, host, target string
+		status                          int
+	}{
+		{":443", http.MethodGet, "albums.example.com", "https://albums.example.com/albums?artist=Nirvana", http.StatusMovedPermanently},
+		{":8443", http.MethodGet, "albums.example.com:8080", "https://albums.example.com:8443/albums?artist=Nirvana", http.StatusMovedPermanently},
+		{":443", http.MethodPost, "[::1]:8080", "https://[::1]/albums?artist=Nirvana", http.StatusPermanentRedirect},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(c.method, "/albums?artist=Nirvana", nil)
+		request.Host = c.host
+		recorder := httptest.NewRecorder()
+		redirectToHTTPS(c.httpsAddr).ServeHTTP(recorder, request)
+		if recorder.Code != c.status || recorder.Header().Get("Location") != c.target {
+			t.Errorf("%s %s: expected %d to %s, got %d to %s", c.method, c.host, c.status, c.target, recorder.Code, recorder.Header().Get("Location"))
+		}
+	}
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	_, _, err := LoadConfig(testFlagSet(ioutil.Discard), []string{"-tls-cert", "cert.pem", "-redirect-addr", ":80", "-hsts-max-age", "-1"}, env(nil))
+	if err == nil {
+		t.Fatal("the configuration should be invalid")
+	}
+	for _, problem := range []string{"tls-key", "hsts-max-age"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("the error should mention %s, got %v", problem, err)
+		}
+	}
+
+	// Boolean settings don't need a value
+	cfg, _, err := LoadConfig(testFlagSet(ioutil.Discard), []string{"-tls-cert", "c.pem", "-tls-key", "k.pem", "-tls-self-signed"}, env(nil))
+	if err != nil || !cfg.TLSSelfSigned {
+		t.Errorf("expected a self-signed configuration, got %v", err)
+	}
+}
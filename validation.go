@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxTitleLength  = 200
+	maxArtistLength = 200
+	maxGenreLength  = 50
+	// The first commercial records were pressed in the 1890s, so nothing
+	// older can be an album
+	minAlbumYear = 1890
+)
+
+// albumFieldLengths are the maximum lengths of the text fields
+var albumFieldLengths = map[string]int{
+	"title":  maxTitleLength,
+	"artist": maxArtistLength,
+	"genre":  maxGenreLength,
+}
+
+// maxAlbumYear is the latest year an album can be from. Albums are
+// announced before they are released, so it is next year
+func maxAlbumYear() int {
+	return time.Now().Year() + 1
+}
+
+// Prices are plain decimal amounts with at most two decimal places, such as
+// "22" or "22.99". Currencies and thousands separators are not accepted
+var priceFormat = regexp.MustCompile(`^[0-9]+(\.[0-9]{1,2})?$`)
+
+// priceCents turns a price in the format of `priceFormat` into cents, so
+// that prices are added up without rounding errors
+func priceCents(price string) (int64, bool) {
+	if !priceFormat.MatchString(price) {
+		return 0, false
+	}
+	units, decimals, _ := strings.Cut(price, ".")
+	decimals += "00"
+	cents, err := strconv.ParseInt(units+decimals[:2], 10, 64)
+	return cents, err == nil
+}
+
+// formatCents formats cents as a price in the format of `priceFormat`,
+// always with two decimals
+func formatCents(cents int64) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// Validate checks the fields of an album before it is stored. Leading and
+// trailing spaces are removed first, so a title made of spaces is empty.
+// It returns one error per invalid field, or nil if the album is valid
+func (album *Album) Validate() []fieldError {
+	album.Title = strings.TrimSpace(album.Title)
+	album.Artist = strings.TrimSpace(album.Artist)
+	album.Price = strings.TrimSpace(album.Price)
+	album.Year = strings.TrimSpace(album.Year)
+	album.Genre = strings.TrimSpace(album.Genre)
+
+	var errs []fieldError
+	errs = appendRequired(errs, "title", album.Title, maxTitleLength)
+	errs = appendRequired(errs, "artist", album.Artist, maxArtistLength)
+
+	if utf8.RuneCountInString(album.Genre) > maxGenreLength {
+		errs = append(errs, fieldError{"genre", "too_long", "must be at most " + strconv.Itoa(maxGenreLength) + " characters"})
+	}
+
+	if album.Year != "" {
+		maxYear := maxAlbumYear()
+		year, err := strconv.Atoi(album.Year)
+		if err != nil || year < minAlbumYear || year > maxYear {
+			errs = append(errs, fieldError{"year", "out_of_range", "must be a year between " + strconv.Itoa(minAlbumYear) + " and " + strconv.Itoa(maxYear)})
+		}
+	}
+
+	if album.Price != "" && !priceFormat.MatchString(album.Price) {
+		errs = append(errs, fieldError{"price", "invalid_format", "must be a decimal amount such as 22.99"})
+	}
+
+	return errs
+}
+
+func appendRequired(errs []fieldError, field, value string, maxLength int) []fieldError {
+	if value == "" {
+		return append(errs, fieldError{field, "required", "is required"})
+	}
+	if utf8.RuneCountInString(value) > maxLength {
+		return append(errs, fieldError{field, "too_long", "must be at most " + strconv.Itoa(maxLength) + " characters"})
+	}
+	return errs
+}
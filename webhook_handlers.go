@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Secrets shorter than this would be too easy to guess
+const minWebhookSecretLength = 16
+
+// The event types a webhook can subscribe to
+var webhookEventTypes = []string{eventAlbumCreated, eventAlbumUpdated, eventAlbumDeleted}
+
+// registerWebhookRoutes adds the webhook management routes to `r`. Webhooks
+// make the server send requests to other systems, and belong to none of the
+// users, so only the staff may manage them
+func registerWebhookRoutes(r *mux.Router) {
+	r.Handle("/webhooks", requireStaff(createWebhookHandler)).Methods("POST")
+	r.Handle("/webhooks", requireStaff(listWebhooksHandler)).Methods("GET")
+	r.Handle("/webhooks/{id:[0-9]+}", requireStaff(getWebhookHandler)).Methods("GET")
+	r.Handle("/webhooks/{id:[0-9]+}", requireStaff(deleteWebhookHandler)).Methods("DELETE")
+	r.Handle("/webhooks/{id:[0-9]+}/deliveries", requireStaff(listDeliveriesHandler)).Methods("GET")
+	r.Handle("/webhooks/{id:[0-9]+}/deliveries/{delivery:[0-9]+}", requireStaff(getDeliveryHandler)).Methods("GET")
+	r.Handle("/webhooks/{id:[0-9]+}/deliveries/{delivery:[0-9]+}/replay", requireStaff(replayDeliveryHandler)).Methods("POST")
+}
+
+// requireAPIKey refuses requests that don't carry a known API key
+func requireAPIKey(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := apiUser(r); !ok {
+			w.Header().Set("WWW-Authenticate", `APIKey header="X-API-Key"`)
+			writeProblem(w, r, http.StatusUnauthorized, "A valid API key is required in the X-API-Key header.")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// webhookRequest is the body of a request creating a webhook
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+func (req *webhookRequest) Validate() []fieldError {
+	var errs []fieldError
+
+	u, err := url.Parse(req.URL)
+	if req.URL == "" {
+		errs = append(errs, fieldError{"url", "required", "is required"})
+	} else if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fieldError{"url", "invalid_format", "must be an absolute http or https URL"})
+	} else if !webhookHostAllowed(u.Hostname()) {
+		errs = append(errs, fieldError{"url", "not_allowed", "must not point to a loopback, link-local or private address"})
+	}
+
+	if len(req.Events) == 0 {
+		errs = append(errs, fieldError{"events", "required", "is required"})
+	}
+	for _, event := range req.Events {
+		if !isWebhookEventType(event) {
+			errs = append(errs, fieldError{"events", "invalid_format", "must only contain " + strings.Join(webhookEventTypes, ", ")})
+			break
+		}
+	}
+
+	if utf8.RuneCountInString(req.Secret) < minWebhookSecretLength {
+		errs = append(errs, fieldError{"secret", "too_short", "must be at least " + strconv.Itoa(minWebhookSecretLength) + " characters"})
+	}
+	return errs
+}
+
+func isWebhookEventType(event string) bool {
+	for _, t := range webhookEventTypes {
+		if t == event {
+			return true
+		}
+	}
+	return false
+}
+
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	req := webhookRequest{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAlbumBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "The request body could not be parsed: "+err.Error())
+		return
+	}
+	if errs := req.Validate(); errs != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "The webhook has invalid fields.", errs...)
+		return
+	}
+
+	hook := &Webhook{URL: req.URL, Events: req.Events, Secret: req.Secret}
+	if err := webhookStore.CreateWebhook(hook); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", apiV1Prefix+"/webhooks/"+strconv.FormatInt(hook.ID, 10))
+	writeJSON(w, r, http.StatusCreated, hook)
+}
+
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks, err := webhookStore.ListWebhooks()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, hooks)
+}
+
+func getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook, ok := findWebhook(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, hook)
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	err := webhookStore.DeleteWebhook(id)
+	if errors.Is(err, ErrWebhookNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "There is no webhook with this ID.")
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	hook, ok := findWebhook(w, r)
+	if !ok {
+		return
+	}
+	deliveries, err := webhookStore.ListDeliveries(hook.ID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, deliveries)
+}
+
+func getDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	_, delivery, ok := findDelivery(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, delivery)
+}
+
+// replayDeliveryHandler sends the payload of a delivery again. The new
+// delivery is made in the background, so its outcome has to be looked up in
+// the delivery log
+func replayDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	hook, delivery, ok := findDelivery(w, r)
+	if !ok {
+		return
+	}
+	replay, err := webhooks.Replay(hook, delivery)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", apiV1Prefix+"/webhooks/"+strconv.FormatInt(hook.ID, 10)+"/deliveries/"+strconv.FormatInt(replay.ID, 10))
+	writeJSON(w, r, http.StatusAccepted, replay)
+}
+
+// findWebhook loads the webhook of the route, or answers with an error
+func findWebhook(w http.ResponseWriter, r *http.Request) (*Webhook, bool) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	hook, err := webhookStore.GetWebhook(id)
+	if errors.Is(err, ErrWebhookNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "There is no webhook with this ID.")
+		return nil, false
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return nil, false
+	}
+	return hook, true
+}
+
+// findDelivery loads the webhook and the delivery of the route, or answers
+// with an error
+func findDelivery(w http.ResponseWriter, r *http.Request) (*Webhook, *WebhookDelivery, bool) {
+	hook, ok := findWebhook(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	id, _ := strconv.ParseInt(mux.Vars(r)["delivery"], 10, 64)
+	delivery, err := webhookStore.GetDelivery(hook.ID, id)
+	if errors.Is(err, ErrWebhookNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "This webhook has no delivery with this ID.")
+		return nil, nil, false
+	}
+	if err != nil {
+		writeServerError(w, r, err)
+		return nil, nil, false
+	}
+	return hook, delivery, true
+}
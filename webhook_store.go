@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// The webhook store keeps the subscriptions and a log of every delivery
+// attempt made for them
+type WebhookStore interface {
+	CreateWebhook(hook *Webhook) error
+	GetWebhook(id int64) (*Webhook, error)
+	ListWebhooks() ([]*Webhook, error)
+	DeleteWebhook(id int64) error
+	CreateDelivery(delivery *WebhookDelivery) error
+	UpdateDelivery(delivery *WebhookDelivery) error
+	GetDelivery(webhookID, id int64) (*WebhookDelivery, error)
+	ListDeliveries(webhookID int64) ([]*WebhookDelivery, error)
+}
+
+// ErrWebhookNotFound is returned when there is no webhook, or no delivery of
+// this webhook, with the given ID
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+func (store *dbStore) CreateWebhook(hook *Webhook) error {
+	hook.CreatedAt = time.Now().UTC()
+	res, err := store.exec("INSERT INTO webhooks(url, events, secret, created_at) VALUES ($1,$2,$3,$4)",
+		hook.URL, strings.Join(hook.Events, ","), hook.Secret, hook.CreatedAt)
+	if err != nil {
+		return err
+	}
+	hook.ID, err = res.LastInsertId()
+	return err
+}
+
+func (store *dbStore) GetWebhook(id int64) (*Webhook, error) {
+	hooks, err := store.queryWebhooks("WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(hooks) == 0 {
+		return nil, ErrWebhookNotFound
+	}
+	return hooks[0], nil
+}
+
+func (store *dbStore) ListWebhooks() ([]*Webhook, error) {
+	return store.queryWebhooks("")
+}
+
+func (store *dbStore) queryWebhooks(where string, args ...interface{}) ([]*Webhook, error) {
+	rows, err := store.query("SELECT id, url, events, secret, created_at FROM webhooks "+where+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []*Webhook{}
+	for rows.Next() {
+		hook := &Webhook{}
+		var events string
+		if err := rows.Scan(&hook.ID, &hook.URL, &events, &hook.Secret, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		hook.Events = strings.Split(events, ",")
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (store *dbStore) DeleteWebhook(id int64) error {
+	// The deliveries go with the webhook they belong to
+	if _, err := store.exec("DELETE FROM webhook_deliveries WHERE webhook_id = $1", id); err != nil {
+		return err
+	}
+	res, err := store.exec("DELETE FROM webhooks WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrWebhookNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (store *dbStore) CreateDelivery(delivery *WebhookDelivery) error {
+	delivery.CreatedAt = time.Now().UTC()
+	res, err := store.exec(`INSERT INTO webhook_deliveries(webhook_id, event_id, event_type, payload, status, attempts, response_code, error, created_at, replay_of)
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)`,
+		delivery.WebhookID, delivery.EventID, delivery.EventType, delivery.Payload, delivery.Status,
+		delivery.Attempts, delivery.ResponseCode, delivery.Error, delivery.CreatedAt, delivery.ReplayOf)
+	if err != nil {
+		return err
+	}
+	delivery.ID, err = res.LastInsertId()
+	return err
+}
+
+func (store *dbStore) UpdateDelivery(delivery *WebhookDelivery) error {
+	_, err := store.exec(`UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, response_code = $3, error = $4, last_attempt_at = $5
+		WHERE id = $6`,
+		delivery.Status, delivery.Attempts, delivery.ResponseCode, delivery.Error, delivery.LastAttemptAt, delivery.ID)
+	return err
+}
+
+func (store *dbStore) GetDelivery(webhookID, id int64) (*WebhookDelivery, error) {
+	deliveries, err := store.queryDeliveries("WHERE webhook_id = $1 AND id = $2", webhookID, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, ErrWebhookNotFound
+	}
+	return deliveries[0], nil
+}
+
+func (store *dbStore) ListDeliveries(webhookID int64) ([]*WebhookDelivery, error) {
+	return store.queryDeliveries("WHERE webhook_id = $1", webhookID)
+}
+
+func (store *dbStore) queryDeliveries(where string, args ...interface{}) ([]*WebhookDelivery, error) {
+	rows, err := store.query(`SELECT id, webhook_id, event_id, event_type, payload, status, attempts,
+		response_code, error, created_at, last_attempt_at, replay_of
+		FROM webhook_deliveries `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		delivery := &WebhookDelivery{}
+		var lastAttempt sql.NullTime
+		var replayOf sql.NullInt64
+		if err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventID, &delivery.EventType, &delivery.Payload,
+			&delivery.Status, &delivery.Attempts, &delivery.ResponseCode, &delivery.Error, &delivery.CreatedAt,
+			&lastAttempt, &replayOf); err != nil {
+			return nil, err
+		}
+		if lastAttempt.Valid {
+			delivery.LastAttemptAt = &lastAttempt.Time
+		}
+		if replayOf.Valid {
+			delivery.ReplayOf = &replayOf.Int64
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func createWebhookTables(db *sql.DB) {
+	createWebhooksTableSQL := `CREATE TABLE IF NOT EXISTS webhooks (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"url" TEXT NOT NULL,
+		"events" TEXT NOT NULL,
+		"secret" TEXT NOT NULL,
+		"created_at" DATETIME NOT NULL
+	  );`
+	createDeliveriesTableSQL := `CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"webhook_id" integer NOT NULL REFERENCES webhooks(id),
+		"event_id" integer NOT NULL,
+		"event_type" TEXT NOT NULL,
+		"payload" TEXT NOT NULL,
+		"status" TEXT NOT NULL,
+		"attempts" integer NOT NULL,
+		"response_code" integer NOT NULL,
+		"error" TEXT NOT NULL,
+		"created_at" DATETIME NOT NULL,
+		"last_attempt_at" DATETIME,
+		"replay_of" integer
+	  );`
+
+	for _, statement := range []string{createWebhooksTableSQL, createDeliveriesTableSQL} {
+		if _, err := db.Exec(statement); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+}
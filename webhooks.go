@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A Webhook asks for the events of the given types to be posted to a URL.
+// The secret is used to sign the payloads, and is never sent back
+type Webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Wants reports whether the webhook subscribed to this type of event
+func (hook *Webhook) Wants(eventType string) bool {
+	for _, e := range hook.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// The states of a delivery. A delivery is pending while it is being retried
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+)
+
+// A WebhookDelivery is one event sent to one webhook, with the outcome of
+// its latest attempt. Replaying a delivery creates a new one, which points
+// to the original in `ReplayOf`
+type WebhookDelivery struct {
+	ID            int64      `json:"id"`
+	WebhookID     int64      `json:"webhookId"`
+	EventID       uint64     `json:"eventId"`
+	EventType     string     `json:"eventType"`
+	Payload       string     `json:"payload"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	ResponseCode  int        `json:"responseCode,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	LastAttemptAt *time.Time `json:"lastAttemptAt,omitempty"`
+	ReplayOf      *int64     `json:"replayOf,omitempty"`
+}
+
+// The headers sent with every delivery. The signature covers the timestamp
+// and the body, so that a captured delivery can't be sent again later by
+// somebody else
+const (
+	webhookEventHeader     = "X-Albumpedia-Event"
+	webhookDeliveryHeader  = "X-Albumpedia-Delivery"
+	webhookTimestampHeader = "X-Albumpedia-Timestamp"
+	webhookSignatureHeader = "X-Albumpedia-Signature"
+)
+
+// signWebhook computes the value of the signature header: the hex encoded
+// HMAC-SHA256 of "<timestamp>.<body>", keyed with the webhook secret
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// errWebhookTarget is returned when a delivery would be sent to an address
+// webhooks can't reach
+var errWebhookTarget = errors.New("webhook target is not a public address")
+
+// webhookTargetAllowed tells whether webhooks may reach an address. Loopback,
+// link-local and private addresses are refused, so that webhooks can't be
+// used to send requests to the services next to the server. The tests, whose
+// receivers listen on loopback, replace it
+var webhookTargetAllowed = isPublicIP
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+// webhookHostAllowed checks the host of a webhook URL, or the addresses it
+// resolves to. Hosts that don't resolve yet are left to the check made when
+// delivering
+func webhookHostAllowed(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return webhookTargetAllowed(ip)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return true
+	}
+	for _, ip := range ips {
+		if !webhookTargetAllowed(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newWebhookClient returns the client deliveries are sent with. It checks
+// every address it connects to, since a host can resolve to another address
+// than when its webhook was created, and redirects can lead anywhere
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !webhookTargetAllowed(ip) {
+				return fmt.Errorf("%w: %s", errWebhookTarget, host)
+			}
+			return nil
+		},
+	}
+	// No proxy, the addresses checked are the ones of the receivers
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// The webhookDispatcher turns album events into deliveries, and sends them
+// in the background, retrying failed attempts with an exponential backoff
+type webhookDispatcher struct {
+	store       WebhookStore
+	client      *http.Client
+	maxAttempts int
+	// The first retry waits `retryBase`, and every following one twice as
+	// long as the previous one, plus some jitter
+	retryBase time.Duration
+	// Cancelling the context stops the dispatcher and every delivery
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWebhookDispatcher(s WebhookStore) *webhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookDispatcher{
+		store:       s,
+		client:      newWebhookClient(),
+		maxAttempts: 6,
+		retryBase:   time.Second,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+var (
+	webhookStore WebhookStore
+	webhooks     *webhookDispatcher
+)
+
+func InitWebhooks(s WebhookStore) {
+	webhookStore = s
+	webhooks = newWebhookDispatcher(s)
+}
+
+// Start delivers the events published on the broker from now on, until
+// `Close` is called
+func (d *webhookDispatcher) Start(broker *eventBroker) {
+	// Subscribing before returning makes sure that no event published after
+	// Start is missed
+	lastID := broker.LastID()
+	_, _, events, cancel := broker.Subscribe(lastID)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.run(broker, lastID, events, cancel)
+	}()
+}
+
+// Close stops the dispatcher, and waits for the deliveries in progress to
+// stop. Deliveries cut short stay pending, and can be replayed
+func (d *webhookDispatcher) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (d *webhookDispatcher) run(broker *eventBroker, lastID uint64, events <-chan AlbumEvent, cancel func()) {
+	for {
+		select {
+		case event, ok := <-events:
+			if ok {
+				d.dispatch(event)
+				lastID = event.ID
+				continue
+			}
+			// We fell behind and the broker dropped us. Subscribing again
+			// resumes from the last event we handled, as long as the
+			// broker still has it
+			cancel()
+			var missed []AlbumEvent
+			missed, _, events, cancel = broker.Subscribe(lastID)
+			for _, event := range missed {
+				d.dispatch(event)
+				lastID = event.ID
+			}
+		case <-d.ctx.Done():
+			cancel()
+			return
+		}
+	}
+}
+
+// dispatch creates a delivery for every webhook that wants the event, and
+// starts sending them
+func (d *webhookDispatcher) dispatch(event AlbumEvent) {
+	hooks, err := d.store.ListWebhooks()
+	if err != nil {
+		logger.Error("listing webhooks failed", "event_id", event.ID, "error", err)
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("encoding an event failed", "event_id", event.ID, "error", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if !hook.Wants(event.Type) {
+			continue
+		}
+		delivery := &WebhookDelivery{
+			WebhookID: hook.ID,
+			EventID:   event.ID,
+			EventType: event.Type,
+			Payload:   string(payload),
+			Status:    deliveryPending,
+		}
+		if err := d.store.CreateDelivery(delivery); err != nil {
+			logger.Error("creating a delivery failed", "webhook_id", hook.ID, "event_id", event.ID, "error", err)
+			continue
+		}
+		d.send(hook, delivery)
+	}
+}
+
+// send delivers in the background, retrying until the webhook answers with
+// a 2xx status or the attempts run out. The delivery belongs to the
+// goroutine from then on
+func (d *webhookDispatcher) send(hook *Webhook, delivery *WebhookDelivery) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			d.attempt(hook, delivery)
+			if delivery.Status != deliveryPending {
+				return
+			}
+
+			select {
+			case <-time.After(d.backoff(delivery.Attempts)):
+			case <-d.ctx.Done():
+				// The delivery stays pending, its log shows it was cut short
+				return
+			}
+		}
+	}()
+}
+
+// backoff is how long to wait after the given number of failed attempts
+func (d *webhookDispatcher) backoff(attempts int) time.Duration {
+	wait := d.retryBase << uint(attempts-1)
+	jitter := time.Duration(rand.Int63n(int64(wait)/4 + 1))
+	return wait + jitter
+}
+
+// attempt makes a single delivery attempt and records its outcome
+func (d *webhookDispatcher) attempt(hook *Webhook, delivery *WebhookDelivery) {
+	now := time.Now().UTC()
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	delivery.ResponseCode, delivery.Error = 0, ""
+
+	status, err := d.post(hook, delivery, now)
+	switch {
+	case err != nil:
+		delivery.Error = err.Error()
+	case status < 200 || status > 299:
+		delivery.ResponseCode = status
+		delivery.Error = "unexpected status " + strconv.Itoa(status)
+	default:
+		delivery.ResponseCode = status
+		delivery.Status = deliverySucceeded
+	}
+	if delivery.Status == deliveryPending && delivery.Attempts >= d.maxAttempts {
+		delivery.Status = deliveryFailed
+	}
+
+	if err := d.store.UpdateDelivery(delivery); err != nil {
+		logger.Error("recording a delivery failed", "webhook_id", hook.ID, "delivery_id", delivery.ID, "error", err)
+	}
+	if delivery.Status == deliveryFailed {
+		logger.Warn("webhook delivery failed", "webhook_id", hook.ID, "delivery_id", delivery.ID, "attempts", delivery.Attempts, "error", delivery.Error)
+	}
+}
+
+func (d *webhookDispatcher) post(hook *Webhook, delivery *WebhookDelivery, now time.Time) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(d.ctx, "POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Albumpedia-Webhooks/1.0")
+	req.Header.Set(webhookEventHeader, delivery.EventType)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(hook.Secret, now.Unix(), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Reading the body lets the connection be reused. We don't need it,
+	// so only a little of it is read
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// Replay sends the payload of an earlier delivery again, as a new delivery
+func (d *webhookDispatcher) Replay(hook *Webhook, original *WebhookDelivery) (*WebhookDelivery, error) {
+	replayOf := original.ID
+	delivery := &WebhookDelivery{
+		WebhookID: hook.ID,
+		EventID:   original.EventID,
+		EventType: original.EventType,
+		Payload:   original.Payload,
+		Status:    deliveryPending,
+		ReplayOf:  &replayOf,
+	}
+	if err := d.store.CreateDelivery(delivery); err != nil {
+		return nil, err
+	}
+	// The caller gets a copy, since the delivery now belongs to `send`
+	created := *delivery
+	d.send(hook, delivery)
+	return &created, nil
+}
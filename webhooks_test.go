@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	// Computed with: printf '1700000000.{"id":1}' | openssl dgst -sha256 -hmac 'a very secret key'
+	expected := "sha256=357578215dc57fb40b84852f4a3d9079ef6e33f3f2c62767b7e6116c7fd4388a"
+	actual := signWebhook("a very secret key", 1700000000, []byte(`{"id":1}`))
+	if actual != expected {
+		t.Errorf("signature should be %s, got %s", expected, actual)
+	}
+	// The signature depends on the timestamp, the body and the secret
+	for _, other := range []string{
+		signWebhook("a very secret key", 1700000001, []byte(`{"id":1}`)),
+		signWebhook("a very secret key", 1700000000, []byte(`{"id":2}`)),
+		signWebhook("another secret key", 1700000000, []byte(`{"id":1}`)),
+	} {
+		if other == actual {
+			t.Errorf("different inputs should have different signatures")
+		}
+	}
+}
+
+func TestWebhookDeliveryWithRetries(t *testing.T) {
+	InitAPIKeys(map[string]string{"test-key": "tester"})
+	defer InitAPIKeys(map[string]string{})
+	InitStaff([]string{"tester"})
+	defer InitStaff(nil)
+	allowLoopbackWebhooks(t)
+
+	// The receiver fails the first attempt, then checks the signature
+	var mu sync.Mutex
+	calls := 0
+	received := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		first := calls == 1
+		mu.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(webhookTimestampHeader), 10, 64)
+		if r.Header.Get(webhookSignatureHeader) != signWebhook("0123456789abcdef", timestamp, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		received <- r.Header.Get(webhookEventHeader)
+	}))
+	defer receiver.Close()
+
+	webhooks = newWebhookDispatcher(webhookStore)
+	webhooks.retryBase = 10 * time.Millisecond
+	webhooks.Start(albumEvents)
+	defer webhooks.Close()
+
+	r := newRouter()
+
+	// Subscribe to deletions only
+	body := `{"url": "` + receiver.URL + `", "events": ["album.deleted"], "secret": "0123456789abcdef"}`
+	req := httptest.NewRequest("POST", "/api/v1/webhooks", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "test-key")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("creating the webhook failed with %d: %s", recorder.Code, recorder.Body)
+	}
+	hook := Webhook{}
+	if err := json.NewDecoder(recorder.Body).Decode(&hook); err != nil {
+		t.Fatal(err)
+	}
+
+	// Creating an album is not delivered, deleting it is
+	album := &Album{Title: "Thriller", Artist: "Michael Jackson"}
+	if err := createAlbum(context.Background(), album); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteAlbum(context.Background(), album.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-received:
+		if event != eventAlbumDeleted {
+			t.Errorf("expected an %s event, got %s", eventAlbumDeleted, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was never delivered")
+	}
+
+	// The delivery log shows the failed attempt followed by the successful
+	// one, once the dispatcher has recorded the answer
+	deliveries := []WebhookDelivery{}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		getJSON(t, r, "/api/v1/webhooks/"+strconv.FormatInt(hook.ID, 10)+"/deliveries", &deliveries)
+		if len(deliveries) == 1 && deliveries[0].Status != deliveryPending {
+			break
+		}
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != deliverySucceeded || deliveries[0].Attempts != 2 {
+		t.Fatalf("expected one delivery that succeeded on the second attempt, got %+v", deliveries)
+	}
+
+	// Replaying the delivery sends the same payload again
+	path := "/api/v1/webhooks/" + strconv.FormatInt(hook.ID, 10) + "/deliveries/" + strconv.FormatInt(deliveries[0].ID, 10) + "/replay"
+	req = httptest.NewRequest("POST", path, nil)
+	req.Header.Set("X-API-Key", "test-key")
+	recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("replay failed with %d: %s", recorder.Code, recorder.Body)
+	}
+	replay := WebhookDelivery{}
+	if err := json.NewDecoder(recorder.Body).Decode(&replay); err != nil {
+		t.Fatal(err)
+	}
+	if replay.ReplayOf == nil || *replay.ReplayOf != deliveries[0].ID || replay.Payload != deliveries[0].Payload {
+		t.Errorf("unexpected replay %+v", replay)
+	}
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the replay was never delivered")
+	}
+}
+
+func TestWebhookRoutesRequireAPIKey(t *testing.T) {
+	r := newRouter()
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/v1/webhooks", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Status should be 401, got %d", recorder.Code)
+	}
+}
+
+func TestWebhookRoutesRequireStaff(t *testing.T) {
+	withShopStaff(t)
+	for _, route := range []struct{ method, path string }{
+		{"POST", "/api/v1/webhooks"},
+		{"GET", "/api/v1/webhooks"},
+		{"DELETE", "/api/v1/webhooks/1"},
+		{"POST", "/api/v1/webhooks/1/deliveries/1/replay"},
+	} {
+		if response := callAPI(route.method, route.path, "alice-key-0123456", "{}"); response.Code != http.StatusForbidden {
+			t.Errorf("%s %s: expected 403 for a customer, got %d", route.method, route.path, response.Code)
+		}
+	}
+	if response := callAPI("GET", "/api/v1/webhooks", "bob-key-0123456789", ""); response.Code != http.StatusOK {
+		t.Errorf("expected the staff to list the webhooks, got %d", response.Code)
+	}
+}
+
+// allowLoopbackWebhooks lets webhooks reach the receivers of the tests
+func allowLoopbackWebhooks(t *testing.T) {
+	webhookTargetAllowed = func(ip net.IP) bool { return true }
+	t.Cleanup(func() { webhookTargetAllowed = isPublicIP })
+}
+
+func TestWebhooksCantReachInternalAddresses(t *testing.T) {
+	for _, target := range []string{"http://127.0.0.1:8080/hook", "http://[::1]/hook", "http://localhost/hook",
+		"http://169.254.169.254/latest/meta-data", "https://10.1.2.3/hook", "http://192.168.0.1/hook", "http://0.0.0.0/hook"} {
+		req := webhookRequest{URL: target, Events: []string{eventAlbumCreated}, Secret: "0123456789abcdef"}
+		if errs := req.Validate(); len(errs) != 1 || errs[0].Code != "not_allowed" {
+			t.Errorf("%s: expected the URL to be refused, got %v", target, errs)
+		}
+	}
+
+	// Hosts resolving to internal addresses later are stopped when delivering
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the receiver shouldn't be reached")
+	}))
+	defer receiver.Close()
+	if _, err := newWebhookClient().Post(receiver.URL, "application/json", nil); !errors.Is(err, errWebhookTarget) {
+		t.Errorf("expected the delivery to be refused, got %v", err)
+	}
+}
+
+func TestWebhookValidation(t *testing.T) {
+	tests := []struct {
+		req   webhookRequest
+		field string
+	}{
+		{webhookRequest{URL: "ftp://example.com", Events: []string{eventAlbumCreated}, Secret: "0123456789abcdef"}, "url"},
+		{webhookRequest{URL: "https://example.com", Events: []string{"album.played"}, Secret: "0123456789abcdef"}, "events"},
+		{webhookRequest{URL: "https://example.com", Events: []string{eventAlbumCreated}, Secret: "short"}, "secret"},
+	}
+	for _, test := range tests {
+		errs := test.req.Validate()
+		if len(errs) != 1 || errs[0].Field != test.field {
+			t.Errorf("%+v: expected an error on %s, got %v", test.req, test.field, errs)
+		}
+	}
+}
+
+func getJSON(t *testing.T, handler http.Handler, path string, v interface{}) {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("X-API-Key", "test-key")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("GET %s failed with %d: %s", path, recorder.Code, recorder.Body)
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}